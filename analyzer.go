@@ -0,0 +1,463 @@
+package pto3
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Analyzer registry for PTO3 obs.
+// Analyzers are registered by name; each registration of an analyzer metadata
+// document (the JSON object an observation set's _analyzer URL refers to)
+// under a name creates a new version of that analyzer. A version is
+// identified by its link in the PTO (/analyzer/<name>/<version>), and
+// optionally by an external URL (e.g. a link to the document in the
+// analyzer's source repository), which always refers to the most recent
+// version registered under it. Observation sets whose _analyzer refers to a
+// registered version are linked to it in the database.
+//
+// The metadata document may declare a JSON Schema for the metadata of the
+// sets the analyzer produces, in its _metadata_schema key, and the conditions
+// those sets may declare, in its _conditions key. Sets linked to a registered
+// analyzer are validated against these on insertion and update. Sets whose
+// analyzer is not registered are not validated.
+
+// Analyzer is a registered version of an analyzer metadata document.
+type Analyzer struct {
+	// Analyzer ID in the database
+	ID int
+	// Analyzer name
+	Name string
+	// Version number, starting at 1 for each name
+	Version int
+	// External analyzer metadata URL this version is registered under, if any
+	URL string
+	// Owner identity, from _owner
+	Owner string
+	// Conditions declared by the analyzer, from _conditions
+	Conditions []string `pg:",array"`
+	// Source code repository, from _repository
+	Repository string
+	// Source code revision (tag or commit), from _revision
+	Revision string
+	// Analyzer metadata document
+	Document map[string]interface{}
+	// Registration timestamp
+	Registered *time.Time
+	// system metadata
+	link string
+}
+
+// createAnalyzerNameVersionIndex ensures analyzer versions are unique per name.
+const createAnalyzerNameVersionIndex = "CREATE UNIQUE INDEX IF NOT EXISTS analyzers_name_version_idx ON analyzers (name, version)"
+
+// createAnalyzerURLIndex ensures external analyzer URLs are unique overall.
+const createAnalyzerURLIndex = "CREATE UNIQUE INDEX IF NOT EXISTS analyzers_url_idx ON analyzers (url)"
+
+// analyzerRegistryLock is the advisory lock class serializing registration
+// of versions of each analyzer, keyed within the class by analyzer name.
+const analyzerRegistryLock = 0x616e6c7a
+
+var analyzerNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// NewAnalyzer creates an Analyzer with the given name from an analyzer
+// metadata document, checking that the document has an owner and that any
+// metadata schema and condition list it declares are well-formed.
+func NewAnalyzer(name string, doc []byte) (*Analyzer, error) {
+	if !analyzerNameRegexp.MatchString(name) {
+		return nil, PTOErrorf("bad analyzer name %s", name).StatusIs(http.StatusBadRequest)
+	}
+
+	a := Analyzer{Name: name}
+	if err := json.Unmarshal(doc, &a.Document); err != nil {
+		return nil, PTOErrorf("analyzer metadata for %s is not a JSON object: %s", name, err.Error()).StatusIs(http.StatusBadRequest)
+	}
+
+	owner, ok := a.Document["_owner"].(string)
+	if !ok || owner == "" {
+		return nil, PTOMissingMetadataError("_owner")
+	}
+	a.Owner = owner
+
+	a.Repository, _ = a.Document["_repository"].(string)
+	a.Revision, _ = a.Document["_revision"].(string)
+
+	if schema, ok := a.Document["_metadata_schema"]; ok {
+		if err := checkJSONSchema(schema, "/_metadata_schema"); err != nil {
+			return nil, PTOErrorf("analyzer metadata for %s: %s", name, err.Error()).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	if conditions, ok := a.Document["_conditions"]; ok {
+		cl, ok := conditions.([]interface{})
+		for i := 0; ok && i < len(cl); i++ {
+			var c string
+			c, ok = cl[i].(string)
+			a.Conditions = append(a.Conditions, c)
+		}
+		if !ok {
+			return nil, PTOErrorf("analyzer metadata for %s: _conditions not a string array", name).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	return &a, nil
+}
+
+// Register inserts this Analyzer into the database as the next version of
+// the analyzer with its name. If it has an external URL, that URL is moved
+// from any previous version to this one; it is an error for the URL to be
+// registered to an analyzer with a different name. Registrations of the same
+// name are serialized by an advisory lock held until the end of the
+// transaction, so concurrent registrations get distinct versions.
+func (a *Analyzer) Register(t *pg.Tx) error {
+	if _, err := t.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", analyzerRegistryLock, a.Name); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if a.URL != "" {
+		var previous []Analyzer
+		if err := t.Model(&previous).Where("url = ?", a.URL).Select(); err != nil {
+			return PTOWrapError(err)
+		}
+		for _, p := range previous {
+			if p.Name != a.Name {
+				return PTOErrorf("analyzer URL %s already registered to analyzer %s", a.URL, p.Name).StatusIs(http.StatusConflict)
+			}
+		}
+
+		if _, err := t.Exec("UPDATE analyzers SET url = NULL WHERE url = ?", a.URL); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	var latest struct {
+		Version int
+	}
+	if _, err := t.QueryOne(&latest,
+		"SELECT coalesce(max(version), 0) AS version FROM analyzers WHERE name = ?", a.Name); err != nil {
+		return PTOWrapError(err)
+	}
+
+	rtime := time.Now().UTC()
+	a.ID = 0
+	a.Version = latest.Version + 1
+	a.Registered = &rtime
+
+	if err := t.Insert(a); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// RegisterAnalyzer registers a new version of the named analyzer from an
+// analyzer metadata document, optionally under an external URL, within a
+// transaction.
+func RegisterAnalyzer(db *pg.DB, name string, analyzerURL string, doc []byte) (*Analyzer, error) {
+	a, err := NewAnalyzer(name, doc)
+	if err != nil {
+		return nil, err
+	}
+	a.URL = analyzerURL
+
+	if err := db.RunInTransaction(func(t *pg.Tx) error {
+		return a.Register(t)
+	}); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// LookupAnalyzer retrieves a given version of the named analyzer from the
+// database, or the latest version if the version is 0. FIXME as with
+// ObservationSet.SelectByID, this returns pg.ErrNoRows unwrapped if there is
+// no such analyzer.
+func LookupAnalyzer(db orm.DB, name string, version int) (*Analyzer, error) {
+	var a Analyzer
+	q := db.Model(&a).Where("name = ?", name)
+	if version > 0 {
+		q = q.Where("version = ?", version)
+	}
+	if err := q.Order("version DESC").First(); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, err
+		}
+		return nil, PTOWrapError(err)
+	}
+	return &a, nil
+}
+
+// LookupAnalyzerByURL retrieves the registered analyzer version an
+// observation set's _analyzer URL refers to, or nil if it refers to none. The
+// URL matches either the external URL a version is registered under, or a
+// version's link on this instance, as given by the configuration
+// (<base>/analyzer/<name>/<version>, or <base>/analyzer/<name> for the latest
+// version). Links to other instances' registries do not match, as versions
+// are numbered separately on each instance.
+func LookupAnalyzerByURL(db orm.DB, config *PTOConfiguration, analyzerURL string) (*Analyzer, error) {
+	var a Analyzer
+	err := db.Model(&a).Where("url = ?", analyzerURL).First()
+	if err == nil {
+		return &a, nil
+	} else if err != pg.ErrNoRows {
+		return nil, PTOWrapError(err)
+	}
+
+	name, version, ok := parseAnalyzerLink(config, analyzerURL)
+	if !ok {
+		return nil, nil
+	}
+
+	found, err := LookupAnalyzer(db, name, version)
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	return found, err
+}
+
+// parseAnalyzerLink extracts an analyzer name and version from an analyzer
+// link on this instance, as given by the configuration. The version is 0 if
+// the link refers to the latest version.
+func parseAnalyzerLink(config *PTOConfiguration, link string) (string, int, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", 0, false
+	}
+
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	var name string
+	var version int
+	if len(path) >= 3 && path[len(path)-3] == "analyzer" {
+		version, err = strconv.Atoi(path[len(path)-1])
+		if err != nil || version < 1 {
+			return "", 0, false
+		}
+		name = path[len(path)-2]
+	} else if len(path) >= 2 && path[len(path)-2] == "analyzer" {
+		name = path[len(path)-1]
+	} else {
+		return "", 0, false
+	}
+
+	// only links this instance would generate refer to its registry
+	if LinkForAnalyzer(config, name, version) != link {
+		return "", 0, false
+	}
+
+	return name, version, true
+}
+
+// AnalyzerNames lists the names of all registered analyzers, in order.
+func AnalyzerNames(db orm.DB) ([]string, error) {
+	var names []string
+	err := db.Model(&Analyzer{}).
+		ColumnExpr("array_agg(DISTINCT name)").
+		Select(pg.Array(&names))
+	if err == pg.ErrNoRows || names == nil {
+		return make([]string, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// AnalyzerVersions retrieves all versions of the named analyzer, oldest
+// first. It returns pg.ErrNoRows if there is no analyzer with that name.
+func AnalyzerVersions(db orm.DB, name string) ([]Analyzer, error) {
+	var versions []Analyzer
+	if err := db.Model(&versions).Where("name = ?", name).Order("version").Select(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if len(versions) == 0 {
+		return nil, pg.ErrNoRows
+	}
+
+	return versions, nil
+}
+
+// LinkForAnalyzer returns a link to a given version of the named analyzer,
+// or to its latest version if the version is 0.
+func LinkForAnalyzer(config *PTOConfiguration, name string, version int) string {
+	var link string
+	if version > 0 {
+		link, _ = config.LinkTo(fmt.Sprintf("/analyzer/%s/%d", name, version))
+	} else {
+		link, _ = config.LinkTo(fmt.Sprintf("/analyzer/%s", name))
+	}
+	return link
+}
+
+// LinkVia sets the link for this Analyzer given a configuration.
+func (a *Analyzer) LinkVia(config *PTOConfiguration) {
+	a.link = LinkForAnalyzer(config, a.Name, a.Version)
+}
+
+// MarshalJSON returns the analyzer metadata document with registry
+// information in __ keys.
+func (a *Analyzer) MarshalJSON() ([]byte, error) {
+	jmap := make(map[string]interface{})
+
+	for k, v := range a.Document {
+		jmap[k] = v
+	}
+
+	jmap["__name"] = a.Name
+	jmap["__version"] = a.Version
+
+	if a.link != "" {
+		jmap["__link"] = a.link
+	}
+
+	if a.URL != "" {
+		jmap["__url"] = a.URL
+	}
+
+	if a.Registered != nil {
+		jmap["__registered"] = a.Registered.Format(time.RFC3339)
+	}
+
+	return json.Marshal(jmap)
+}
+
+// allowsCondition determines whether the analyzer's declared conditions
+// include a given condition name. Declared names ending in * match any
+// condition with the preceding prefix. An analyzer declaring no conditions
+// allows any condition.
+func (a *Analyzer) allowsCondition(name string) bool {
+	if _, ok := a.Document["_conditions"]; !ok {
+		return true
+	}
+
+	for _, c := range a.Conditions {
+		if c == name || (strings.HasSuffix(c, "*") && strings.HasPrefix(name, strings.TrimSuffix(c, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks an ObservationSet's metadata and declared conditions
+// against this analyzer's metadata schema and condition list, returning a
+// list of violations. An empty list means the set conforms.
+func (a *Analyzer) Validate(set *ObservationSet) ([]string, error) {
+	var violations []string
+
+	for _, c := range set.Conditions {
+		if !a.allowsCondition(c.Name) {
+			violations = append(violations, "/_conditions: condition "+c.Name+" not declared by analyzer")
+		}
+	}
+
+	if schema, ok := a.Document["_metadata_schema"]; ok {
+		doc, err := set.metadataDocument()
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, validateJSONSchema(schema, doc, "")...)
+	}
+
+	return violations, nil
+}
+
+// metadataDocument returns this ObservationSet's metadata as it would be
+// uploaded, i.e. without server-maintained __ keys, as unmarshaled JSON.
+func (set *ObservationSet) metadataDocument() (interface{}, error) {
+	jmap := make(map[string]interface{})
+	for k, v := range set.Metadata {
+		jmap[k] = v
+	}
+
+	jmap["_sources"] = set.Sources
+	jmap["_analyzer"] = set.Analyzer
+
+	conditionNames := make([]string, len(set.Conditions))
+	for i := range set.Conditions {
+		conditionNames[i] = set.Conditions[i].Name
+	}
+	jmap["_conditions"] = conditionNames
+
+	if len(set.Supersedes) > 0 {
+		jmap["_supersedes"] = supersessionLinks(nil, set.Supersedes)
+	}
+
+	// round-trip through JSON to get the same types a schema sees on upload
+	b, err := json.Marshal(jmap)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return doc, nil
+}
+
+// linkAnalyzer links this ObservationSet to the registered analyzer version
+// its _analyzer URL refers to, if any, and validates the set against it,
+// returning an error listing every violation if it does not conform. If the
+// configuration requires registered analyzers, it is an error for the URL to
+// refer to none.
+func (set *ObservationSet) linkAnalyzer(db orm.DB, config *PTOConfiguration) error {
+	set.AnalyzerID = 0
+
+	a, err := LookupAnalyzerByURL(db, config, set.Analyzer)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		if config.RequireRegisteredAnalyzer {
+			return PTOErrorf("analyzer %s not registered", set.Analyzer).StatusIs(http.StatusBadRequest)
+		}
+		return nil
+	}
+
+	violations, err := a.Validate(set)
+	if err != nil {
+		return err
+	}
+
+	if len(violations) > 0 {
+		return PTOErrorf("observation set metadata does not conform to analyzer %s version %d: %s",
+			a.Name, a.Version, strings.Join(violations, "; ")).StatusIs(http.StatusBadRequest)
+	}
+
+	set.AnalyzerID = a.ID
+	return nil
+}
+
+// ObservationSetIDsWithRegisteredAnalyzer lists all observation set IDs in
+// the database linked to any version of the named registered analyzer.
+func ObservationSetIDsWithRegisteredAnalyzer(db orm.DB, name string) ([]int, error) {
+	var setIds []int
+
+	err := db.Model(&ObservationSet{}).
+		ColumnExpr("array_agg(observation_set.id)").
+		Join("JOIN analyzers AS a ON a.id = observation_set.analyzer_id").
+		Where("a.name = ?", name).
+		Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Ints(setIds)
+
+	return setIds, nil
+}
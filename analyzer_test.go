@@ -0,0 +1,259 @@
+package pto3_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mami-project/pto3-go"
+)
+
+const testSchemaAnalyzer = "https://localhost:8383/schema_test_analyzer.json"
+
+func TestAnalyzerSchemaValidation(t *testing.T) {
+	// schemas using unsupported keywords must be rejected at registration
+	if _, err := pto3.RegisterAnalyzer(TestDB, "schema_test", testSchemaAnalyzer,
+		[]byte(`{"_owner": "ptotest@example.com", "_metadata_schema": {"properties": {"x": {"$ref": "#/definitions/x"}}}}`)); err == nil {
+		t.Fatal("analyzer schema with $ref accepted")
+	}
+
+	a, err := pto3.RegisterAnalyzer(TestDB, "schema_test", testSchemaAnalyzer, []byte(`{
+		"_owner": "ptotest@example.com",
+		"description": "an analyzer for testing metadata validation",
+		"_conditions": ["pto.test.schema.*", "pto.test.color.red"],
+		"_metadata_schema": {
+			"type": "object",
+			"required": ["schema_test_runs"],
+			"properties": {
+				"schema_test_runs": {"type": "integer", "minimum": 1},
+				"schema_test_mode": {"enum": ["fast", "thorough"]}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSets := []struct {
+		metadata   string
+		violations []string
+	}{
+		{`{"_conditions": ["pto.test.schema.works"], "schema_test_runs": 3, "schema_test_mode": "fast"}`, nil},
+		{`{"_conditions": ["pto.test.color.red"], "schema_test_runs": 1}`, nil},
+		{`{"_conditions": ["pto.test.schema.works"], "schema_test_mode": "fast"}`,
+			[]string{"/: missing required key schema_test_runs"}},
+		{`{"_conditions": ["pto.test.schema.works"], "schema_test_runs": 1.5, "schema_test_mode": "slow"}`,
+			[]string{"/schema_test_runs: expected integer", `/schema_test_mode: value "slow" not one of`}},
+		{`{"_conditions": ["pto.test.color.blue"], "schema_test_runs": 0}`,
+			[]string{"condition pto.test.color.blue not declared", "/schema_test_runs: value 0 less than minimum 1"}},
+	}
+
+	for i, ts := range testSets {
+		set := pto3.ObservationSet{}
+		md := `{"_sources": ["https://localhost:8383/raw/schema/schema-0.ndjson"], "_analyzer": "` +
+			testSchemaAnalyzer + `", ` + strings.TrimPrefix(ts.metadata, "{")
+		if err := json.Unmarshal([]byte(md), &set); err != nil {
+			t.Fatal(err)
+		}
+
+		err := set.Insert(TestDB, TestConfig, true)
+		if ts.violations == nil {
+			if err != nil {
+				t.Fatalf("conforming set %d rejected: %s", i, err.Error())
+			}
+			if set.AnalyzerID != a.ID {
+				t.Fatalf("conforming set %d not linked to analyzer", i)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("nonconforming set %d accepted", i)
+		}
+		for _, v := range ts.violations {
+			if !strings.Contains(err.Error(), v) {
+				t.Fatalf("set %d error %q does not report %q", i, err.Error(), v)
+			}
+		}
+	}
+}
+
+func TestAnalyzerRegistry(t *testing.T) {
+	const registryAnalyzer = "https://localhost:8383/registry_test_analyzer.json"
+
+	if _, err := pto3.RegisterAnalyzer(TestDB, "registry_test", "", []byte(`{"description": "no owner"}`)); err == nil {
+		t.Fatal("analyzer without _owner accepted")
+	}
+
+	if _, err := pto3.RegisterAnalyzer(TestDB, "registry/test", "", []byte(`{"_owner": "ptotest@example.com"}`)); err == nil {
+		t.Fatal("analyzer with bad name accepted")
+	}
+
+	v1, err := pto3.RegisterAnalyzer(TestDB, "registry_test", registryAnalyzer, []byte(`{
+		"_owner": "ptotest@example.com",
+		"_repository": "https://github.com/mami-project/pto3-go",
+		"_revision": "v1.0",
+		"_conditions": ["pto.test.registry.v1"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a set using the external URL is linked to the first version
+	set1 := pto3.ObservationSet{
+		Sources:    []string{"https://localhost:8383/raw/registry/registry-0.ndjson"},
+		Analyzer:   registryAnalyzer,
+		Conditions: []pto3.Condition{{Name: "pto.test.registry.v1"}},
+	}
+	if err := set1.Insert(TestDB, TestConfig, true); err != nil {
+		t.Fatal(err)
+	}
+	if set1.AnalyzerID != v1.ID {
+		t.Fatalf("set not linked to analyzer version 1")
+	}
+
+	// registering again moves the URL to a new version
+	v2, err := pto3.RegisterAnalyzer(TestDB, "registry_test", registryAnalyzer, []byte(`{
+		"_owner": "ptotest@example.com",
+		"_repository": "https://github.com/mami-project/pto3-go",
+		"_revision": "v2.0",
+		"_conditions": ["pto.test.registry.v2"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.Version != 2 || v2.Revision != "v2.0" || v2.Owner != "ptotest@example.com" {
+		t.Fatalf("unexpected second analyzer version %d revision %s owner %s", v2.Version, v2.Revision, v2.Owner)
+	}
+
+	// so the old condition is no longer allowed via the URL...
+	set2 := pto3.ObservationSet{
+		Sources:    []string{"https://localhost:8383/raw/registry/registry-1.ndjson"},
+		Analyzer:   registryAnalyzer,
+		Conditions: []pto3.Condition{{Name: "pto.test.registry.v1"}},
+	}
+	if err := set2.Insert(TestDB, TestConfig, true); err == nil {
+		t.Fatal("set with condition not declared by latest analyzer version accepted")
+	}
+
+	// ...but is via a link to the first version
+	set2.Analyzer = pto3.LinkForAnalyzer(TestConfig, "registry_test", 1)
+	if err := set2.Insert(TestDB, TestConfig, true); err != nil {
+		t.Fatal(err)
+	}
+	if set2.AnalyzerID != v1.ID {
+		t.Fatalf("set not linked to analyzer version 1 by link")
+	}
+
+	// links to another instance's registry refer to other analyzers
+	set3 := pto3.ObservationSet{
+		Sources:    []string{"https://localhost:8383/raw/registry/registry-2.ndjson"},
+		Analyzer:   "https://pto.elsewhere.example.com/analyzer/registry_test/1",
+		Conditions: []pto3.Condition{{Name: "pto.test.registry.elsewhere"}},
+	}
+	if err := set3.Insert(TestDB, TestConfig, true); err != nil {
+		t.Fatal(err)
+	}
+	if set3.AnalyzerID != 0 {
+		t.Fatalf("set linked to local analyzer by link to another instance")
+	}
+
+	// the URL cannot be claimed by another analyzer
+	if _, err := pto3.RegisterAnalyzer(TestDB, "registry_thief", registryAnalyzer,
+		[]byte(`{"_owner": "ptotest@example.com"}`)); err == nil {
+		t.Fatal("analyzer URL registered to two analyzers")
+	}
+
+	versions, err := pto3.AnalyzerVersions(TestDB, "registry_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].URL != "" || versions[1].URL != registryAnalyzer {
+		t.Fatalf("unexpected analyzer versions %v", versions)
+	}
+
+	latest, err := pto3.LookupAnalyzer(TestDB, "registry_test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.ID != v2.ID {
+		t.Fatalf("latest analyzer version is %d, expected %d", latest.Version, v2.Version)
+	}
+
+	names, err := pto3.AnalyzerNames(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, name := range names {
+		if name == "registry_test" {
+			found = true
+		} else if name == "registry_thief" {
+			t.Fatal("analyzer with conflicting URL registered")
+		}
+	}
+	if !found {
+		t.Fatalf("registry_test missing from analyzer names %v", names)
+	}
+
+	setIds, err := pto3.ObservationSetIDsWithRegisteredAnalyzer(TestDB, "registry_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setIds) != 2 {
+		t.Fatalf("expected two sets linked to registry_test, got %v", setIds)
+	}
+}
+
+func TestRequireRegisteredAnalyzer(t *testing.T) {
+	requireConfig, err := pto3.NewConfigFromJSON([]byte(`{
+		"BaseURL": "https://localhost:8383",
+		"RequireRegisteredAnalyzer": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidCache := pto3.NewPathCache(0)
+
+	unregistered := `{"_analyzer": "https://localhost:8383/require_test_analyzer.json", "_sources": ["https://localhost:8383/raw/require/require-0.ndjson"], "_conditions": ["pto.test.require"]}
+["", "2017-12-09T04:05:06Z", "2017-12-09T04:05:07Z", "10.0.2.1 * 10.0.2.2", "pto.test.require"]`
+
+	// files loaded with an unregistered analyzer are rejected if so configured...
+	if _, err := pto3.CopySetFromObsStream(strings.NewReader(unregistered), TestDB, requireConfig, cidCache, pidCache); err == nil {
+		t.Fatal("set with unregistered analyzer loaded")
+	}
+
+	// ...and accepted otherwise
+	set, err := pto3.CopySetFromObsStream(strings.NewReader(unregistered), TestDB, TestConfig, cidCache, pidCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as are archives containing them
+	var archive bytes.Buffer
+	if err := pto3.ExportObsArchive(TestDB, TestConfig, []int{set.ID}, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pto3.ImportObsArchive(bytes.NewReader(archive.Bytes()), TestDB, requireConfig, cidCache, pidCache); err == nil {
+		t.Fatal("archive with unregistered analyzer imported")
+	}
+
+	// once the analyzer is registered, both are accepted
+	if _, err := pto3.RegisterAnalyzer(TestDB, "require_test", "https://localhost:8383/require_test_analyzer.json",
+		[]byte(`{"_owner": "ptotest@example.com", "_conditions": ["pto.test.require"]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pto3.CopySetFromObsStream(strings.NewReader(unregistered), TestDB, requireConfig, cidCache, pidCache); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pto3.ImportObsArchive(bytes.NewReader(archive.Bytes()), TestDB, requireConfig, cidCache, pidCache); err != nil {
+		t.Fatal(err)
+	}
+}
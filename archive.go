@@ -0,0 +1,564 @@
+package pto3
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Observation set archives for PTO3 obs.
+// An archive moves observation sets between PTO instances. It is a
+// zstd-compressed tar file containing a manifest, the registry entries of the
+// conditions used by the sets, and, for each set, its metadata, its
+// provenance, and its observations as an observation set file:
+//
+//   manifest.json
+//   conditions.json
+//   sets/<id>/metadata.json
+//   sets/<id>/provenance.json
+//   sets/<id>/obs.ndjson
+//
+// Sets are given new IDs when imported. Source links into the exporting
+// instance are rewritten to refer to the importing instance, with links to
+// sets in the archive following them to their new IDs.
+
+// ObsArchiveContentType is the content type of an observation set archive.
+const ObsArchiveContentType = "application/zstd"
+
+// Identifier and version of the archive format
+const (
+	obsArchiveFormat  = "pto3-obs-archive"
+	obsArchiveVersion = 1
+)
+
+// ObsArchiveManifest describes the contents of an observation set archive.
+type ObsArchiveManifest struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Base URL of the PTO instance the sets were exported from
+	BaseURL string `json:"base_url"`
+	// Export timestamp
+	Exported *time.Time `json:"exported"`
+	// IDs of the exported sets, in hexadecimal, in archive order
+	Sets []string `json:"sets"`
+}
+
+// writeArchiveEntry writes a file of a given size from a reader to a tar
+// archive.
+func writeArchiveEntry(tw *tar.Writer, name string, modified time.Time, size int64, r io.Reader) error {
+	hdr := tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modified,
+	}
+
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := io.Copy(tw, r); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// writeArchiveJSON writes a value as a JSON file to a tar archive.
+func writeArchiveJSON(tw *tar.Writer, name string, modified time.Time, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	return writeArchiveEntry(tw, name, modified, int64(len(b)), bytes.NewReader(b))
+}
+
+// writeArchiveObservations writes an observation set, as an observation set
+// file, to a tar archive. Archive entries need their size up front, so the
+// file is written to a temporary file first.
+func writeArchiveObservations(tw *tar.Writer, name string, modified time.Time, db orm.DB, set *ObservationSet) error {
+	tmp, err := ioutil.TempFile("", "pto3-archive")
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	out := bufio.NewWriter(tmp)
+
+	b, err := json.Marshal(set)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// copying an empty set would wait for observations forever
+	if set.CountObservations(db) > 0 {
+		if err := set.CopyDataToStream(db, out); err != nil {
+			return err
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return writeArchiveEntry(tw, name, modified, size, tmp)
+}
+
+// ExportObsArchive writes an archive of the given observation sets, with
+// links via the given configuration, to a stream. Returns pg.ErrNoRows
+// unwrapped if any set does not exist.
+func ExportObsArchive(db orm.DB, config *PTOConfiguration, setIds []int, out io.Writer) error {
+	sets := make([]*ObservationSet, len(setIds))
+	conditions := make(map[string]*Condition)
+
+	for i, setid := range setIds {
+		sets[i] = &ObservationSet{ID: setid}
+		if err := sets[i].SelectByID(db); err != nil {
+			return err
+		}
+		sets[i].LinkVia(config)
+		sets[i].CountObservations(db)
+
+		for j := range sets[i].Conditions {
+			conditions[sets[i].Conditions[j].Name] = &sets[i].Conditions[j]
+		}
+	}
+
+	now := time.Now().UTC()
+	manifest := ObsArchiveManifest{
+		Format:   obsArchiveFormat,
+		Version:  obsArchiveVersion,
+		BaseURL:  config.BaseURL,
+		Exported: &now,
+		Sets:     make([]string, len(sets)),
+	}
+	for i := range sets {
+		manifest.Sets[i] = fmt.Sprintf("%x", sets[i].ID)
+	}
+
+	conditionNames := make([]string, 0, len(conditions))
+	for name := range conditions {
+		conditionNames = append(conditionNames, name)
+	}
+	sort.Strings(conditionNames)
+
+	conditionList := make([]*Condition, len(conditionNames))
+	for i, name := range conditionNames {
+		conditionList[i] = conditions[name]
+	}
+
+	zw, err := zstd.NewWriter(out)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	tw := tar.NewWriter(zw)
+
+	if err := writeArchiveJSON(tw, "manifest.json", now, &manifest); err != nil {
+		return err
+	}
+
+	if err := writeArchiveJSON(tw, "conditions.json", now, conditionList); err != nil {
+		return err
+	}
+
+	for i, set := range sets {
+		dir := "sets/" + manifest.Sets[i] + "/"
+
+		modified := now
+		if set.Modified != nil {
+			modified = *set.Modified
+		}
+
+		if err := writeArchiveJSON(tw, dir+"metadata.json", modified, set); err != nil {
+			return err
+		}
+
+		prov, err := ProvenanceOfSets(db, []int{set.ID})
+		if err != nil {
+			return err
+		}
+		if err := writeArchiveJSON(tw, dir+"provenance.json", modified, prov.Links(config)); err != nil {
+			return err
+		}
+
+		if err := writeArchiveObservations(tw, dir+"obs.ndjson", modified, db, set); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// archiveImport holds the state of an archive being imported within a
+// transaction.
+type archiveImport struct {
+	t        *pg.Tx
+	config   *PTOConfiguration
+	cidCache ConditionCache
+	pidCache *PathCache
+	manifest *ObsArchiveManifest
+	// new set IDs, by set ID in the archive
+	setIDs map[int]int
+	// sets whose metadata has been read, by set ID in the archive
+	sets map[int]*ObservationSet
+	// retraction reasons of sets retracted when exported
+	retracted map[int]string
+	// sets imported, in archive order
+	imported []*ObservationSet
+	loaders  []*obsLoader
+}
+
+// badArchive returns an error for an invalid archive.
+func badArchive(format string, args ...interface{}) error {
+	return PTOErrorf("bad observation set archive: "+format, args...).StatusIs(http.StatusBadRequest)
+}
+
+// readManifest reads the archive manifest, and reserves IDs for all the sets
+// it lists, so that links between them can be rewritten as they are read.
+func (imp *archiveImport) readManifest(r io.Reader) error {
+	imp.manifest = new(ObsArchiveManifest)
+	if err := json.NewDecoder(r).Decode(imp.manifest); err != nil {
+		return badArchive("error in manifest: %s", err.Error())
+	}
+
+	if imp.manifest.Format != obsArchiveFormat {
+		return badArchive("unknown format %s", imp.manifest.Format)
+	}
+	if imp.manifest.Version > obsArchiveVersion {
+		return badArchive("version %d is newer than version %d supported by this PTO",
+			imp.manifest.Version, obsArchiveVersion)
+	}
+
+	for _, idstr := range imp.manifest.Sets {
+		setid, err := strconv.ParseUint(idstr, 16, 32)
+		if err != nil {
+			return badArchive("bad set ID %s in manifest", idstr)
+		}
+
+		set := ObservationSet{}
+		if err := set.reserveID(imp.t); err != nil {
+			return err
+		}
+		imp.setIDs[int(setid)] = set.ID
+	}
+
+	return nil
+}
+
+// readConditions reads the registry entries of the conditions used by the
+// sets in the archive, and registers those not yet registered here.
+// Conditions already registered keep their existing entries.
+func (imp *archiveImport) readConditions(r io.Reader) error {
+	var conditions []Condition
+	if err := json.NewDecoder(r).Decode(&conditions); err != nil {
+		return badArchive("error in conditions: %s", err.Error())
+	}
+
+	for i := range conditions {
+		// conditions without registry entries are created as they are used
+		if conditions[i].ValueType == "" && conditions[i].Description == "" {
+			continue
+		}
+
+		existing := Condition{Name: conditions[i].Name}
+		err := existing.SelectByName(imp.t)
+		if err == nil && (existing.ValueType != "" || existing.Description != "") {
+			continue
+		} else if err != nil && err != pg.ErrNoRows {
+			return err
+		}
+
+		if err := conditions[i].Register(imp.t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readMetadata reads the metadata of a set in the archive.
+func (imp *archiveImport) readMetadata(setid int, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	set := new(ObservationSet)
+	if err := set.UnmarshalJSON(b); err != nil {
+		return badArchive("error in metadata for set %x: %s", setid, err.Error())
+	}
+	set.ID = imp.setIDs[setid]
+	imp.sets[setid] = set
+
+	// system metadata is not unmarshaled, but retraction is kept
+	var system struct {
+		Retracted string `json:"__retracted"`
+		Reason    string `json:"_retraction_reason"`
+	}
+	if err := json.Unmarshal(b, &system); err != nil {
+		return badArchive("error in metadata for set %x: %s", setid, err.Error())
+	}
+	if system.Retracted != "" {
+		imp.retracted[setid] = system.Reason
+	}
+
+	return nil
+}
+
+// rewriteSource rewrites a source link into the instance the archive was
+// exported from to refer to this instance. Links to sets in the archive
+// refer to their new IDs; links to other sets are left as they are, as they
+// have no counterpart here, as are links to other instances.
+func (imp *archiveImport) rewriteSource(source string) string {
+	base := imp.manifest.BaseURL
+	if base == "" {
+		return source
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	if !strings.HasPrefix(source, base) {
+		return source
+	}
+
+	src := ObservationSetSource{Source: source}
+	src.parseSourceLink()
+	if src.SourceSetID != 0 {
+		if newid, ok := imp.setIDs[src.SourceSetID]; ok {
+			return LinkForSetID(imp.config, newid)
+		}
+		return source
+	}
+
+	link, err := imp.config.LinkTo(strings.TrimPrefix(source, base))
+	if err != nil {
+		return source
+	}
+	return link
+}
+
+// readObservations loads the observations of a set in the archive, and
+// stores the set, with its links rewritten.
+func (imp *archiveImport) readObservations(setid int, r io.Reader) error {
+	set := imp.sets[setid]
+	if set == nil {
+		return badArchive("observations for set %x precede its metadata", setid)
+	}
+
+	l := newObsLoader(imp.t, set, true, imp.cidCache, imp.pidCache)
+	imp.loaders = append(imp.loaders, l)
+
+	lineno := 0
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		lineno++
+		line := strings.TrimSpace(in.Text())
+
+		// metadata is taken from metadata.json
+		if len(line) == 0 || line[0] != '[' {
+			continue
+		}
+
+		jslice, err := parseObsLine(line)
+		if err != nil {
+			return badArchive("set %x: %s", setid, obsLineError(lineno, err).Error())
+		}
+		if err := l.add(jslice); err != nil {
+			return badArchive("set %x: %s", setid, obsLineError(lineno, err).Error())
+		}
+	}
+
+	if err := in.Err(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := l.flush(); err != nil {
+		return err
+	}
+
+	// rewrite links into the exporting instance; the analyzer is left as it
+	// is, as analyzer versions on the exporting instance have no counterpart
+	// here, so links to its registry are not linked to analyzers here
+	for i := range set.Sources {
+		set.Sources[i] = imp.rewriteSource(set.Sources[i])
+	}
+
+	// supersession of sets outside the archive cannot be kept
+	supersedes := make([]int, 0, len(set.Supersedes))
+	for _, id := range set.Supersedes {
+		if newid, ok := imp.setIDs[id]; ok {
+			supersedes = append(supersedes, newid)
+		}
+	}
+	set.Supersedes = supersedes
+
+	if err := imp.cidCache.FillConditionIDsInSet(imp.t, set); err != nil {
+		return err
+	}
+
+	if err := set.storeNew(imp.t, imp.config, true); err != nil {
+		return err
+	}
+
+	if err := set.updateStats(imp.t); err != nil {
+		return err
+	}
+
+	if err := set.updateRollups(imp.t); err != nil {
+		return err
+	}
+
+	if reason, ok := imp.retracted[setid]; ok {
+		if err := set.Retract(imp.t, reason); err != nil {
+			return err
+		}
+	}
+
+	imp.imported = append(imp.imported, set)
+	return nil
+}
+
+// read reads an archive, importing the sets in it.
+func (imp *archiveImport) read(tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return badArchive("%s", err.Error())
+		}
+
+		if hdr.Name == "manifest.json" {
+			if err := imp.readManifest(tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if imp.manifest == nil {
+			return badArchive("%s precedes manifest", hdr.Name)
+		}
+
+		if hdr.Name == "conditions.json" {
+			if err := imp.readConditions(tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// everything else belongs to a set
+		parts := strings.Split(hdr.Name, "/")
+		if len(parts) != 3 || parts[0] != "sets" {
+			return badArchive("unexpected file %s", hdr.Name)
+		}
+
+		archiveID, err := strconv.ParseUint(parts[1], 16, 32)
+		if _, ok := imp.setIDs[int(archiveID)]; err != nil || !ok {
+			return badArchive("file %s for set not in manifest", hdr.Name)
+		}
+		setid := int(archiveID)
+
+		switch parts[2] {
+		case "metadata.json":
+			err = imp.readMetadata(setid, tr)
+		case "obs.ndjson":
+			err = imp.readObservations(setid, tr)
+		case "provenance.json":
+			// provenance is rebuilt from the rewritten sources
+		default:
+			err = badArchive("unexpected file %s", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if imp.manifest == nil {
+		return badArchive("no manifest")
+	}
+
+	if len(imp.imported) != len(imp.manifest.Sets) {
+		return badArchive("%d sets in manifest, but observations for %d", len(imp.manifest.Sets), len(imp.imported))
+	}
+
+	return nil
+}
+
+// ImportObsArchive imports the observation sets in an archive from a stream
+// into the database, within a single transaction, giving them new IDs and
+// rewriting their links to refer to the instance with the given
+// configuration. All the sets are imported, or none of them. It uses given
+// caches to cache condition and path IDs. Returns the imported sets, in
+// archive order, and a map from set IDs in the archive to new set IDs.
+func ImportObsArchive(
+	r io.Reader,
+	db *pg.DB,
+	config *PTOConfiguration,
+	cidCache ConditionCache,
+	pidCache *PathCache) ([]*ObservationSet, map[int]int, error) {
+
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, nil, badArchive("%s", err.Error())
+	}
+	defer zr.Close()
+
+	imp := archiveImport{
+		config:    config,
+		cidCache:  cidCache,
+		pidCache:  pidCache,
+		setIDs:    make(map[int]int),
+		sets:      make(map[int]*ObservationSet),
+		retracted: make(map[int]string),
+	}
+
+	err = db.RunInTransaction(func(t *pg.Tx) error {
+		imp.t = t
+		return imp.read(tar.NewReader(zr))
+	})
+
+	if err != nil {
+		// on failure, the transaction has been rolled back
+		for _, l := range imp.loaders {
+			l.uncache()
+		}
+		return nil, nil, err
+	}
+
+	return imp.imported, imp.setIDs, nil
+}
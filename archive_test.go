@@ -0,0 +1,155 @@
+package pto3_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestObsArchive(t *testing.T) {
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidCache := pto3.NewPathCache(0)
+
+	first := `{"_analyzer": "https://localhost:8383/archive_test_analyzer.json", "_sources": ["https://ptotest.mami-project.eu/raw/archive/archive-0.ndjson"], "_conditions": ["pto.test.archive.first"], "archive_test": "first"}
+["", "2017-12-08T04:05:06Z", "2017-12-08T04:05:07Z", "10.0.1.1 * 10.0.1.2", "pto.test.archive.first"]
+["", "2017-12-08T04:05:08Z", "2017-12-08T04:05:09Z", "10.0.1.1 * 10.0.1.3", "pto.test.archive.first"]`
+
+	set1, err := pto3.CopySetFromObsStream(strings.NewReader(first), TestDB, TestConfig, cidCache, pidCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link1 := pto3.LinkForSetID(TestConfig, set1.ID)
+	second := fmt.Sprintf(`{"_analyzer": "https://localhost:8383/archive_test_analyzer.json", "_sources": ["%s", "https://ptotest.mami-project.eu/raw/archive/archive-1.ndjson", "https://elsewhere.example.com/raw/archive-2.ndjson"], "_supersedes": ["%s"], "_conditions": ["pto.test.archive.second"], "archive_test": "second"}
+["", "2017-12-08T05:05:06Z", "2017-12-08T05:05:07Z", "10.0.1.1 * 10.0.1.4", "pto.test.archive.second"]`, link1, link1)
+
+	set2, err := pto3.CopySetFromObsStream(strings.NewReader(second), TestDB, TestConfig, cidCache, pidCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := pto3.ExportObsArchive(TestDB, TestConfig, []int{set1.ID, set2.ID}, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// import into an instance at another base URL, sharing the test database
+	importConfig, err := pto3.NewConfigFromJSON([]byte(`{"BaseURL": "https://ptoimport.mami-project.eu"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, setIDs, err := pto3.ImportObsArchive(&archive, TestDB, importConfig, cidCache, pidCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(imported) != 2 {
+		t.Fatalf("expected 2 imported sets, got %d", len(imported))
+	}
+
+	for i, set := range []*pto3.ObservationSet{set1, set2} {
+		newID, ok := setIDs[set.ID]
+		if !ok || newID == set.ID || imported[i].ID != newID {
+			t.Fatalf("set %x imported with bad ID %x", set.ID, newID)
+		}
+
+		newSet := pto3.ObservationSet{ID: newID}
+		if err := newSet.SelectByID(TestDB); err != nil {
+			t.Fatal(err)
+		}
+
+		if newSet.Analyzer != set.Analyzer {
+			t.Fatalf("set %x imported with analyzer %s", set.ID, newSet.Analyzer)
+		}
+		if newSet.Metadata["archive_test"] != set.Metadata["archive_test"] {
+			t.Fatalf("set %x imported with metadata %v", set.ID, newSet.Metadata)
+		}
+		if newSet.CountObservations(TestDB) != set.CountObservations(TestDB) {
+			t.Fatalf("set %x imported with %d observations, expected %d",
+				set.ID, newSet.CountObservations(TestDB), set.CountObservations(TestDB))
+		}
+	}
+
+	// links within the archive follow the sets, and links to the exporting
+	// instance move to the importing instance
+	newSet2 := pto3.ObservationSet{ID: setIDs[set2.ID]}
+	if err := newSet2.SelectByID(TestDB); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedSources := []string{
+		pto3.LinkForSetID(importConfig, setIDs[set1.ID]),
+		"https://ptoimport.mami-project.eu/raw/archive/archive-1.ndjson",
+		"https://elsewhere.example.com/raw/archive-2.ndjson",
+	}
+	if !reflect.DeepEqual(newSet2.Sources, expectedSources) {
+		t.Fatalf("imported set sources %v, expected %v", newSet2.Sources, expectedSources)
+	}
+
+	if !reflect.DeepEqual(newSet2.Supersedes, []int{setIDs[set1.ID]}) {
+		t.Fatalf("imported set supersedes %v, expected %x", newSet2.Supersedes, setIDs[set1.ID])
+	}
+
+	// a damaged archive imports nothing
+	archive.Reset()
+	if err := pto3.ExportObsArchive(TestDB, TestConfig, []int{set1.ID}, &archive); err != nil {
+		t.Fatal(err)
+	}
+	truncated := bytes.NewReader(archive.Bytes()[:archive.Len()/2])
+	if _, _, err := pto3.ImportObsArchive(truncated, TestDB, importConfig, cidCache, pidCache); err == nil {
+		t.Fatal("truncated archive imported")
+	}
+}
+
+func TestObsArchiveAnalyzerLinks(t *testing.T) {
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidCache := pto3.NewPathCache(0)
+
+	if _, err := pto3.RegisterAnalyzer(TestDB, "archive_link_test", "",
+		[]byte(`{"_owner": "ptotest@example.com", "_conditions": ["pto.test.archive.linked"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	analyzerLink := pto3.LinkForAnalyzer(TestConfig, "archive_link_test", 1)
+
+	obs := fmt.Sprintf(`{"_analyzer": "%s", "_sources": ["https://ptotest.mami-project.eu/raw/archive/archive-3.ndjson"], "_conditions": ["pto.test.archive.linked"]}
+["", "2017-12-08T06:05:06Z", "2017-12-08T06:05:07Z", "10.0.1.1 * 10.0.1.5", "pto.test.archive.linked"]`, analyzerLink)
+
+	set, err := pto3.CopySetFromObsStream(strings.NewReader(obs), TestDB, TestConfig, cidCache, pidCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.AnalyzerID == 0 {
+		t.Fatal("set not linked to registered analyzer")
+	}
+
+	var archive bytes.Buffer
+	if err := pto3.ExportObsArchive(TestDB, TestConfig, []int{set.ID}, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance's analyzer versions are unrelated to those exported,
+	// so the imported set keeps its link but is not linked to an analyzer
+	importConfig, err := pto3.NewConfigFromJSON([]byte(`{"BaseURL": "https://ptoimport.mami-project.eu"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, _, err := pto3.ImportObsArchive(&archive, TestDB, importConfig, cidCache, pidCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported[0].Analyzer != analyzerLink || imported[0].AnalyzerID != 0 {
+		t.Fatalf("imported set has analyzer %s linked to %d", imported[0].Analyzer, imported[0].AnalyzerID)
+	}
+}
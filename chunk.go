@@ -0,0 +1,230 @@
+package pto3
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Appended data chunks for PTO3 obs.
+// Observations may be added to an existing observation set in chunks (e.g.
+// one per day of a long-running campaign). Each chunk is recorded with an ID
+// and, optionally, a key supplied by the client; appending a chunk with a
+// key already recorded for the set does nothing, so clients can safely retry
+// appends which may or may not have completed.
+
+// ObservationSetChunk records a chunk of observations appended to an
+// observation set.
+type ObservationSetChunk struct {
+	ID               int        `json:"chunk"`
+	ObservationSetID int        `json:"-"`
+	Key              string     `json:"key,omitempty"`
+	Observations     int        `json:"observations"`
+	Appended         *time.Time `json:"appended"`
+}
+
+// createChunkKeyIndex ensures chunk keys are unique within a set. Chunks
+// without keys are stored with a NULL key, and are therefore never duplicates.
+const createChunkKeyIndex = "CREATE UNIQUE INDEX IF NOT EXISTS observation_set_chunks_key_idx ON observation_set_chunks (observation_set_id, key)"
+
+// chunkStagingTable holds the observations of a chunk being appended, until
+// the set's statistics and rollups have been updated from them.
+const chunkStagingTable = "observation_chunk"
+
+// createChunkStagingTable creates the staging table for a chunk, which lasts
+// until the end of the transaction appending it. Observation IDs are assigned
+// as observations are staged.
+const createChunkStagingTable = `CREATE TEMPORARY TABLE observation_chunk
+	(LIKE observations INCLUDING DEFAULTS) ON COMMIT DROP`
+
+// selectChunkByKey fills in a chunk of a set by key. It returns
+// pg.ErrNoRows unwrapped if there is no such chunk.
+func selectChunkByKey(db orm.DB, setID int, key string) (*ObservationSetChunk, error) {
+	chunk := ObservationSetChunk{}
+	err := db.Model(&chunk).
+		Where("observation_set_id = ?", setID).
+		Where("key = ?", key).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+// ObservationSetChunks returns the chunks appended to an observation set, in
+// the order in which they were appended.
+func ObservationSetChunks(db orm.DB, setID int) ([]ObservationSetChunk, error) {
+	chunks := make([]ObservationSetChunk, 0)
+	if err := db.Model(&chunks).Where("observation_set_id = ?", setID).Order("id").Select(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return chunks, nil
+}
+
+// AppendDataFromObsStream appends observations in observation set file
+// format from a stream to an ObservationSet which already exists in the
+// database, as a new chunk, in a single pass. It uses given caches to cache
+// condition and path IDs, and checks conditions against those declared. If a
+// non-empty key is given, and a chunk with that key has already been appended
+// to the set, the stream is not read and the existing chunk is returned.
+// Returns the chunk, and whether it was newly appended.
+func AppendDataFromObsStream(
+	r io.Reader,
+	db *pg.DB, set *ObservationSet,
+	key string,
+	cidCache ConditionCache,
+	pidCache *PathCache) (*ObservationSetChunk, bool, error) {
+
+	var chunk *ObservationSetChunk
+	appended := false
+
+	err := db.RunInTransaction(func(t *pg.Tx) error {
+		// lock the set, serializing appends to it, and get its statistics
+		// before this chunk
+		var before struct {
+			Retracted *time.Time
+			Stats     *ObservationSetStats
+		}
+		if _, err := t.QueryOne(&before, "SELECT retracted, stats FROM observation_sets WHERE id = ? FOR UPDATE", set.ID); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// if this chunk has already been appended, we're done
+		if key != "" {
+			existing, err := selectChunkByKey(t, set.ID, key)
+			if err == nil {
+				chunk = existing
+				return nil
+			} else if err != pg.ErrNoRows {
+				return PTOWrapError(err)
+			}
+		}
+
+		// retracted sets cannot change
+		if before.Retracted != nil {
+			return PTOErrorf("observation set %x is retracted", set.ID).StatusIs(http.StatusConflict)
+		}
+
+		// stage the observations, so that statistics and rollups can be
+		// updated from this chunk alone
+		if _, err := t.Exec(createChunkStagingTable); err != nil {
+			return PTOWrapError(err)
+		}
+		if err := loadObsStream(t, r, set, false, chunkStagingTable, nil, cidCache, pidCache); err != nil {
+			return err
+		}
+
+		// note that the set's data has changed
+		if err := set.bumpGeneration(t); err != nil {
+			return err
+		}
+
+		// merge the chunk's statistics and rollups into the set's, before
+		// its observations join the set's
+		observations, err := set.mergeChunkStats(t, before.Stats)
+		if err != nil {
+			return err
+		}
+		if err := set.insertRollups(t, chunkStagingTable); err != nil {
+			return err
+		}
+
+		if _, err := t.Exec(`INSERT INTO observations (id, set_id, time_start, time_end, path_id, condition_id, value)
+			SELECT id, set_id, time_start, time_end, path_id, condition_id, value FROM ` + chunkStagingTable); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// finally, record the chunk
+		now := time.Now().UTC()
+		chunk = &ObservationSetChunk{
+			ObservationSetID: set.ID,
+			Key:              key,
+			Observations:     observations,
+			Appended:         &now,
+		}
+
+		if err := t.Insert(chunk); err != nil {
+			return PTOWrapError(err)
+		}
+
+		appended = true
+		return nil
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return chunk, appended, nil
+}
+
+// mergeChunkStats merges statistics over the observations of a chunk staged
+// for this ObservationSet into its statistics before the chunk, given, and
+// stores them. Paths and targets are counted as distinct if the set has no
+// observations on them before the chunk. Returns the number of observations
+// in the chunk.
+func (set *ObservationSet) mergeChunkStats(t *pg.Tx, before *ObservationSetStats) (int, error) {
+	var delta ObservationSetStats
+
+	_, err := t.QueryOne(&delta, `
+		SELECT count(*) AS observations,
+			min(observation.time_start) AS time_start,
+			max(observation.time_end) AS time_end,
+			count(DISTINCT observation.path_id) FILTER (WHERE NOT EXISTS
+				(SELECT 1 FROM observations AS o WHERE o.set_id = ?0 AND o.path_id = observation.path_id)) AS distinct_paths,
+			count(DISTINCT path.target) FILTER (WHERE NOT EXISTS
+				(SELECT 1 FROM observation_rollups AS r WHERE r.set_id = ?0 AND r.target = path.target)) AS distinct_targets
+		FROM `+chunkStagingTable+` AS observation
+		JOIN paths AS path ON path.id = observation.path_id
+		WHERE observation.set_id = ?0`, set.ID)
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	var conditionCounts []struct {
+		Name  string
+		Count int
+	}
+
+	_, err = t.Query(&conditionCounts, `
+		SELECT condition.name, count(*) AS count
+		FROM `+chunkStagingTable+` AS observation
+		JOIN conditions AS condition ON condition.id = observation.condition_id
+		WHERE observation.set_id = ?
+		GROUP BY condition.name`, set.ID)
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	stats := ObservationSetStats{Conditions: make(map[string]int)}
+	if before != nil {
+		stats = *before
+		if stats.Conditions == nil {
+			stats.Conditions = make(map[string]int)
+		}
+	}
+
+	stats.Observations += delta.Observations
+	stats.DistinctPaths += delta.DistinctPaths
+	stats.DistinctTargets += delta.DistinctTargets
+	if delta.TimeStart != nil && (stats.TimeStart == nil || delta.TimeStart.Before(*stats.TimeStart)) {
+		stats.TimeStart = delta.TimeStart
+	}
+	if delta.TimeEnd != nil && (stats.TimeEnd == nil || delta.TimeEnd.After(*stats.TimeEnd)) {
+		stats.TimeEnd = delta.TimeEnd
+	}
+	for _, cc := range conditionCounts {
+		stats.Conditions[cc.Name] += cc.Count
+	}
+
+	if _, err := t.Exec("UPDATE observation_sets SET stats = ? WHERE id = ?", &stats, set.ID); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	set.Stats = &stats
+	set.count = stats.Observations
+	return delta.Observations, nil
+}
@@ -0,0 +1,72 @@
+// ptoanalyzer registers a new version of an analyzer metadata document with a
+// PTO database, so that observation sets produced by the analyzer are linked
+// to it and validated against the metadata schema and conditions it declares.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
+var initdbFlag = flag.Bool("initdb", false, "Create database tables on startup")
+var urlFlag = flag.String("url", "", "external analyzer metadata `URL` to register the analyzer under")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: register analyzer metadata with a PTO database\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> analyzer-name analyzer-metadata-file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	doc, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := pg.Connect(&config.ObsDatabase)
+	if *initdbFlag {
+		if err := pto3.CreateTables(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	a, err := pto3.RegisterAnalyzer(db, args[0], *urlFlag, doc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a.LinkVia(config)
+
+	log.Printf("registered analyzer %s version %d:", a.Name, a.Version)
+	b, _ := json.MarshalIndent(a, "  ", "  ")
+	os.Stderr.Write(b)
+	log.Println("")
+}
@@ -0,0 +1,46 @@
+// ptodedupe merges duplicate paths in a PTO database created before path
+// strings were required to be unique, repointing observations to a single
+// copy of each path, and adds the constraint preventing further duplicates.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: merge duplicate paths in a PTO database\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag || len(flag.Args()) > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := pg.Connect(&config.ObsDatabase)
+
+	removed, err := pto3.DeduplicatePaths(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("removed %d duplicate paths", removed)
+}
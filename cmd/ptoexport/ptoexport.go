@@ -0,0 +1,73 @@
+// ptoexport writes one or more observation sets from a PTO database, with
+// their metadata, provenance, and conditions, to a compressed archive, for
+// import into another PTO instance with ptoimport.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
+var outFlag = flag.String("out", "", "write the archive to `file` instead of standard output")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: export observation sets from a PTO database to an archive\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> (Set ID)+\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Note that set IDs are given in hexadecimal\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag || len(flag.Args()) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	setIDs := make([]int, 0)
+	for _, arg := range flag.Args() {
+		idarg, err := strconv.ParseUint(arg, 16, 32)
+		if err != nil {
+			log.Printf("cannot parse Set ID %s", arg)
+			flag.Usage()
+			os.Exit(1)
+		}
+		setIDs = append(setIDs, int(idarg))
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := pg.Connect(&config.ObsDatabase)
+
+	out := os.Stdout
+	if *outFlag != "" {
+		if out, err = os.Create(*outFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := pto3.ExportObsArchive(db, config, setIDs, out); err != nil {
+		if err == pg.ErrNoRows {
+			log.Fatal("observation set not found")
+		}
+		log.Fatal(err)
+	}
+
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("exported %d observation sets", len(setIDs))
+}
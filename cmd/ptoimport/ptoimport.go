@@ -0,0 +1,88 @@
+// ptoimport imports observation set archives written by ptoexport or
+// retrieved from a PTO's observation API into a PTO database. Imported sets
+// get new IDs, and links to the exporting instance in their sources are
+// rewritten to refer to this one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection and base URL information")
+var initdbFlag = flag.Bool("initdb", false, "Create database tables on startup")
+
+func importFile(filename string, db *pg.DB, config *pto3.PTOConfiguration,
+	cidCache pto3.ConditionCache, pidCache *pto3.PathCache) error {
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	sets, setIDs, err := pto3.ImportObsArchive(in, db, config, cidCache, pidCache)
+	if err != nil {
+		return err
+	}
+
+	// report new IDs by old ones
+	newIDs := make(map[int]int)
+	for oldID, newID := range setIDs {
+		newIDs[newID] = oldID
+	}
+
+	for _, set := range sets {
+		set.LinkVia(config)
+		log.Printf("%s: imported observation set %x as %s", filename, newIDs[set.ID], set.Link())
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: import observation set archives into a PTO database\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> archive-files\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag || len(flag.Args()) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := pg.Connect(&config.ObsDatabase)
+	if *initdbFlag {
+		if err := pto3.CreateTables(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// share pid and condition caches across all archives
+	cidCache, err := pto3.LoadConditionCache(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pidCache := pto3.NewPathCache(config.PathCacheSize)
+
+	for _, filename := range flag.Args() {
+		if err := importFile(filename, db, config, cidCache, pidCache); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
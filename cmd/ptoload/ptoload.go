@@ -16,6 +16,47 @@ import (
 var helpFlag = flag.Bool("h", false, "display a help message")
 var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
 var initdbFlag = flag.Bool("initdb", false, "Create database tables on startup")
+var checkFlag = flag.Bool("check", false, "validate input files and report problems, without loading them")
+var maxErrorsFlag = flag.Int("max-errors", pto3.DefaultValidationErrorCap, "report at most `n` problems per file with -check; 0 for all")
+
+// checkFiles validates each file, reporting problems with it on standard
+// output. Returns true if all files are valid.
+func checkFiles(filenames []string, db *pg.DB) bool {
+	valid := true
+
+	for _, filename := range filenames {
+		report, err := checkFile(filename, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, problem := range report.Errors {
+			fmt.Printf("%s:%d: %s\n", filename, problem.Line, problem.Problem)
+		}
+
+		if report.Valid() {
+			fmt.Printf("%s: %d observations ok\n", filename, report.Observations)
+		} else {
+			valid = false
+			if report.Truncated {
+				fmt.Printf("%s: %d more problems not shown\n", filename, report.ErrorCount-len(report.Errors))
+			}
+			fmt.Printf("%s: %d problems in %d observations\n", filename, report.ErrorCount, report.Observations)
+		}
+	}
+
+	return valid
+}
+
+func checkFile(filename string, db *pg.DB) (*pto3.ObsValidationReport, error) {
+	in, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	return pto3.ValidateObsStream(in, db, nil, *maxErrorsFlag)
+}
 
 func main() {
 	flag.Usage = func() {
@@ -50,17 +91,24 @@ func main() {
 		}
 	}
 
+	if *checkFlag {
+		if !checkFiles(args, db) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// share pid and condition caches across all files
 	cidCache, err := pto3.LoadConditionCache(db)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	pidCache := make(pto3.PathCache)
+	pidCache := pto3.NewPathCache(config.PathCacheSize)
 
 	for _, filename := range args {
 		var set *pto3.ObservationSet
-		set, err = pto3.CopySetFromObsFile(filename, db, cidCache, pidCache)
+		set, err = pto3.CopySetFromObsFile(filename, db, config, cidCache, pidCache)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,68 @@
+// ptomigrate brings the schema of a PTO observation database up to date,
+// creating its tables if it is empty and applying pending migrations if it was
+// created by an earlier version of the PTO.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
+var dryRunFlag = flag.Bool("dry-run", false, "list pending migrations without applying them")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: migrate a PTO database to the latest schema version\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag || len(flag.Args()) > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := pg.Connect(&config.ObsDatabase)
+
+	version, initialized, err := pto3.DatabaseSchemaVersion(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if initialized {
+		log.Printf("database at schema version %d, latest is %d", version, pto3.LatestSchemaVersion())
+	} else {
+		log.Printf("database not initialized, latest schema version is %d", pto3.LatestSchemaVersion())
+	}
+
+	migrations, err := pto3.MigrateTables(db, *dryRunFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(migrations) == 0 {
+		log.Printf("nothing to do")
+	}
+
+	for _, m := range migrations {
+		if *dryRunFlag {
+			log.Printf("would migrate to version %d: %s", m.Version, m.Description)
+		} else {
+			log.Printf("migrated to version %d: %s", m.Version, m.Description)
+		}
+	}
+}
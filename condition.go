@@ -1,15 +1,214 @@
 package pto3
 
 import (
+	"encoding/json"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
 )
 
+// Condition represents a condition which can be observed, along with its
+// entry in the condition registry. Condition names are hierarchical, with
+// dot-separated components: the first component names the feature (e.g.
+// ecn), and all but the last name the aspect of that feature (e.g.
+// ecn.connectivity) the condition describes the state of.
 type Condition struct {
 	ID   int
 	Name string
+	// Human-readable description of the condition
+	Description string
+	// Expected type of observation values; empty if not registered
+	ValueType string
+	// Unit of observation values, for numeric value types
+	Unit string
+	// Deprecated conditions should not be used by new analyzers
+	Deprecated bool
+	// Name of the condition replacing this one, if deprecated
+	ReplacedBy string
+}
+
+// Value types for conditions in the condition registry.
+const (
+	// Observations of this condition carry no value
+	ValueTypeNone = "none"
+	// Observation values are true or false
+	ValueTypeBoolean = "boolean"
+	// Observation values are integers
+	ValueTypeInteger = "integer"
+	// Observation values are numbers
+	ValueTypeNumber = "number"
+	// Observation values are arbitrary strings
+	ValueTypeString = "string"
+)
+
+var conditionValueTypes = map[string]struct{}{
+	ValueTypeNone:    {},
+	ValueTypeBoolean: {},
+	ValueTypeInteger: {},
+	ValueTypeNumber:  {},
+	ValueTypeString:  {},
+}
+
+// Feature returns the feature this condition describes.
+func (c *Condition) Feature() string {
+	return strings.SplitN(c.Name, ".", 2)[0]
+}
+
+// Aspect returns the aspect of the feature this condition describes.
+func (c *Condition) Aspect() string {
+	if i := strings.LastIndex(c.Name, "."); i > 0 {
+		return c.Name[:i]
+	}
+	return c.Name
+}
+
+// MarshalJSON returns this condition's registry entry as a JSON object.
+func (c *Condition) MarshalJSON() ([]byte, error) {
+	jmap := map[string]interface{}{
+		"name":       c.Name,
+		"feature":    c.Feature(),
+		"aspect":     c.Aspect(),
+		"deprecated": c.Deprecated,
+	}
+
+	if c.Description != "" {
+		jmap["description"] = c.Description
+	}
+
+	if c.ValueType != "" {
+		jmap["value_type"] = c.ValueType
+	}
+
+	if c.Unit != "" {
+		jmap["unit"] = c.Unit
+	}
+
+	if c.ReplacedBy != "" {
+		jmap["replaced_by"] = c.ReplacedBy
+	}
+
+	return json.Marshal(jmap)
+}
+
+// UnmarshalJSON fills in this condition's registry entry from a JSON object.
+// Feature and aspect are implied by the name, and are ignored.
+func (c *Condition) UnmarshalJSON(b []byte) error {
+	var in struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		ValueType   string `json:"value_type"`
+		Unit        string `json:"unit"`
+		Deprecated  bool   `json:"deprecated"`
+		ReplacedBy  string `json:"replaced_by"`
+	}
+
+	if err := json.Unmarshal(b, &in); err != nil {
+		return PTOErrorf("bad condition registry entry: %s", err.Error()).StatusIs(http.StatusBadRequest)
+	}
+
+	c.Name = in.Name
+	c.Description = in.Description
+	c.ValueType = in.ValueType
+	c.Unit = in.Unit
+	c.Deprecated = in.Deprecated
+	c.ReplacedBy = in.ReplacedBy
+
+	return nil
+}
+
+// Register stores this condition's registry entry in the database, creating
+// the condition if it does not yet exist.
+func (c *Condition) Register(db orm.DB) error {
+	if c.Name == "" {
+		return PTOErrorf("condition registry entry missing name").StatusIs(http.StatusBadRequest)
+	}
+
+	if c.ValueType != "" {
+		if _, ok := conditionValueTypes[c.ValueType]; !ok {
+			return PTOErrorf("condition %s has unknown value type %s", c.Name, c.ValueType).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	if c.ReplacedBy != "" && !c.Deprecated {
+		return PTOErrorf("condition %s is replaced by %s but not deprecated", c.Name, c.ReplacedBy).StatusIs(http.StatusBadRequest)
+	}
+
+	c.ID = 0
+	if err := c.InsertOnce(db); err != nil {
+		return err
+	}
+
+	_, err := db.Model(c).
+		Column("description", "value_type", "unit", "deprecated", "replaced_by").
+		Where("id = ?id").
+		Update()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// SelectByName selects this condition's registry entry from the database by
+// its name. FIXME as with ObservationSet.SelectByID, this returns
+// pg.ErrNoRows unwrapped if there is no such condition.
+func (c *Condition) SelectByName(db orm.DB) error {
+	if err := db.Model(c).Where("name = ?name").First(); err != nil {
+		if err == pg.ErrNoRows {
+			return err
+		}
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// ValidateValue checks an observation value against this condition's
+// registered value type. Conditions with no registered value type accept any
+// value.
+func (c *Condition) ValidateValue(v string) error {
+	var err error
+
+	switch c.ValueType {
+	case ValueTypeNone:
+		if v != "" {
+			return PTOErrorf("condition %s takes no value, got %s", c.Name, v).StatusIs(http.StatusBadRequest)
+		}
+	case ValueTypeBoolean:
+		_, err = strconv.ParseBool(v)
+	case ValueTypeInteger:
+		_, err = strconv.ParseInt(v, 10, 64)
+	case ValueTypeNumber:
+		_, err = strconv.ParseFloat(v, 64)
+	}
+
+	if err != nil {
+		return PTOErrorf("condition %s requires %s value, got %s", c.Name, c.ValueType, v).StatusIs(http.StatusBadRequest)
+	}
+
+	return nil
+}
+
+// ConditionNamesUnder lists the names of all conditions of a given feature or
+// aspect, in order.
+func ConditionNamesUnder(db orm.DB, prefix string) ([]string, error) {
+	var names []string
+	err := db.Model(&Condition{}).
+		ColumnExpr("array_agg(name)").
+		Where("name LIKE ?", likeEscaper.Replace(prefix)+".%").
+		Select(pg.Array(&names))
+	if err == pg.ErrNoRows || names == nil {
+		return make([]string, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
 }
 
 // FIXME consider replacing this with a condition cache everywhere
@@ -0,0 +1,105 @@
+package pto3_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/mami-project/pto3-go"
+)
+
+func TestConditionHierarchy(t *testing.T) {
+	c := pto3.Condition{Name: "ecn.connectivity.works"}
+
+	if c.Feature() != "ecn" {
+		t.Fatalf("bad feature %s for %s", c.Feature(), c.Name)
+	}
+
+	if c.Aspect() != "ecn.connectivity" {
+		t.Fatalf("bad aspect %s for %s", c.Aspect(), c.Name)
+	}
+}
+
+func TestConditionRegistry(t *testing.T) {
+	registry := []pto3.Condition{
+		{Name: "pto.test.valued.count", Description: "a count of things", ValueType: pto3.ValueTypeInteger, Unit: "things"},
+		{Name: "pto.test.valued.flag", Description: "a flag", ValueType: pto3.ValueTypeBoolean},
+		{Name: "pto.test.valued.bare", Description: "no value here", ValueType: pto3.ValueTypeNone,
+			Deprecated: true, ReplacedBy: "pto.test.valued.flag"},
+	}
+
+	for i := range registry {
+		if err := registry[i].Register(TestDB); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bad := pto3.Condition{Name: "pto.test.valued.bad", ValueType: "complex"}
+	if err := bad.Register(TestDB); err == nil {
+		t.Fatal("condition with unknown value type registered")
+	}
+
+	c := pto3.Condition{Name: "pto.test.valued.count"}
+	if err := c.SelectByName(TestDB); err != nil {
+		t.Fatal(err)
+	}
+	if c.ValueType != pto3.ValueTypeInteger || c.Unit != "things" || c.Deprecated {
+		t.Fatalf("bad registry entry for %s: %+v", c.Name, c)
+	}
+
+	c = pto3.Condition{Name: "pto.test.valued.nonexistent"}
+	if err := c.SelectByName(TestDB); err != pg.ErrNoRows {
+		t.Fatalf("expected no rows for nonexistent condition, got %v", err)
+	}
+
+	names, err := pto3.ConditionNamesUnder(TestDB, "pto.test.valued")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "pto.test.valued.bare,pto.test.valued.count,pto.test.valued.flag" {
+		t.Fatalf("unexpected conditions under pto.test.valued: %v", names)
+	}
+
+	// now load observations against the registered value types
+	testFiles := []struct {
+		observations string
+		ok           bool
+	}{
+		{`["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.0.0.1 * 10.0.0.2", "pto.test.valued.count", "42"]
+["", "2017-12-05T14:31:27Z", "2017-12-05T14:31:27Z", "10.0.0.1 * 10.0.0.2", "pto.test.valued.flag", "true"]
+["", "2017-12-05T14:31:28Z", "2017-12-05T14:31:28Z", "10.0.0.1 * 10.0.0.2", "pto.test.valued.bare"]`, true},
+		{`["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.0.0.1 * 10.0.0.2", "pto.test.valued.count", "many"]`, false},
+		{`["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.0.0.1 * 10.0.0.2", "pto.test.valued.bare", "1"]`, false},
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidCache := pto3.NewPathCache(0)
+
+	for i, tf := range testFiles {
+		f, err := ioutil.TempFile("", "pto3-test-valued")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		if _, err := f.WriteString(`{"_analyzer": "https://localhost:8383/valued_test_analyzer.json", ` +
+			`"_sources": ["https://localhost:8383/raw/valued/valued-0.ndjson"], ` +
+			`"_conditions": ["pto.test.valued.count", "pto.test.valued.flag", "pto.test.valued.bare"]}` + "\n" +
+			tf.observations + "\n"); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		_, err = pto3.CopySetFromObsFile(f.Name(), TestDB, TestConfig, cidCache, pidCache)
+		if tf.ok && err != nil {
+			t.Fatalf("valid observation file %d rejected: %s", i, err.Error())
+		} else if !tf.ok && err == nil {
+			t.Fatalf("observation file %d with invalid value accepted", i)
+		}
+	}
+}
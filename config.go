@@ -50,6 +50,18 @@ type PTOConfiguration struct {
 	// Number of concurrent queries
 	ConcurrentQueries int
 
+	// Rerun cached queries whose source observation sets have changed
+	RerunStaleQueries bool
+
+	// Reject created or imported observation sets whose analyzer is not registered
+	RequireRegisteredAnalyzer bool
+
+	// Number of paths to cache path IDs for; 0 for the default
+	PathCacheSize int
+
+	// Number of months ahead to create observation partitions for; 0 for the default
+	PartitionMonthsAhead int
+
 	// Access logging file path
 	AccessLogPath string
 	accessLogger  *log.Logger
@@ -0,0 +1,358 @@
+package pto3
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Minimal JSON Schema validator for PTO3 analyzer metadata.
+// This implements the subset of JSON Schema (draft 7) validation keywords
+// useful for describing observation set metadata: type, enum, const,
+// required, properties, additionalProperties, items, minItems, maxItems,
+// minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, allOf, anyOf, oneOf and not. Annotation keywords (title,
+// description, etc.) are ignored. Schemas using keywords which would change
+// the result of validation but are not implemented here (such as $ref) are
+// rejected when checked, rather than silently accepting everything.
+
+var jsonSchemaUnsupported = []string{
+	"$ref", "definitions", "dependencies", "patternProperties", "propertyNames",
+	"contains", "additionalItems", "uniqueItems", "minProperties", "maxProperties",
+	"multipleOf", "if", "then", "else",
+}
+
+var jsonSchemaTypes = map[string]struct{}{
+	"null": {}, "boolean": {}, "object": {}, "array": {},
+	"number": {}, "integer": {}, "string": {},
+}
+
+// checkJSONSchema verifies that a schema, as unmarshaled from JSON, is a
+// well-formed schema using only supported keywords.
+func checkJSONSchema(schema interface{}, pointer string) error {
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+
+	sm, ok := schema.(map[string]interface{})
+	if !ok {
+		return PTOErrorf("schema at %s is not an object or boolean", jsonPointerRoot(pointer))
+	}
+
+	for _, k := range jsonSchemaUnsupported {
+		if _, ok := sm[k]; ok {
+			return PTOErrorf("schema keyword %s at %s not supported", k, jsonPointerRoot(pointer))
+		}
+	}
+
+	if t, ok := sm["type"]; ok {
+		types, ok := jsonSchemaTypeList(t)
+		if !ok {
+			return PTOErrorf("schema type at %s is not a string or string array", jsonPointerRoot(pointer))
+		}
+		for _, typ := range types {
+			if _, ok := jsonSchemaTypes[typ]; !ok {
+				return PTOErrorf("schema type %s at %s unknown", typ, jsonPointerRoot(pointer))
+			}
+		}
+	}
+
+	if e, ok := sm["enum"]; ok {
+		if _, ok := e.([]interface{}); !ok {
+			return PTOErrorf("schema enum at %s is not an array", jsonPointerRoot(pointer))
+		}
+	}
+
+	if r, ok := sm["required"]; ok {
+		if _, ok := AsStringArray(r); !ok {
+			return PTOErrorf("schema required at %s is not a string array", jsonPointerRoot(pointer))
+		}
+	}
+
+	if p, ok := sm["pattern"]; ok {
+		ps, ok := p.(string)
+		if !ok {
+			return PTOErrorf("schema pattern at %s is not a string", jsonPointerRoot(pointer))
+		}
+		if _, err := regexp.Compile(ps); err != nil {
+			return PTOErrorf("schema pattern at %s invalid: %s", jsonPointerRoot(pointer), err.Error())
+		}
+	}
+
+	for _, k := range []string{"minItems", "maxItems", "minLength", "maxLength",
+		"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum"} {
+		if v, ok := sm[k]; ok {
+			if _, ok := v.(float64); !ok {
+				return PTOErrorf("schema %s at %s is not a number", k, jsonPointerRoot(pointer))
+			}
+		}
+	}
+
+	if p, ok := sm["properties"]; ok {
+		pm, ok := p.(map[string]interface{})
+		if !ok {
+			return PTOErrorf("schema properties at %s is not an object", jsonPointerRoot(pointer))
+		}
+		for k, sub := range pm {
+			if err := checkJSONSchema(sub, pointer+"/properties/"+jsonPointerEscape(k)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, k := range []string{"additionalProperties", "items", "not"} {
+		if sub, ok := sm[k]; ok {
+			if err := checkJSONSchema(sub, pointer+"/"+k); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, k := range []string{"allOf", "anyOf", "oneOf"} {
+		if subs, ok := sm[k]; ok {
+			sl, ok := subs.([]interface{})
+			if !ok || len(sl) == 0 {
+				return PTOErrorf("schema %s at %s is not a non-empty array", k, jsonPointerRoot(pointer))
+			}
+			for i, sub := range sl {
+				if err := checkJSONSchema(sub, fmt.Sprintf("%s/%s/%d", pointer, k, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateJSONSchema validates a value, as unmarshaled from JSON, against a
+// schema which has been checked with checkJSONSchema. It returns a list of
+// violations, each prefixed with the JSON pointer to the offending value;
+// an empty list means the value conforms to the schema.
+func validateJSONSchema(schema interface{}, value interface{}, pointer string) []string {
+	if b, ok := schema.(bool); ok {
+		if b {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: not allowed", jsonPointerRoot(pointer))}
+	}
+
+	sm, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, jsonPointerRoot(pointer)+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := sm["type"]; ok {
+		types, _ := jsonSchemaTypeList(t)
+		matched := false
+		for _, typ := range types {
+			if jsonValueHasType(value, typ) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("expected %s, got %s", strings.Join(types, " or "), jsonValueType(value))
+			// further keywords are meaningless on the wrong type
+			return errs
+		}
+	}
+
+	if e, ok := sm["enum"]; ok {
+		matched := false
+		for _, ev := range e.([]interface{}) {
+			if reflect.DeepEqual(ev, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("value %s not one of %s", jsonText(value), jsonText(e))
+		}
+	}
+
+	if c, ok := sm["const"]; ok {
+		if !reflect.DeepEqual(c, value) {
+			fail("value %s is not %s", jsonText(value), jsonText(c))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if r, ok := sm["required"]; ok {
+			required, _ := AsStringArray(r)
+			for _, k := range required {
+				if _, ok := v[k]; !ok {
+					fail("missing required key %s", k)
+				}
+			}
+		}
+
+		props, _ := sm["properties"].(map[string]interface{})
+		additional, hasAdditional := sm["additionalProperties"]
+
+		// iterate in key order for stable error messages
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			subpointer := pointer + "/" + jsonPointerEscape(k)
+			if sub, ok := props[k]; ok {
+				errs = append(errs, validateJSONSchema(sub, v[k], subpointer)...)
+			} else if hasAdditional {
+				if b, ok := additional.(bool); ok && !b {
+					fail("key %s not allowed", k)
+				} else {
+					errs = append(errs, validateJSONSchema(additional, v[k], subpointer)...)
+				}
+			}
+		}
+
+	case []interface{}:
+		if n, ok := sm["minItems"].(float64); ok && float64(len(v)) < n {
+			fail("expected at least %v items, got %d", n, len(v))
+		}
+		if n, ok := sm["maxItems"].(float64); ok && float64(len(v)) > n {
+			fail("expected at most %v items, got %d", n, len(v))
+		}
+		if items, ok := sm["items"]; ok {
+			for i := range v {
+				errs = append(errs, validateJSONSchema(items, v[i], fmt.Sprintf("%s/%d", pointer, i))...)
+			}
+		}
+
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := sm["minLength"].(float64); ok && length < n {
+			fail("expected at least %v characters, got %v", n, length)
+		}
+		if n, ok := sm["maxLength"].(float64); ok && length > n {
+			fail("expected at most %v characters, got %v", n, length)
+		}
+		if p, ok := sm["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err == nil && !re.MatchString(v) {
+				fail("value %s does not match pattern %s", jsonText(v), p)
+			}
+		}
+
+	case float64:
+		if n, ok := sm["minimum"].(float64); ok && v < n {
+			fail("value %v less than minimum %v", v, n)
+		}
+		if n, ok := sm["maximum"].(float64); ok && v > n {
+			fail("value %v greater than maximum %v", v, n)
+		}
+		if n, ok := sm["exclusiveMinimum"].(float64); ok && v <= n {
+			fail("value %v not greater than %v", v, n)
+		}
+		if n, ok := sm["exclusiveMaximum"].(float64); ok && v >= n {
+			fail("value %v not less than %v", v, n)
+		}
+	}
+
+	if subs, ok := sm["allOf"].([]interface{}); ok {
+		for _, sub := range subs {
+			errs = append(errs, validateJSONSchema(sub, value, pointer)...)
+		}
+	}
+
+	if subs, ok := sm["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range subs {
+			if len(validateJSONSchema(sub, value, pointer)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("value matches none of anyOf")
+		}
+	}
+
+	if subs, ok := sm["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range subs {
+			if len(validateJSONSchema(sub, value, pointer)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("value matches %d of oneOf, expected exactly one", matches)
+		}
+	}
+
+	if sub, ok := sm["not"]; ok {
+		if len(validateJSONSchema(sub, value, pointer)) == 0 {
+			fail("value matches schema in not")
+		}
+	}
+
+	return errs
+}
+
+func jsonSchemaTypeList(t interface{}) ([]string, bool) {
+	if s, ok := t.(string); ok {
+		return []string{s}, true
+	}
+	return AsStringArray(t)
+}
+
+func jsonValueHasType(value interface{}, typ string) bool {
+	switch typ {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	default:
+		return jsonValueType(value) == typ
+	}
+}
+
+func jsonValueType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func jsonText(value interface{}) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(b)
+}
+
+func jsonPointerEscape(k string) string {
+	return strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1)
+}
+
+func jsonPointerRoot(pointer string) string {
+	if pointer == "" {
+		return "/"
+	}
+	return pointer
+}
@@ -0,0 +1,263 @@
+package pto3
+
+import (
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Schema versioning for PTO3 obs.
+// The database records the migrations applied to it in the schema_versions
+// table. An empty database is created at the latest schema version directly.
+// A database initialized before schema versioning is at version zero, and may
+// have been created by any earlier release, so the migrations bringing it up
+// to date are written to apply cleanly to a schema which already has some of
+// their changes. Migrations only go up, and each runs in its own transaction.
+
+// Migration is a change to the schema of the observation database.
+type Migration struct {
+	// Schema version after this migration
+	Version int
+	// Description of the change
+	Description string
+	up          func(t *pg.Tx) error
+}
+
+// SchemaVersion records a migration applied to the observation database.
+type SchemaVersion struct {
+	Version     int `sql:",pk"`
+	Description string
+	Applied     *time.Time
+}
+
+// schemaMigrationLock is the advisory lock key serializing migrations.
+const schemaMigrationLock = 0x70746f34
+
+// migrations lists all migrations, in order. Add new migrations to the end.
+var migrations = []Migration{
+	{1, "drop unused like_rev function and operator", func(t *pg.Tx) error {
+		return execAll(t,
+			"DROP OPERATOR IF EXISTS ~~~~ (text, text)",
+			"DROP FUNCTION IF EXISTS like_rev (text, text)")
+	}},
+	{2, "add generation, retraction, and statistics to observation sets", func(t *pg.Tx) error {
+		if err := execAll(t,
+			`ALTER TABLE observation_sets
+				ADD COLUMN IF NOT EXISTS generation bigint,
+				ADD COLUMN IF NOT EXISTS retracted timestamptz,
+				ADD COLUMN IF NOT EXISTS stats jsonb`); err != nil {
+			return err
+		}
+		return fillSetStats(t)
+	}},
+	{3, "add observation set supersession", func(t *pg.Tx) error {
+		return createTable(t, &ObservationSetSupersession{})
+	}},
+	{4, "add provenance index", func(t *pg.Tx) error {
+		if err := createTable(t, &ObservationSetSource{}); err != nil {
+			return err
+		}
+		if err := execAll(t, createSourceIndexes...); err != nil {
+			return err
+		}
+
+		// index sources of sets created before the provenance index existed
+		indexed, err := t.Model(&ObservationSetSource{}).Count()
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		if indexed == 0 {
+			return RebuildSourceIndex(t)
+		}
+		return nil
+	}},
+	{5, "add analyzer registry", func(t *pg.Tx) error {
+		if err := createTable(t, &Analyzer{}); err != nil {
+			return err
+		}
+		return execAll(t,
+			createAnalyzerNameVersionIndex,
+			createAnalyzerURLIndex,
+			"ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS analyzer_id bigint",
+			addSetAnalyzerForeignKey)
+	}},
+	{6, "add condition registry", func(t *pg.Tx) error {
+		return execAll(t,
+			`ALTER TABLE conditions
+				ADD COLUMN IF NOT EXISTS description text,
+				ADD COLUMN IF NOT EXISTS value_type text,
+				ADD COLUMN IF NOT EXISTS unit text,
+				ADD COLUMN IF NOT EXISTS deprecated boolean,
+				ADD COLUMN IF NOT EXISTS replaced_by text`)
+	}},
+	{7, "merge duplicate paths and make path strings unique", func(t *pg.Tx) error {
+		_, err := deduplicatePaths(t)
+		return err
+	}},
+	{8, "add typed path elements and canonical endpoints", func(t *pg.Tx) error {
+		if err := execAll(t,
+			`ALTER TABLE paths
+				ADD COLUMN IF NOT EXISTS elements text[],
+				ADD COLUMN IF NOT EXISTS element_types text[]`); err != nil {
+			return err
+		}
+		if err := fillPathElements(t); err != nil {
+			return err
+		}
+		return execAll(t, createPathElementsIndex)
+	}},
+	{9, "add observation set chunks", func(t *pg.Tx) error {
+		if err := createTable(t, &ObservationSetChunk{}); err != nil {
+			return err
+		}
+		return execAll(t, createChunkKeyIndex)
+	}},
+	{10, "partition observations by time", partitionObservations},
+	{11, "add observation rollups", func(t *pg.Tx) error {
+		if err := execAll(t, createObservationRollupsTable); err != nil {
+			return err
+		}
+		if err := execAll(t, createRollupIndexes...); err != nil {
+			return err
+		}
+		return fillRollups(t)
+	}},
+	{12, "index paths and rollup targets by set for appending chunks", func(t *pg.Tx) error {
+		return execAll(t, createObservationSetPathIndex, createRollupTargetIndex)
+	}},
+}
+
+// execAll executes each of a list of statements.
+func execAll(t *pg.Tx, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := t.Exec(stmt); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
+
+// createTable creates a table for a model if it does not exist.
+func createTable(t *pg.Tx, model interface{}) error {
+	opts := orm.CreateTableOptions{
+		IfNotExists:   true,
+		FKConstraints: true,
+	}
+
+	if err := t.CreateTable(model, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// LatestSchemaVersion returns the schema version this PTO uses.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrations returns all the migrations known to this PTO, in order.
+func Migrations() []Migration {
+	out := make([]Migration, len(migrations))
+	copy(out, migrations)
+	return out
+}
+
+// DatabaseSchemaVersion returns the schema version of the observation
+// database, and whether it has been initialized at all. Databases initialized
+// before schema versioning are at version zero.
+func DatabaseSchemaVersion(db orm.DB) (int, bool, error) {
+	var tables struct {
+		Versions bool
+		Sets     bool
+	}
+
+	if _, err := db.QueryOne(&tables, `SELECT
+		to_regclass('schema_versions') IS NOT NULL AS versions,
+		to_regclass('observation_sets') IS NOT NULL AS sets`); err != nil {
+		return 0, false, PTOWrapError(err)
+	}
+
+	if !tables.Versions {
+		return 0, tables.Sets, nil
+	}
+
+	var version int
+	if _, err := db.QueryOne(pg.Scan(&version), "SELECT coalesce(max(version), 0) FROM schema_versions"); err != nil {
+		return 0, false, PTOWrapError(err)
+	}
+
+	return version, true, nil
+}
+
+// apply applies a migration within a transaction, and records it, unless it
+// has already been applied by a concurrent migration.
+func (m *Migration) apply(t *pg.Tx) error {
+	if _, err := t.Exec("SELECT pg_advisory_xact_lock(?)", schemaMigrationLock); err != nil {
+		return PTOWrapError(err)
+	}
+
+	version, initialized, err := DatabaseSchemaVersion(t)
+	if err != nil {
+		return err
+	}
+	if initialized && version >= m.Version {
+		return nil
+	}
+
+	if err := m.up(t); err != nil {
+		return err
+	}
+
+	if err := createTable(t, &SchemaVersion{}); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if err := t.Insert(&SchemaVersion{Version: m.Version, Description: m.Description, Applied: &now}); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// MigrateTables brings the schema of the observation database up to date,
+// creating the tables in an empty database, and applying pending migrations
+// in order to an older one. If dryRun is set, the database is not changed. It
+// returns the migrations applied, or which would be applied, and an error if
+// the database schema is newer than this PTO.
+func MigrateTables(db *pg.DB, dryRun bool) ([]Migration, error) {
+	version, initialized, err := DatabaseSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := LatestSchemaVersion()
+	if version > latest {
+		return nil, PTOErrorf("database schema version %d is newer than version %d used by this PTO; upgrade the PTO", version, latest)
+	}
+
+	pending := make([]Migration, 0)
+	if !initialized {
+		pending = append(pending, Migration{latest, "create tables", createTables})
+	} else {
+		for _, m := range migrations {
+			if m.Version > version {
+				pending = append(pending, m)
+			}
+		}
+	}
+
+	if dryRun {
+		return pending, nil
+	}
+
+	for i := range pending {
+		if err := db.RunInTransaction(pending[i].apply); err != nil {
+			return nil, PTOErrorf("migration to schema version %d (%s) failed: %s",
+				pending[i].Version, pending[i].Description, err.Error())
+		}
+	}
+
+	return pending, nil
+}
@@ -0,0 +1,51 @@
+package pto3_test
+
+import (
+	"testing"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	// migrations are numbered consecutively
+	for i, m := range pto3.Migrations() {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d (%s) has version %d", i, m.Description, m.Version)
+		}
+	}
+
+	// tables were created at the latest version
+	version, initialized, err := pto3.DatabaseSchemaVersion(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !initialized || version != pto3.LatestSchemaVersion() {
+		t.Fatalf("expected database at schema version %d, got %d (initialized %v)", pto3.LatestSchemaVersion(), version, initialized)
+	}
+
+	// so there is nothing to migrate
+	pending, err := pto3.MigrateTables(TestDB, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("unexpected pending migrations %v", pending)
+	}
+
+	if err := pto3.CreateTables(TestDB); err != nil {
+		t.Fatal(err)
+	}
+
+	// a database newer than this PTO is refused
+	now := time.Now().UTC()
+	newer := pto3.SchemaVersion{Version: pto3.LatestSchemaVersion() + 1, Description: "from the future", Applied: &now}
+	if err := TestDB.Insert(&newer); err != nil {
+		t.Fatal(err)
+	}
+	defer TestDB.Delete(&newer)
+
+	if _, err := pto3.MigrateTables(TestDB, true); err == nil {
+		t.Fatal("newer database schema accepted")
+	}
+}
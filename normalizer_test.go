@@ -104,9 +104,9 @@ func TestNormalization(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	pidCache := make(pto3.PathCache)
+	pidCache := pto3.NewPathCache(0)
 
-	set, err := pto3.CopySetFromObsFile(tf.Name(), TestDB, cidCache, pidCache)
+	set, err := pto3.CopySetFromObsFile(tf.Name(), TestDB, TestConfig, cidCache, pidCache)
 	if err != nil {
 		t.Fatal(err)
 	}
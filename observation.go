@@ -2,12 +2,15 @@ package pto3
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -28,18 +31,47 @@ type ObservationSet struct {
 	Sources []string `pg:",array"`
 	// Analyzer metadata URL, from _analyzer metadata key
 	Analyzer string
+	// ID of the registered analyzer version the analyzer URL refers to, if any
+	AnalyzerID int
 	// Conditions declared to appear in this observation set,
 	Conditions []Condition `pg:",many2many:observation_set_conditions"`
-	// Arbitrary metadata
-	Metadata map[string]string
+	// Arbitrary metadata, as JSON values
+	Metadata map[string]interface{}
 	// Metadata creation timestamp
 	Created *time.Time
 	// Metadata modification timestamp
 	Modified *time.Time
+	// Modification generation, incremented on each metadata or data change
+	Generation int
+	// Retraction timestamp; retracted sets are hidden from queries
+	Retracted *time.Time
+	// Statistics over observations, computed when data is loaded
+	Stats *ObservationSetStats
+	// IDs of sets superseded by this one, from _supersedes metadata key
+	Supersedes []int `sql:"-"`
 	// system metadata
-	datalink string
-	link     string
-	count    int
+	datalink          string
+	link              string
+	count             int
+	supersededBy      []int
+	supersedesLinks   []string
+	supersededByLinks []string
+}
+
+// ObservationSetStats holds statistics about the observations in an
+// observation set, computed when its data is loaded.
+type ObservationSetStats struct {
+	// Count of observations
+	Observations int `json:"observations"`
+	// Earliest observation start time
+	TimeStart *time.Time `json:"time_start,omitempty"`
+	// Latest observation end time
+	TimeEnd *time.Time `json:"time_end,omitempty"`
+	// Count of observations by condition name
+	Conditions map[string]int `json:"conditions"`
+	// Count of distinct paths and path targets
+	DistinctPaths   int `json:"distinct_paths"`
+	DistinctTargets int `json:"distinct_targets"`
 }
 
 // ObservationSetCondition implements a linking table between observation sets
@@ -70,6 +102,10 @@ func (set *ObservationSet) MarshalJSON() ([]byte, error) {
 		jmap["__obs_count"] = set.count
 	}
 
+	if set.Stats != nil {
+		jmap["__stats"] = set.Stats
+	}
+
 	if set.Created != nil {
 		jmap["__created"] = set.Created.Format(time.RFC3339)
 	}
@@ -78,6 +114,30 @@ func (set *ObservationSet) MarshalJSON() ([]byte, error) {
 		jmap["__modified"] = set.Modified.Format(time.RFC3339)
 	}
 
+	if set.Generation != 0 {
+		jmap["__generation"] = set.Generation
+	}
+
+	if set.Retracted != nil {
+		jmap["__retracted"] = set.Retracted.Format(time.RFC3339)
+	}
+
+	if len(set.Supersedes) > 0 {
+		if set.supersedesLinks != nil {
+			jmap["_supersedes"] = set.supersedesLinks
+		} else {
+			jmap["_supersedes"] = supersessionLinks(nil, set.Supersedes)
+		}
+	}
+
+	if len(set.supersededBy) > 0 {
+		if set.supersededByLinks != nil {
+			jmap["__superseded_by"] = set.supersededByLinks
+		} else {
+			jmap["__superseded_by"] = supersessionLinks(nil, set.supersededBy)
+		}
+	}
+
 	conditionNames := make([]string, len(set.Conditions))
 	for i := range set.Conditions {
 		conditionNames[i] = set.Conditions[i].Name
@@ -96,7 +156,7 @@ func (set *ObservationSet) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON fills in an ObservationSet from a JSON observation set
 // metadata object suitable for use with the PTO API.
 func (set *ObservationSet) UnmarshalJSON(b []byte) error {
-	set.Metadata = make(map[string]string)
+	set.Metadata = make(map[string]interface{})
 
 	var jmap map[string]interface{}
 	err := json.Unmarshal(b, &jmap)
@@ -127,6 +187,18 @@ func (set *ObservationSet) UnmarshalJSON(b []byte) error {
 			for i := range conditionNames {
 				set.Conditions[i].Name = conditionNames[i]
 			}
+		} else if k == "_supersedes" {
+			// Accept set links or bare set IDs
+			supersedes, ok := AsStringArray(v)
+			if !ok {
+				return PTOErrorf("_supersedes not a string array")
+			}
+			set.Supersedes = make([]int, len(supersedes))
+			for i := range supersedes {
+				if set.Supersedes[i], err = SetIDFromLink(supersedes[i]); err != nil {
+					return err
+				}
+			}
 		} else if k == "__link" {
 			set.link = AsString(v)
 		} else if k == "__data_link" {
@@ -134,8 +206,8 @@ func (set *ObservationSet) UnmarshalJSON(b []byte) error {
 		} else if strings.HasPrefix(k, "__") {
 			// Ignore all other incoming __ keys instead of stuffing them in metadata
 		} else {
-			// Everything else is metadata
-			set.Metadata[k] = AsString(v)
+			// Everything else is metadata, of any JSON type
+			set.Metadata[k] = v
 		}
 	}
 
@@ -155,6 +227,32 @@ func (set *ObservationSet) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// mergeMetadata merges a metadata line from an observation set file into this
+// ObservationSet. As when metadata is coalesced, the last value of each key
+// wins, and keys absent from the line keep their values from earlier lines,
+// so the line need not repeat _sources, _analyzer, or _conditions. The set's
+// ID, which may have been reserved, is kept. On error, the set is unchanged.
+func (set *ObservationSet) mergeMetadata(b []byte) error {
+	merged := *set
+	if err := merged.UnmarshalJSON(b); err != nil {
+		return err
+	}
+
+	for k, v := range set.Metadata {
+		if _, ok := merged.Metadata[k]; !ok {
+			merged.Metadata[k] = v
+		}
+	}
+
+	merged.ID = set.ID
+	*set = merged
+	return nil
+}
+
+// strayLineProblem describes a line in an observation set file which is
+// neither an observation nor metadata.
+const strayLineProblem = "line is neither observation nor metadata"
+
 func (set *ObservationSet) ensureConditionsInDB(db orm.DB) error {
 	for i := range set.Conditions {
 		if err := set.Conditions[i].InsertOnce(db); err != nil {
@@ -166,37 +264,77 @@ func (set *ObservationSet) ensureConditionsInDB(db orm.DB) error {
 
 // Insert inserts an ObservationSet into the database. A row is inserted if
 // the observation set has not already been inserted (i.e., has no ID) or if
-// the force flag is set.
-func (set *ObservationSet) Insert(db orm.DB, force bool) error {
+// the force flag is set. The configuration determines whether the set's
+// analyzer must be registered.
+func (set *ObservationSet) Insert(db orm.DB, config *PTOConfiguration, force bool) error {
 	if force {
 		set.ID = 0
 	}
 
 	if set.ID == 0 {
-		// set creation and modification timestamps
-		ctime := time.Now().UTC()
-		set.Created = &ctime
-		set.Modified = &ctime
+		return set.storeNew(db, config, false)
+	}
+	return nil
+}
 
-		// ensure conditions have IDs
-		if err := set.ensureConditionsInDB(db); err != nil {
-			return err
-		}
+// reserveID inserts an empty placeholder row for this ObservationSet, giving
+// it an ID before its metadata is known, so that observations can be loaded
+// into it. The row must be completed with storeNew in the same transaction.
+func (set *ObservationSet) reserveID(db orm.DB) error {
+	if _, err := db.QueryOne(pg.Scan(&set.ID), "INSERT INTO observation_sets DEFAULT VALUES RETURNING id"); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// storeNew stores a new ObservationSet and its conditions, supersessions,
+// and sources in the database. If reserved is set, the set's row has been
+// reserved by reserveID and is filled in; otherwise a new row is inserted.
+func (set *ObservationSet) storeNew(db orm.DB, config *PTOConfiguration, reserved bool) error {
+	// link to and validate against the registered analyzer
+	if err := set.linkAnalyzer(db, config); err != nil {
+		return err
+	}
+
+	// set creation and modification timestamps
+	ctime := time.Now().UTC()
+	set.Created = &ctime
+	set.Modified = &ctime
+
+	// new sets start at the first generation
+	set.Generation = 1
+
+	// ensure conditions have IDs
+	if err := set.ensureConditionsInDB(db); err != nil {
+		return err
+	}
 
-		// main insertion
+	// main insertion
+	if reserved {
+		if err := db.Update(set); err != nil {
+			return PTOWrapError(err)
+		}
+	} else {
 		if err := db.Insert(set); err != nil {
 			return PTOWrapError(err)
 		}
+	}
 
-		// TODO file a bug against go-pg or its docs: this should be automatic.
-		for i := range set.Conditions {
-			_, err := db.Exec("INSERT INTO observation_set_conditions VALUES (?, ?)", set.ID, set.Conditions[i].ID)
-			if err != nil {
-				return PTOWrapError(err)
-			}
+	// TODO file a bug against go-pg or its docs: this should be automatic.
+	for i := range set.Conditions {
+		_, err := db.Exec("INSERT INTO observation_set_conditions VALUES (?, ?)", set.ID, set.Conditions[i].ID)
+		if err != nil {
+			return PTOWrapError(err)
 		}
 	}
-	return nil
+
+	// and link to sets this one supersedes
+	if err := set.storeSupersessions(db); err != nil {
+		return err
+	}
+
+	// index sources for provenance
+	return set.storeSourceIndex(db)
 }
 
 // SelectByID selects values for this ObservationSet from the database by its
@@ -229,12 +367,30 @@ func (set *ObservationSet) SelectByID(db orm.DB) error {
 		}
 	}
 
-	return nil
+	return set.selectSupersessions(db)
 }
 
 // Update updates this ObservationSet in the database by overwriting the DB's
-// values with its own, by ID.
-func (set *ObservationSet) Update(db orm.DB) error {
+// values with its own, by ID. Retracted sets cannot be updated. The
+// configuration determines whether the set's analyzer must be registered.
+func (set *ObservationSet) Update(db orm.DB, config *PTOConfiguration) error {
+	// retracted sets are frozen for audit, so check before validating or
+	// changing anything, locking the set against concurrent retraction
+	var current struct {
+		Retracted *time.Time
+	}
+	if _, err := db.QueryOne(&current, "SELECT retracted FROM observation_sets WHERE id = ? FOR UPDATE", set.ID); err != nil {
+		return err
+	}
+	if current.Retracted != nil {
+		return PTOErrorf("observation set %x is retracted", set.ID).StatusIs(http.StatusConflict)
+	}
+
+	// link to and validate against the registered analyzer
+	if err := set.linkAnalyzer(db, config); err != nil {
+		return err
+	}
+
 	// set modified timestamp
 	mtime := time.Now().UTC()
 	set.Modified = &mtime
@@ -244,6 +400,11 @@ func (set *ObservationSet) Update(db orm.DB) error {
 		return err
 	}
 
+	// bump generation, so the main update writes it back unchanged
+	if err := set.bumpGeneration(db); err != nil {
+		return err
+	}
+
 	// main update
 	if err := db.Update(set); err != nil {
 		return PTOWrapError(err)
@@ -262,9 +423,215 @@ func (set *ObservationSet) Update(db orm.DB) error {
 		}
 	}
 
+	// and supersessions and provenance
+	if err := set.storeSupersessions(db); err != nil {
+		return err
+	}
+
+	if err := set.storeSourceIndex(db); err != nil {
+		return err
+	}
+
+	return set.selectSupersessions(db)
+}
+
+// bumpGeneration increments this ObservationSet's modification generation in
+// the database, and stores the new generation in the set, along with the
+// retraction timestamp and statistics, which metadata updates cannot change.
+func (set *ObservationSet) bumpGeneration(db orm.DB) error {
+	var gen struct {
+		Generation int
+		Retracted  *time.Time
+		Stats      *ObservationSetStats
+	}
+
+	_, err := db.QueryOne(&gen,
+		"UPDATE observation_sets SET generation = coalesce(generation, 0) + 1 WHERE id = ? RETURNING generation, retracted, stats",
+		set.ID)
+	if err != nil {
+		return err
+	}
+
+	set.Generation = gen.Generation
+	set.Retracted = gen.Retracted
+	set.Stats = gen.Stats
+	return nil
+}
+
+// updateStats computes statistics over the observations in this
+// ObservationSet and stores them in the database. This is called whenever
+// observation data is loaded, so that metadata retrieval need not scan the
+// observations table.
+func (set *ObservationSet) updateStats(db orm.DB) error {
+	stats := ObservationSetStats{Conditions: make(map[string]int)}
+
+	_, err := db.QueryOne(&stats, `
+		SELECT count(*) AS observations,
+			min(observation.time_start) AS time_start,
+			max(observation.time_end) AS time_end,
+			count(DISTINCT observation.path_id) AS distinct_paths,
+			count(DISTINCT path.target) AS distinct_targets
+		FROM observations AS observation
+		JOIN paths AS path ON path.id = observation.path_id
+		WHERE observation.set_id = ?`, set.ID)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	var conditionCounts []struct {
+		Name  string
+		Count int
+	}
+
+	_, err = db.Query(&conditionCounts, `
+		SELECT condition.name, count(*) AS count
+		FROM observations AS observation
+		JOIN conditions AS condition ON condition.id = observation.condition_id
+		WHERE observation.set_id = ?
+		GROUP BY condition.name`, set.ID)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, cc := range conditionCounts {
+		stats.Conditions[cc.Name] = cc.Count
+	}
+
+	if _, err := db.Exec("UPDATE observation_sets SET stats = ? WHERE id = ?", &stats, set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+
+	set.Stats = &stats
+	set.count = stats.Observations
+	return nil
+}
+
+// fillSetStats computes statistics for observation sets loaded before they
+// were computed at load time.
+func fillSetStats(db orm.DB) error {
+	var sets []ObservationSet
+	if err := db.Model(&sets).Column("id").Where("stats IS NULL").Select(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for i := range sets {
+		if err := sets[i].updateStats(db); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Retract marks this ObservationSet as retracted, hiding its observations
+// from queries while leaving its metadata and data available for audit. The
+// reason for retraction is stored in the _retraction_reason metadata key.
+// Retracting an already retracted set updates the reason but keeps the
+// original retraction timestamp. Like SelectByID, returns pg.ErrNoRows
+// unwrapped if the set does not exist.
+func (set *ObservationSet) Retract(db orm.DB, reason string) error {
+	if err := set.SelectByID(db); err != nil {
+		return err
+	}
+
+	if err := set.bumpGeneration(db); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	set.Modified = &now
+	if set.Retracted == nil {
+		set.Retracted = &now
+	}
+
+	if set.Metadata == nil {
+		set.Metadata = make(map[string]interface{})
+	}
+	set.Metadata["_retraction_reason"] = reason
+
+	_, err := db.Model(set).
+		Column("retracted", "metadata", "modified").
+		Where("id = ?id").
+		Update()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	// retracted sets no longer count toward queries answered from rollups
+	return set.deleteRollups(db)
+}
+
+// Delete permanently removes this ObservationSet, its observations, and its
+// condition declarations from the database. It should be called within a
+// transaction, so that a failure leaves the set intact. Returns pg.ErrNoRows
+// unwrapped if the set does not exist.
+func (set *ObservationSet) Delete(db orm.DB) error {
+	if _, err := db.Exec("DELETE FROM observations WHERE set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := set.deleteRollups(db); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("DELETE FROM observation_set_conditions WHERE observation_set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+
+	_, err := db.Exec("DELETE FROM observation_set_supersessions WHERE observation_set_id = ? OR superseded_set_id = ?",
+		set.ID, set.ID)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := db.Exec("DELETE FROM observation_set_chunks WHERE observation_set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// sets derived from this one keep their provenance entries
+	if _, err := db.Exec("DELETE FROM observation_set_sources WHERE observation_set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+
+	res, err := db.Exec("DELETE FROM observation_sets WHERE id = ?", set.ID)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return pg.ErrNoRows
+	}
+
+	set.count = 0
 	return nil
 }
 
+// ObservationSetGenerations returns a map of set ID to current modification
+// generation for each of the given set IDs which exist in the database.
+func ObservationSetGenerations(db orm.DB, setIds []int) (map[int]int, error) {
+	var sets []ObservationSet
+
+	out := make(map[int]int)
+
+	if len(setIds) == 0 {
+		return out, nil
+	}
+
+	err := db.Model(&sets).
+		Column("id", "generation").
+		Where("id IN (?)", pg.In(setIds)).
+		Select()
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	for _, set := range sets {
+		out[set.ID] = set.Generation
+	}
+
+	return out, nil
+}
+
 // LinkForSetID generates a link from given PTO configuration and a set ID. Observation set
 // links are given by set ID as a hexadecimal string.
 func LinkForSetID(config *PTOConfiguration, setid int) string {
@@ -276,35 +643,25 @@ func LinkForSetID(config *PTOConfiguration, setid int) string {
 func (set *ObservationSet) LinkVia(config *PTOConfiguration) {
 	set.link = LinkForSetID(config, set.ID)
 	set.datalink = set.link + "/data"
+	set.supersedesLinks = supersessionLinks(config, set.Supersedes)
+	set.supersededByLinks = supersessionLinks(config, set.supersededBy)
 }
 
 func (set *ObservationSet) Link() string {
 	return set.link
 }
 
-// CountObservations counts observations in the database for this ObservationSet
+// CountObservations counts observations in the database for this
+// ObservationSet, using its statistics if they have been computed.
 func (set *ObservationSet) CountObservations(db orm.DB) int {
 	if set.count == 0 {
-		set.count, _ = db.Model(&Observation{}).Where("set_id = ?", set.ID).Count()
-	}
-	return set.count
-}
-
-func (set *ObservationSet) verifyConditionSet(conditionNames map[string]struct{}) error {
-	// make a set condition names declared in the condition set
-	conditionDeclared := make(map[string]struct{})
-	for _, c := range set.Conditions {
-		conditionDeclared[c.Name] = struct{}{}
-	}
-
-	// look for name in condition names not declared in the set, raise error if so
-	for conditionName := range conditionNames {
-		if _, ok := conditionDeclared[conditionName]; !ok {
-			return PTOErrorf("observation has condition %s not declared in set", conditionName)
+		if set.Stats != nil {
+			set.count = set.Stats.Observations
+		} else {
+			set.count, _ = db.Model(&Observation{}).Where("set_id = ?", set.ID).Count()
 		}
 	}
-
-	return nil
+	return set.count
 }
 
 // Observation represents a single observation, within an observation set
@@ -365,6 +722,7 @@ func (obs *Observation) unmarshalStringSlice(jslice []string, time_format string
 	}
 	obs.TimeEnd = &endtime
 
+	// paths are validated when loaded, not every time they are read
 	obs.Path = &Path{String: jslice[3]}
 	obs.Path.Parse()
 
@@ -398,75 +756,171 @@ func (obs *Observation) UnmarshalJSON(b []byte) error {
 
 }
 
-// CreateTables insures that the tables used by the ORM exist in the given
-// database. This is used for testing, and the (not yet implemented) ptodb init
-// command.
+// CreateTables ensures that the tables used by the ORM exist in the given
+// database, at the latest schema version, creating them in an empty database
+// and migrating them in an older one. This is used for testing, and by the
+// -initdb flag of the PTO commands.
 func CreateTables(db *pg.DB) error {
+	_, err := MigrateTables(db, false)
+	return err
+}
+
+// addSetAnalyzerForeignKey links observation sets to registered analyzers.
+const addSetAnalyzerForeignKey = `DO $$ BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'observation_sets_analyzer_id_fkey') THEN
+		ALTER TABLE observation_sets ADD CONSTRAINT observation_sets_analyzer_id_fkey
+			FOREIGN KEY (analyzer_id) REFERENCES analyzers (id);
+	END IF;
+END $$`
+
+// createTables creates the tables used by the ORM, at the latest schema
+// version, in an empty database.
+func createTables(t *pg.Tx) error {
 	opts := orm.CreateTableOptions{
 		IfNotExists:   true,
 		FKConstraints: true,
 	}
 
-	// Create functions first.
-	// EWW EWW
-	// PostgreSQL doesn't have IF NOT EXISTS for these,
-	// so just run them and ignore the error, since any error other than
-	// "exists" will probably cause later failures in the subsequent
-	// EWW EWW
-	db.Exec("create function like_rev (text, text) returns boolean as $$ select $2 like $1 $$ language SQL")
-	db.Exec("create operator ~~~~ (procedure = like_rev,  leftarg=text, rightarg=text)")
+	if err := t.CreateTable(&Condition{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
 
-	return db.RunInTransaction(func(tx *pg.Tx) error {
-		if err := db.CreateTable(&Condition{}, &opts); err != nil {
-			return PTOWrapError(err)
-		}
+	if err := t.CreateTable(&Path{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
 
-		if err := db.CreateTable(&Path{}, &opts); err != nil {
-			return PTOWrapError(err)
-		}
+	if err := t.CreateTable(&Analyzer{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
 
-		if err := db.CreateTable(&ObservationSet{}, &opts); err != nil {
-			return PTOWrapError(err)
-		}
+	if err := t.CreateTable(&ObservationSet{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
 
-		if err := db.CreateTable(&ObservationSetCondition{}, &opts); err != nil {
-			return PTOWrapError(err)
-		}
+	if err := t.CreateTable(&ObservationSetCondition{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := t.CreateTable(&ObservationSetSupersession{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := t.CreateTable(&ObservationSetSource{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := t.CreateTable(&ObservationSetChunk{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// observations are partitioned by time, which the ORM can't declare
+	if _, err := t.Exec(createObservationsTable); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := t.Exec(createObservationRollupsTable); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// analyzer versions are unique per name, and external URLs unique overall
+	if _, err := t.Exec(createAnalyzerNameVersionIndex); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := t.Exec(createAnalyzerURLIndex); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := t.Exec(addSetAnalyzerForeignKey); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// indexes to select observations by set ID, and paths within a set
+	if _, err := t.Exec(createObservationSetIndex); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := t.Exec(createObservationSetPathIndex); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// path strings are unique
+	if _, err := t.Exec(createPathStringIndex); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// index to select paths by element
+	if _, err := t.Exec(createPathElementsIndex); err != nil {
+		return PTOWrapError(err)
+	}
 
-		if err := db.CreateTable(&Observation{}, &opts); err != nil {
+	// indexes to traverse provenance in either direction, and to search by source prefix
+	for _, index := range createSourceIndexes {
+		if _, err := t.Exec(index); err != nil {
 			return PTOWrapError(err)
 		}
+	}
+
+	// chunk keys identify appended data for idempotent retry
+	if _, err := t.Exec(createChunkKeyIndex); err != nil {
+		return PTOWrapError(err)
+	}
 
-		// index to select observations by set ID
-		if _, err := db.Exec("CREATE INDEX ON observations (set_id)"); err != nil {
+	// indexes to select rollups by set, by day, and by target within a set
+	for _, index := range createRollupIndexes {
+		if _, err := t.Exec(index); err != nil {
 			return PTOWrapError(err)
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
 
 // DropTables removes the tables used by the ORM from the database. Use this for
 // testing only, please.
 func DropTables(db *pg.DB) error {
 	return db.RunInTransaction(func(tx *pg.Tx) error {
-		if err := db.DropTable(&Observation{}, nil); err != nil {
+		if err := db.DropTable(&SchemaVersion{}, nil); err != nil {
 			return PTOWrapError(err)
 		}
 
-		if err := db.DropTable(&ObservationSetCondition{}, nil); err != nil {
+		if _, err := db.Exec("DROP TABLE observation_rollups"); err != nil {
 			return PTOWrapError(err)
 		}
 
-		if err := db.DropTable(&ObservationSet{}, nil); err != nil {
+		if err := db.DropTable(&Observation{}, nil); err != nil {
 			return PTOWrapError(err)
 		}
 
-		if err := db.DropTable(&Condition{}, nil); err != nil {
+		if err := db.DropTable(&ObservationSetCondition{}, nil); err != nil {
 			return PTOWrapError(err)
 		}
 
-		if err := db.DropTable(&Path{}, nil); err != nil {
+		if err := db.DropTable(&ObservationSetSupersession{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&ObservationSetSource{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&ObservationSetChunk{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&ObservationSet{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&Analyzer{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&Condition{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&Path{}, nil); err != nil {
 			return PTOWrapError(err)
 		}
 
@@ -503,122 +957,561 @@ func WriteObservations(obsdat []Observation, out io.Writer) error {
 	return nil
 }
 
-// obsFileFirstPass scans a file, getting metadata (in the form of an observation set), a set of paths, and a set of conditions
-func obsFileFirstPass(r *os.File) (*ObservationSet, map[string]struct{}, map[string]struct{}, error) {
-	filename := r.Name()
+// obsLoadBatchSize is the number of observations the streaming loader
+// resolves and copies into the database at once, bounding its memory use.
+const obsLoadBatchSize = 10000
+
+// obsLoader loads observations into the database for an observation set
+// within a transaction, in batches. The paths in each batch are resolved to
+// IDs through a path cache, then the batch is copied into the observations
+// table with COPY FROM. Conditions are resolved, and their registry entries
+// looked up to validate values, the first time each is seen.
+type obsLoader struct {
+	t        *pg.Tx
+	set      *ObservationSet
+	cidCache ConditionCache
+	pidCache *PathCache
+	// conditions declared by the set; nil if not yet known
+	conditionDeclared map[string]struct{}
+	conditionSeen     map[string]struct{}
+	// conditions added to the condition cache by this loader
+	conditionCached []string
+	valueTypes      map[string]*Condition
+	batch           [][]string
+	pathSet         map[string]struct{}
+	// months for which observation partitions are known to exist; nil if
+	// the observations table has not yet been checked for partitioning
+	partitionMonths map[time.Time]struct{}
+	partitioned     bool
+	// table into which observations are copied
+	table string
+}
 
-	// create an observation set to hold metadata
-	set := ObservationSet{}
+// newObsLoader creates a loader for observations in a set, which must
+// already have an ID. If declared is set, the set's conditions are known, and
+// observations of other conditions are rejected as they are added; otherwise,
+// they must be checked with checkDeclared once they are.
+func newObsLoader(t *pg.Tx, set *ObservationSet, declared bool, cidCache ConditionCache, pidCache *PathCache) *obsLoader {
+	l := obsLoader{
+		t:             t,
+		set:           set,
+		cidCache:      cidCache,
+		pidCache:      pidCache,
+		conditionSeen: make(map[string]struct{}),
+		valueTypes:    make(map[string]*Condition),
+		batch:         make([][]string, 0, obsLoadBatchSize),
+		pathSet:       make(map[string]struct{}),
+		table:         "observations",
+	}
 
-	// and maps to hold paths and conditions
-	pathSeen := make(map[string]struct{})
-	conditionSeen := make(map[string]struct{})
+	if declared {
+		l.conditionDeclared = make(map[string]struct{})
+		for _, c := range set.Conditions {
+			l.conditionDeclared[c.Name] = struct{}{}
+		}
+	}
 
-	// now scan the file for metadata, paths, and conditions
-	var lineno = 0
-	in := bufio.NewScanner(r)
-	for in.Scan() {
-		lineno++
-		line := strings.TrimSpace(in.Text())
-		switch line[0] {
-		case '{':
-			if err := set.UnmarshalJSON([]byte(line)); err != nil {
-				return nil, nil, nil, PTOErrorf("error in metadata at %s line %d: %s", filename, lineno, err.Error())
-			}
-		case '[':
-			var obs []string
-			if err := json.Unmarshal([]byte(line), &obs); err != nil {
-				return nil, nil, nil, PTOErrorf("error looking for path at %s line %d: %s", filename, lineno, err.Error())
-			}
-			if len(obs) < 4 {
-				return nil, nil, nil, PTOErrorf("short observation looking for path at %s line %d", filename, lineno)
-			}
-			pathSeen[obs[3]] = struct{}{}
-			conditionSeen[obs[4]] = struct{}{}
+	return &l
+}
+
+// checkDeclared verifies that every condition seen by this loader is declared
+// by its set. This is used when the set's conditions were not known when
+// loading began.
+func (l *obsLoader) checkDeclared() error {
+	declared := make(map[string]struct{})
+	for _, c := range l.set.Conditions {
+		declared[c.Name] = struct{}{}
+	}
+
+	for name := range l.conditionSeen {
+		if _, ok := declared[name]; !ok {
+			return PTOErrorf("observation has condition %s not declared in set", name).StatusIs(http.StatusBadRequest)
 		}
 	}
 
-	// done
-	return &set, pathSeen, conditionSeen, nil
+	return nil
 }
 
-// writeObsToCSV writes an unparsed observation to a CSV writer, for COPY FROM
-// loading of observations into a PostgreSQL table.
-func writeObsToCSV(
-	set *ObservationSet,
-	cidCache ConditionCache,
-	pidCache PathCache,
-	line string,
-	out *csv.Writer) error {
+// addCondition checks a condition the first time it is seen, ensures it has
+// an ID, and looks up its registered value type.
+func (l *obsLoader) addCondition(name string) error {
+	if l.conditionDeclared != nil {
+		if _, ok := l.conditionDeclared[name]; !ok {
+			return PTOErrorf("observation has condition %s not declared in set", name).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	c := Condition{Name: name}
+	if err := c.SelectByName(l.t); err != nil && err != pg.ErrNoRows {
+		return err
+	}
 
+	if _, ok := l.cidCache[name]; !ok {
+		l.conditionCached = append(l.conditionCached, name)
+	}
+	if err := l.cidCache.SetConditionID(l.t, &c); err != nil {
+		return err
+	}
+
+	if c.ValueType != "" {
+		l.valueTypes[name] = &c
+	}
+
+	l.conditionSeen[name] = struct{}{}
+	return nil
+}
+
+// uncache removes conditions added to the condition cache by this loader,
+// whose IDs are invalid if the transaction loading them is rolled back.
+func (l *obsLoader) uncache() {
+	for _, name := range l.conditionCached {
+		delete(l.cidCache, name)
+	}
+}
+
+// parseObsLine splits an observation, given as a JSON array line from an
+// observation set file, into its elements.
+func parseObsLine(line string) ([]string, error) {
 	var jslice []string
 
 	if err := json.Unmarshal([]byte(line), &jslice); err != nil {
+		return nil, PTOErrorf("bad observation: %s", err.Error()).StatusIs(http.StatusBadRequest)
+	}
+
+	if len(jslice) < 5 {
+		return nil, PTOErrorf("observation requires at least five elements").StatusIs(http.StatusBadRequest)
+	}
+
+	return jslice, nil
+}
+
+// checkObsElements checks the times and path of an observation split into
+// its elements by parseObsLine, before it is loaded. Path elements are checked
+// separately, as paths repeat often.
+func checkObsElements(jslice []string) error {
+	start, err := time.Parse(time.RFC3339, jslice[1])
+	if err != nil {
+		return PTOErrorf("bad start time %s", jslice[1]).StatusIs(http.StatusBadRequest)
+	}
+
+	end, err := time.Parse(time.RFC3339, jslice[2])
+	if err != nil {
+		return PTOErrorf("bad end time %s", jslice[2]).StatusIs(http.StatusBadRequest)
+	}
+
+	if end.Before(start) {
+		return PTOErrorf("end time %s before start time %s", jslice[2], jslice[1]).StatusIs(http.StatusBadRequest)
+	}
+
+	if strings.TrimSpace(jslice[3]) == "" {
+		return PTOErrorf("empty path").StatusIs(http.StatusBadRequest)
+	}
+
+	return nil
+}
+
+// add checks an observation, split into its elements by parseObsLine, and
+// adds it to the current batch, loading the batch if full.
+func (l *obsLoader) add(jslice []string) error {
+	if err := checkObsElements(jslice); err != nil {
 		return err
 	}
 
-	// add zero value if missing
-	if len(jslice) == 5 {
-		jslice = append(jslice, "0")
+	// check path, once per batch
+	if _, ok := l.pathSet[jslice[3]]; !ok {
+		p := Path{String: jslice[3]}
+		if err := p.Parse(); err != nil {
+			return PTOErrorf("bad path: %s", err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		l.pathSet[jslice[3]] = struct{}{}
 	}
 
-	// replace set ID
-	jslice[0] = fmt.Sprintf("%d", set.ID)
+	// check condition, once per load
+	if _, ok := l.conditionSeen[jslice[4]]; !ok {
+		if err := l.addCondition(jslice[4]); err != nil {
+			return err
+		}
+	}
 
-	// replace path string with path ID
-	jslice[3] = fmt.Sprintf("%d", pidCache[jslice[3]])
+	// check value against the condition's registered value type
+	if c, ok := l.valueTypes[jslice[4]]; ok {
+		value := ""
+		if len(jslice) >= 6 {
+			value = jslice[5]
+		}
+		if err := c.ValidateValue(value); err != nil {
+			return err
+		}
+	}
 
-	// replace condition name with condition ID
-	jslice[4] = fmt.Sprintf("%d", cidCache[jslice[4]])
+	l.batch = append(l.batch, jslice)
+	if len(l.batch) >= obsLoadBatchSize {
+		return l.flush()
+	}
+	return nil
+}
 
-	// write as CSV to output writer
-	return out.Write(jslice)
+// ensurePartitions makes sure observation partitions exist for the months in
+// which the observations in the current batch start.
+func (l *obsLoader) ensurePartitions() error {
+	if l.partitionMonths == nil {
+		partitioned, err := observationsPartitioned(l.t)
+		if err != nil {
+			return err
+		}
+		l.partitioned = partitioned
+		l.partitionMonths = make(map[time.Time]struct{})
+	}
+
+	if !l.partitioned {
+		return nil
+	}
+
+	for _, jslice := range l.batch {
+		// times have been checked when added to the batch
+		start, _ := time.Parse(time.RFC3339, jslice[1])
+		month := observationMonth(start)
+		if _, ok := l.partitionMonths[month]; ok {
+			continue
+		}
+		if err := ensureObservationPartition(l.t, month); err != nil {
+			return err
+		}
+		l.partitionMonths[month] = struct{}{}
+	}
+
+	return nil
 }
 
-func loadObservations(
+// flush resolves the paths in the current batch and copies its observations
+// into the database.
+func (l *obsLoader) flush() error {
+	if len(l.batch) == 0 {
+		return nil
+	}
+
+	pathIDs, err := l.pidCache.PathIDs(l.t, l.pathSet)
+	if err != nil {
+		return err
+	}
+
+	if err := l.ensurePartitions(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	out := csv.NewWriter(&buf)
+	for _, jslice := range l.batch {
+		if err := writeObsToCSV(l.set, l.cidCache, pathIDs, jslice, out); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := l.t.CopyFrom(&buf, fmt.Sprintf("COPY %s (set_id, time_start, time_end, path_id, condition_id, value) FROM STDIN WITH CSV", l.table)); err != nil {
+		return PTOWrapError(err)
+	}
+
+	l.batch = l.batch[:0]
+	l.pathSet = make(map[string]struct{})
+	return nil
+}
+
+// writeObsToCSV writes a checked observation to a CSV writer, for COPY FROM
+// loading of observations into a PostgreSQL table.
+func writeObsToCSV(
+	set *ObservationSet,
 	cidCache ConditionCache,
-	pidCache PathCache,
+	pathIDs map[string]int,
+	jslice []string,
+	out *csv.Writer) error {
+
+	row := make([]string, 6)
+
+	// set ID
+	row[0] = fmt.Sprintf("%d", set.ID)
+
+	// times
+	row[1] = jslice[1]
+	row[2] = jslice[2]
+
+	// path ID for path string
+	row[3] = fmt.Sprintf("%d", pathIDs[jslice[3]])
+
+	// condition ID for condition name
+	row[4] = fmt.Sprintf("%d", cidCache[jslice[4]])
+
+	// value, zero if missing
+	if len(jslice) >= 6 {
+		row[5] = jslice[5]
+	} else {
+		row[5] = "0"
+	}
+
+	// write as CSV to output writer
+	return out.Write(row)
+}
+
+// obsLineError annotates an error loading an observation set file with the
+// line on which it occurred, keeping its status.
+func obsLineError(lineno int, err error) error {
+	if perr, ok := err.(*PTOError); ok && perr.Status() != http.StatusInternalServerError {
+		return PTOErrorf("line %d: %s", lineno, perr.Error()).StatusIs(perr.Status())
+	}
+	return PTOWrapError(err)
+}
+
+// loadObsStream reads an observation set file from a stream in a single pass,
+// loading its observations into the database within a transaction. If create
+// is true, the set is created from the metadata in the file, which may appear
+// anywhere in it; as when metadata is coalesced, the last value of each key
+// wins. Lines which are neither observations nor metadata are rejected. An ID
+// is reserved for the set when the first observation is read, and the set is
+// filled in, and the conditions of its observations checked, once all
+// metadata has been read. If create is false, the set must already exist in
+// the database, and metadata in the file is ignored. Observations are copied
+// into the given table, which is the observations table unless they are
+// staged elsewhere first. The configuration is only consulted when creating
+// the set, and may otherwise be nil.
+func loadObsStream(
 	t *pg.Tx,
+	r io.Reader,
 	set *ObservationSet,
-	r *os.File) error {
+	create bool,
+	table string,
+	config *PTOConfiguration,
+	cidCache ConditionCache,
+	pidCache *PathCache) (err error) {
+
+	var l *obsLoader
+	metadataSeen := false
+	reserved := false
+
+	// on failure, the transaction will be rolled back
+	defer func() {
+		if err != nil && l != nil {
+			l.uncache()
+		}
+	}()
+
+	// create the set from its metadata
+	storeSet := func() error {
+		// make sure conditions are inserted
+		if err := cidCache.FillConditionIDsInSet(t, set); err != nil {
+			return err
+		}
+
+		return set.storeNew(t, config, reserved)
+	}
 
 	lineno := 0
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		lineno++
+		line := strings.TrimSpace(in.Text())
+		if len(line) == 0 {
+			continue
+		}
 
-	dbpipe, obspipe, err := os.Pipe()
-	if err != nil {
-		return err
+		switch line[0] {
+		case '{':
+			if !create {
+				continue
+			}
+			if err := set.mergeMetadata([]byte(line)); err != nil {
+				return PTOErrorf("line %d: error in metadata: %s", lineno, err.Error()).StatusIs(http.StatusBadRequest)
+			}
+			metadataSeen = true
+		case '[':
+			if l == nil {
+				if create {
+					if err := set.reserveID(t); err != nil {
+						return err
+					}
+					reserved = true
+				}
+				l = newObsLoader(t, set, !create, cidCache, pidCache)
+				l.table = table
+			}
+			jslice, err := parseObsLine(line)
+			if err != nil {
+				return obsLineError(lineno, err)
+			}
+			if err := l.add(jslice); err != nil {
+				return obsLineError(lineno, err)
+			}
+		default:
+			return PTOErrorf("line %d: %s", lineno, strayLineProblem).StatusIs(http.StatusBadRequest)
+		}
 	}
-	defer dbpipe.Close()
 
-	converr := make(chan error, 1)
+	if err := in.Err(); err != nil {
+		return PTOWrapError(err)
+	}
 
-	// start a reader goroutine to convert observations to CSV
-	// and write them to a pipe we'll COPY FROM
-	go func() {
-		in := bufio.NewScanner(r)
-		out := csv.NewWriter(obspipe)
-		defer obspipe.Close()
+	if l != nil {
+		if err := l.flush(); err != nil {
+			return err
+		}
+	}
 
-		for in.Scan() {
-			lineno++
-			line := strings.TrimSpace(in.Text())
-			if line[0] == '[' {
-				if err := writeObsToCSV(set, cidCache, pidCache, line, out); err != nil {
-					converr <- PTOWrapError(err)
-				}
+	if !create {
+		return nil
+	}
+
+	// now fill in the set, which is created even if it has no observations
+	if !metadataSeen {
+		return PTOErrorf("observation set file has no metadata").StatusIs(http.StatusBadRequest)
+	}
+
+	if l != nil {
+		if err := l.checkDeclared(); err != nil {
+			return err
+		}
+	}
+
+	return storeSet()
+}
+
+// loadObsSetsStream reads an observation set file containing one or more
+// observation sets from a stream in a single pass, creating the sets and
+// loading their observations into the database within a transaction. As in
+// files produced by ptocat, each metadata object begins a new set, and
+// observations belong to the set whose metadata precedes them, unless their
+// set ID refers to an earlier set in the file. A set is referred to by the
+// set ID of its first observation. Returns the sets created, in file order.
+func loadObsSetsStream(
+	t *pg.Tx,
+	r io.Reader,
+	config *PTOConfiguration,
+	cidCache ConditionCache,
+	pidCache *PathCache) (sets []*ObservationSet, err error) {
+
+	var loaders []*obsLoader
+	var current *obsLoader
+	currentBound := false
+	loadersBySetID := make(map[string]*obsLoader)
+
+	// on failure, the transaction will be rolled back
+	defer func() {
+		if err != nil {
+			for _, l := range loaders {
+				l.uncache()
 			}
 		}
-		out.Flush()
-		converr <- nil
 	}()
 
-	// now copy from the CSV pipe
-	if _, err := t.CopyFrom(dbpipe, "COPY observations (set_id, time_start, time_end, path_id, condition_id, value) FROM STDIN WITH CSV"); err != nil {
-		return PTOWrapError(err)
+	lineno := 0
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		lineno++
+		line := strings.TrimSpace(in.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		switch line[0] {
+		case '{':
+			// new observation set; create it
+			set := new(ObservationSet)
+			if err := set.UnmarshalJSON([]byte(line)); err != nil {
+				return nil, PTOErrorf("line %d: error in metadata: %s", lineno, err.Error()).StatusIs(http.StatusBadRequest)
+			}
+
+			if err := cidCache.FillConditionIDsInSet(t, set); err != nil {
+				return nil, err
+			}
+
+			if err := set.Insert(t, config, true); err != nil {
+				return nil, obsLineError(lineno, err)
+			}
+
+			current = newObsLoader(t, set, true, cidCache, pidCache)
+			currentBound = false
+			loaders = append(loaders, current)
+			sets = append(sets, set)
+		case '[':
+			if current == nil {
+				return nil, PTOErrorf("line %d: observation without preceding metadata", lineno).StatusIs(http.StatusBadRequest)
+			}
+
+			jslice, err := parseObsLine(line)
+			if err != nil {
+				return nil, obsLineError(lineno, err)
+			}
+
+			// find the set this observation belongs to
+			l := current
+			if setid := jslice[0]; setid != "" {
+				if !currentBound {
+					loadersBySetID[setid] = current
+					currentBound = true
+				} else if l = loadersBySetID[setid]; l == nil {
+					return nil, PTOErrorf("line %d: observation refers to unknown set %s", lineno, setid).StatusIs(http.StatusBadRequest)
+				}
+			}
+
+			if err := l.add(jslice); err != nil {
+				return nil, obsLineError(lineno, err)
+			}
+		default:
+			return nil, PTOErrorf("line %d: %s", lineno, strayLineProblem).StatusIs(http.StatusBadRequest)
+		}
 	}
 
-	// wait on the converter goroutine
-	return <-converr
+	if err := in.Err(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if len(sets) == 0 {
+		return nil, PTOErrorf("observation set file has no metadata").StatusIs(http.StatusBadRequest)
+	}
+
+	for _, l := range loaders {
+		if err := l.flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sets, nil
+}
+
+// CopySetFromObsStream loads an observation set file from a stream into the
+// database in a single pass. It uses given caches to cache condition and path
+// IDs, and creates the ObservationSet from the metadata found in the file,
+// which must precede the observations, as the configuration allows.
+func CopySetFromObsStream(
+	r io.Reader,
+	db *pg.DB,
+	config *PTOConfiguration,
+	cidCache ConditionCache,
+	pidCache *PathCache) (*ObservationSet, error) {
+
+	set := &ObservationSet{}
+
+	// spin up a transaction
+	err := db.RunInTransaction(func(t *pg.Tx) error {
+
+		// create the set and insert the observations
+		if err := loadObsStream(t, r, set, true, "observations", config, cidCache, pidCache); err != nil {
+			return err
+		}
+
+		// and compute statistics and rollups over them
+		if err := set.updateStats(t); err != nil {
+			return err
+		}
+		return set.updateRollups(t)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
 }
 
 // CopySetFromObsFile loads an observation file from a local path into the
@@ -628,8 +1521,9 @@ func loadObservations(
 func CopySetFromObsFile(
 	filename string,
 	db *pg.DB,
+	config *PTOConfiguration,
 	cidCache ConditionCache,
-	pidCache PathCache) (*ObservationSet, error) {
+	pidCache *PathCache) (*ObservationSet, error) {
 
 	obsfile, err := os.Open(filename)
 	if err != nil {
@@ -637,61 +1531,93 @@ func CopySetFromObsFile(
 	}
 	defer obsfile.Close()
 
-	// first pass: extract paths, conditions, and metadata
-	set, pathSet, conditionSet, err := obsFileFirstPass(obsfile)
+	return CopySetFromObsStream(obsfile, db, config, cidCache, pidCache)
+}
+
+// CopySetsFromObsStream loads an observation set file containing one or more
+// observation sets, each beginning with its metadata, from a stream into the
+// database in a single pass. All the sets are created, or none of them. It
+// uses given caches to cache condition and path IDs, and creates the sets as
+// the configuration allows. This is used by the API for bulk uploads.
+func CopySetsFromObsStream(
+	r io.Reader,
+	db *pg.DB,
+	config *PTOConfiguration,
+	cidCache ConditionCache,
+	pidCache *PathCache) ([]*ObservationSet, error) {
+
+	var sets []*ObservationSet
+
+	// spin up a transaction
+	err := db.RunInTransaction(func(t *pg.Tx) error {
+		var err error
+
+		// create the sets and insert the observations
+		if sets, err = loadObsSetsStream(t, r, config, cidCache, pidCache); err != nil {
+			return err
+		}
+
+		for _, set := range sets {
+			// and compute statistics and rollups over them
+			if err := set.updateStats(t); err != nil {
+				return err
+			}
+			if err := set.updateRollups(t); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
 	if err != nil {
 		return nil, err
 	}
 
-	// ensure every condition is declared
-	if err := set.verifyConditionSet(conditionSet); err != nil {
-		return nil, err
-	}
+	return sets, nil
+}
 
-	// now rewind for a second pass
-	if _, err := obsfile.Seek(0, 0); err != nil {
-		return nil, PTOWrapError(err)
-	}
+// CopyDataFromObsStream loads observations in observation set file format
+// from a stream into the database in a single pass. It requires an
+// ObservationSet to already exist in the database. It uses given caches to
+// cache condition and path IDs, and checks conditions against those declared.
+// This is used by the API to load uploaded observation set data.
+func CopyDataFromObsStream(
+	r io.Reader,
+	db *pg.DB, set *ObservationSet,
+	cidCache ConditionCache,
+	pidCache *PathCache) error {
 
 	// spin up a transaction
-	err = db.RunInTransaction(func(t *pg.Tx) error {
+	return db.RunInTransaction(func(t *pg.Tx) error {
 
-		// make sure conditions are inserted
-		if err := cidCache.FillConditionIDsInSet(t, set); err != nil {
+		// insert the observations
+		if err := loadObsStream(t, r, set, false, "observations", nil, cidCache, pidCache); err != nil {
 			return err
 		}
 
-		// make sure paths are inserted
-		if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
+		// note that the set's data has changed
+		if err := set.bumpGeneration(t); err != nil {
 			return err
 		}
 
-		// insert the set
-		if err := set.Insert(t, true); err != nil {
+		// and compute statistics and rollups over it
+		if err := set.updateStats(t); err != nil {
 			return err
 		}
-
-		// now insert the observations
-		return loadObservations(cidCache, pidCache, t, set, obsfile)
+		return set.updateRollups(t)
 	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	return set, nil
 }
 
 // CopyDataFromObsFile loads an observation file from a local path into the
 // database. It requires an ObservationSet to already exist in the database.
 // It uses given caches to cache condition and path IDs, and checks conditions
-// against those declared. This is used by ptoload to load observation sets
-// created by local analysis into the database.
+// against those declared.
 func CopyDataFromObsFile(
 	filename string,
 	db *pg.DB, set *ObservationSet,
 	cidCache ConditionCache,
-	pidCache PathCache) error {
+	pidCache *PathCache) error {
 
 	obsfile, err := os.Open(filename)
 	if err != nil {
@@ -699,33 +1625,7 @@ func CopyDataFromObsFile(
 	}
 	defer obsfile.Close()
 
-	// first pass: extract paths and conditions
-	_, pathSet, conditionSet, err := obsFileFirstPass(obsfile)
-	if err != nil {
-		return err
-	}
-
-	// ensure every condition is declared
-	if err := set.verifyConditionSet(conditionSet); err != nil {
-		return err
-	}
-
-	// now rewind for a second pass
-	if _, err := obsfile.Seek(0, 0); err != nil {
-		return PTOWrapError(err)
-	}
-
-	// spin up a transaction
-	return db.RunInTransaction(func(t *pg.Tx) error {
-
-		// make sure paths are inserted
-		if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
-			return err
-		}
-
-		// now insert the observations
-		return loadObservations(cidCache, pidCache, t, set, obsfile)
-	})
+	return CopyDataFromObsStream(obsfile, db, set, cidCache, pidCache)
 }
 
 // CopyDataToStream copies all the observations in this observation set in
@@ -849,16 +1749,235 @@ func ObservationSetIDsWithMetadataValue(db orm.DB, k string, v string) ([]int, e
 	return setIds, nil
 }
 
-// ObservationSetIDsWithSource lists all observation set IDs in the database
-// where the given source is present in the sources list. The source must be
-// given as a fully qualified analyzer URL.
-func ObservationSetIDsWithSource(db orm.DB, source string) ([]int, error) {
+// MetadataTerm is a single condition on an observation set metadata key, for
+// use with ObservationSetIDsWithMetadataTerms.
+type MetadataTerm struct {
+	Key string
+	// Operator: one of eq, ne, prefix, regex, lt, le, gt, ge, contains,
+	// exists, or absent
+	Op    string
+	Value string
+}
+
+// comparisonOperators maps numeric comparison operator names to SQL
+var comparisonOperators = map[string]string{
+	"lt": "<",
+	"le": "<=",
+	"gt": ">",
+	"ge": ">=",
+}
+
+// decimalNumberRegexp matches plain decimal numbers, with optional sign and
+// exponent, as accepted by PostgreSQL's numeric type; strconv.ParseFloat
+// also accepts hexadecimal and underscore-separated forms, which it does not.
+var decimalNumberRegexp = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// Verify checks that this MetadataTerm has a known operator, and a value
+// of the right type where the operator requires one.
+func (mt *MetadataTerm) Verify() error {
+	if mt.Key == "" {
+		return PTOErrorf("metadata term missing key").StatusIs(http.StatusBadRequest)
+	}
+
+	switch mt.Op {
+	case "exists", "absent":
+		return nil
+	case "eq", "ne", "prefix", "contains":
+	case "regex":
+		// regular expressions are checked by the database, in verifyRegex
+	case "lt", "le", "gt", "ge":
+		if !decimalNumberRegexp.MatchString(mt.Value) {
+			return PTOErrorf("metadata operator %s on key %s requires a decimal number", mt.Op, mt.Key).StatusIs(http.StatusBadRequest)
+		}
+	default:
+		return PTOErrorf("unsupported metadata operator %s", mt.Op).StatusIs(http.StatusBadRequest)
+	}
+
+	if mt.Value == "" {
+		return PTOErrorf("metadata operator %s on key %s requires a value", mt.Op, mt.Key).StatusIs(http.StatusBadRequest)
+	}
+
+	return nil
+}
+
+// invalidRegexSQLState is the PostgreSQL error code for an invalid regular
+// expression.
+const invalidRegexSQLState = "2201B"
+
+// verifyRegex checks that this MetadataTerm's value is a regular expression
+// PostgreSQL accepts, since its syntax differs from Go's.
+func (mt *MetadataTerm) verifyRegex(db orm.DB) error {
+	var match bool
+	if _, err := db.QueryOne(pg.Scan(&match), "SELECT '' ~ ?", mt.Value); err != nil {
+		if pgerr, ok := err.(pg.Error); ok && pgerr.Field('C') == invalidRegexSQLState {
+			return PTOErrorf("bad regular expression for metadata key %s: %s", mt.Key, pgerr.Field('M')).StatusIs(http.StatusBadRequest)
+		}
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// jsonValue returns this MetadataTerm's value as JSON: the value itself if it
+// is valid JSON (e.g. 42, true, or ["a", "b"]), or the value as a JSON string
+// otherwise.
+func (mt *MetadataTerm) jsonValue() string {
+	if json.Valid([]byte(mt.Value)) {
+		return mt.Value
+	}
+	b, _ := json.Marshal(mt.Value)
+	return string(b)
+}
+
+// whereExpr returns a SQL condition and parameters for this MetadataTerm.
+// Equality matches values equal to the term's value interpreted as JSON, or
+// as a string, so v=42 matches both the number 42 and the string "42".
+// Prefix and regular expression matches apply only to string values, and
+// numeric comparisons only to numeric values. It returns an error for terms
+// with unsupported operators, which Verify rejects.
+func (mt *MetadataTerm) whereExpr() (string, []interface{}, error) {
+	eqExpr := "(metadata->? = ?::jsonb OR metadata->? = to_jsonb(?::text))"
+	eqParams := []interface{}{mt.Key, mt.jsonValue(), mt.Key, mt.Value}
+
+	switch mt.Op {
+	case "exists":
+		return "metadata->? IS NOT NULL", []interface{}{mt.Key}, nil
+	case "absent":
+		return "metadata->? IS NULL", []interface{}{mt.Key}, nil
+	case "eq":
+		return eqExpr, eqParams, nil
+	case "ne":
+		return "(metadata->? IS NOT NULL AND NOT " + eqExpr + ")", append([]interface{}{mt.Key}, eqParams...), nil
+	case "prefix":
+		return "(jsonb_typeof(metadata->?) = 'string' AND metadata->>? LIKE ?)",
+			[]interface{}{mt.Key, mt.Key, likeEscaper.Replace(mt.Value) + "%"}, nil
+	case "regex":
+		return "(jsonb_typeof(metadata->?) = 'string' AND metadata->>? ~ ?)",
+			[]interface{}{mt.Key, mt.Key, mt.Value}, nil
+	case "lt", "le", "gt", "ge":
+		return "(jsonb_typeof(metadata->?) = 'number' AND (metadata->>?)::numeric " + comparisonOperators[mt.Op] + " ?::numeric)",
+			[]interface{}{mt.Key, mt.Key, mt.Value}, nil
+	case "contains":
+		return "metadata->? @> ?::jsonb", []interface{}{mt.Key, mt.jsonValue()}, nil
+	default:
+		return "", nil, PTOErrorf("unverified metadata operator %s on key %s", mt.Op, mt.Key)
+	}
+}
+
+// ObservationSetIDsWithMetadataTerms lists all observation set IDs in the
+// database whose metadata matches all of the given terms, or any of them if
+// the any flag is set, in a single query. Terms using operators other than
+// absent only match sets where the key is present.
+func ObservationSetIDsWithMetadataTerms(db orm.DB, terms []MetadataTerm, any bool) ([]int, error) {
+	for i := range terms {
+		if err := terms[i].Verify(); err != nil {
+			return nil, err
+		}
+		if terms[i].Op == "regex" {
+			if err := terms[i].verifyRegex(db); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var setIds []int
+
+	err := db.Model(&ObservationSet{}).
+		ColumnExpr("array_agg(id)").
+		WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+			for i := range terms {
+				expr, params, err := terms[i].whereExpr()
+				if err != nil {
+					return nil, err
+				}
+				if any {
+					q = q.WhereOr(expr, params...)
+				} else {
+					q = q.Where(expr, params...)
+				}
+			}
+			return q, nil
+		}).
+		Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
+// ObservationSetIDsInTimeRange lists all observation set IDs in the database
+// containing observations overlapping the given time range, according to the
+// set's statistics. Either end of the range may be nil, leaving it open. Sets
+// without data have no statistics, and never match.
+func ObservationSetIDsInTimeRange(db orm.DB, start *time.Time, end *time.Time) ([]int, error) {
+	var setIds []int
+
+	q := db.Model(&ObservationSet{}).ColumnExpr("array_agg(id)").Where("stats->>'time_start' IS NOT NULL")
+	if start != nil {
+		q = q.Where("(stats->>'time_end')::timestamptz >= ?", start)
+	}
+	if end != nil {
+		q = q.Where("(stats->>'time_start')::timestamptz <= ?", end)
+	}
+
+	err := q.Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
+// ObservationSetIDsCreatedAfter lists all observation set IDs in the database
+// created after the given time.
+func ObservationSetIDsCreatedAfter(db orm.DB, after time.Time) ([]int, error) {
+	return observationSetIDsWithTimestampAfter(db, "created", after)
+}
+
+// ObservationSetIDsModifiedAfter lists all observation set IDs in the
+// database last modified after the given time.
+func ObservationSetIDsModifiedAfter(db orm.DB, after time.Time) ([]int, error) {
+	return observationSetIDsWithTimestampAfter(db, "modified", after)
+}
+
+func observationSetIDsWithTimestampAfter(db orm.DB, column string, after time.Time) ([]int, error) {
 	var setIds []int
 
 	err := db.Model(&ObservationSet{}).
 		ColumnExpr("array_agg(id)").
-		Where("? ~~~~ ANY(sources)", source+"%").
-		//		Where("? = ANY(sources)", source).
+		Where("? > ?", pg.F(column), after).
+		Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
+// likeEscaper escapes strings for literal matching in a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ObservationSetIDsWithSource lists all observation set IDs in the database
+// where the given source, or a URL of which it is a prefix, is present in the
+// sources list. The source must be given as a fully qualified URL.
+func ObservationSetIDsWithSource(db orm.DB, source string) ([]int, error) {
+	var setIds []int
+
+	err := db.Model(&ObservationSetSource{}).
+		ColumnExpr("array_agg(DISTINCT observation_set_id)").
+		Where("source LIKE ?", likeEscaper.Replace(source)+"%").
 		Select(pg.Array(&setIds))
 	if err == pg.ErrNoRows {
 		return make([]int, 0), nil
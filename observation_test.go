@@ -1,7 +1,11 @@
 package pto3_test
 
 import (
+	"encoding/json"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	pto3 "github.com/mami-project/pto3-go"
 )
@@ -63,3 +67,229 @@ func TestObsetQuery(t *testing.T) {
 	}
 
 }
+
+func TestObsetStats(t *testing.T) {
+	set := pto3.ObservationSet{ID: TestQueryCacheSetID}
+	if err := set.SelectByID(TestDB); err != nil {
+		t.Fatal(err)
+	}
+
+	if set.Stats == nil {
+		t.Fatal("no statistics computed for query test set")
+	}
+
+	if set.Stats.Observations != 14400 || set.CountObservations(TestDB) != 14400 {
+		t.Fatalf("expected 14400 observations in statistics, got %d", set.Stats.Observations)
+	}
+
+	if set.Stats.TimeStart == nil || set.Stats.TimeStart.UTC().Format(time.RFC3339) != "2017-12-05T14:31:26Z" {
+		t.Fatalf("bad statistics start time %v", set.Stats.TimeStart)
+	}
+
+	if set.Stats.TimeEnd == nil || set.Stats.TimeEnd.UTC().Format(time.RFC3339) != "2017-12-05T16:31:53Z" {
+		t.Fatalf("bad statistics end time %v", set.Stats.TimeEnd)
+	}
+
+	if set.Stats.Conditions["pto.test.color.red"] != 3195 {
+		t.Fatalf("expected 3195 pto.test.color.red observations in statistics, got %d", set.Stats.Conditions["pto.test.color.red"])
+	}
+
+	if set.Stats.DistinctPaths != 4506 || set.Stats.DistinctTargets != 4506 {
+		t.Fatalf("expected 4506 distinct paths and targets, got %d and %d", set.Stats.DistinctPaths, set.Stats.DistinctTargets)
+	}
+}
+
+func TestObsetMetadataTerms(t *testing.T) {
+	testTerms := []struct {
+		terms   []pto3.MetadataTerm
+		any     bool
+		matches bool
+	}{
+		{[]pto3.MetadataTerm{{"test_obset_type", "eq", "query"}}, false, true},
+		{[]pto3.MetadataTerm{{"test_obset_type", "ne", "query"}}, false, false},
+		{[]pto3.MetadataTerm{{"test_obset_type", "prefix", "que"}}, false, true},
+		{[]pto3.MetadataTerm{{"test_obset_type", "regex", "^q.*y$"}}, false, true},
+		{[]pto3.MetadataTerm{{"test_obset_type", "regex", "^x"}}, false, false},
+		{[]pto3.MetadataTerm{{"test_obset_type", "regex", "^(?=q)(qu)e"}}, false, true},
+		{[]pto3.MetadataTerm{{"this_is_the_query_test_obset", "exists", ""}}, false, true},
+		{[]pto3.MetadataTerm{{"this_is_the_query_test_obset", "absent", ""}}, false, false},
+		{[]pto3.MetadataTerm{
+			{"test_obset_type", "eq", "query"},
+			{"this_is_the_query_test_obset", "eq", "nope"}}, false, false},
+		{[]pto3.MetadataTerm{
+			{"test_obset_type", "eq", "query"},
+			{"this_is_the_query_test_obset", "eq", "nope"}}, true, true},
+	}
+
+	for i, tt := range testTerms {
+		setIds, err := pto3.ObservationSetIDsWithMetadataTerms(TestDB, tt.terms, tt.any)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, setid := range setIds {
+			if setid == TestQueryCacheSetID {
+				found = true
+			}
+		}
+
+		if found != tt.matches {
+			t.Fatalf("metadata terms %d: expected match %v, got set IDs %v", i, tt.matches, setIds)
+		}
+	}
+
+	badTerms := []pto3.MetadataTerm{
+		{"test_obset_type", "like", "query"},
+		{"test_obset_type", "eq", ""},
+		{"test_obset_type", "regex", "(unclosed"},
+		{"test_obset_type", "regex", "(?P<name>query)"},
+		{"test_obset_type", "gt", "three"},
+		{"test_obset_type", "gt", "0x1p-2"},
+		{"test_obset_type", "le", "1_000"},
+		{"test_obset_type", "lt", "Inf"},
+		{"", "exists", ""},
+	}
+
+	for _, bt := range badTerms {
+		_, err := pto3.ObservationSetIDsWithMetadataTerms(TestDB, []pto3.MetadataTerm{bt}, false)
+		if err == nil {
+			t.Fatalf("bad metadata term %v accepted", bt)
+		}
+		if perr, ok := err.(*pto3.PTOError); !ok || perr.Status() != http.StatusBadRequest {
+			t.Fatalf("bad metadata term %v rejected with %v, expected status 400", bt, err)
+		}
+	}
+}
+
+func TestObsetTypedMetadata(t *testing.T) {
+	set := pto3.ObservationSet{}
+	if err := json.Unmarshal([]byte(`{
+		"_sources": ["https://localhost:8383/raw/typed/typed-0.ndjson"],
+		"_analyzer": "https://localhost:8383/typed_metadata_analyzer.json",
+		"_conditions": ["pto.test.color.red"],
+		"typed_test_runs": 3,
+		"typed_test_complete": true,
+		"typed_test_tags": ["ecn", "tfo"],
+		"typed_test_version": "3"
+	}`), &set); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.Insert(TestDB, TestConfig, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// values must come back from the database with their types intact
+	setDown := pto3.ObservationSet{ID: set.ID}
+	if err := setDown.SelectByID(TestDB); err != nil {
+		t.Fatal(err)
+	}
+
+	if runs, ok := setDown.Metadata["typed_test_runs"].(float64); !ok || runs != 3 {
+		t.Fatalf("numeric metadata not preserved: %v", setDown.Metadata["typed_test_runs"])
+	}
+
+	if complete, ok := setDown.Metadata["typed_test_complete"].(bool); !ok || !complete {
+		t.Fatalf("boolean metadata not preserved: %v", setDown.Metadata["typed_test_complete"])
+	}
+
+	if tags, ok := setDown.Metadata["typed_test_tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Fatalf("list metadata not preserved: %v", setDown.Metadata["typed_test_tags"])
+	}
+
+	// and queries on them must be type-aware
+	testTerms := []struct {
+		term    pto3.MetadataTerm
+		matches bool
+	}{
+		{pto3.MetadataTerm{"typed_test_runs", "eq", "3"}, true},
+		{pto3.MetadataTerm{"typed_test_runs", "gt", "2.5"}, true},
+		{pto3.MetadataTerm{"typed_test_runs", "lt", "3"}, false},
+		{pto3.MetadataTerm{"typed_test_runs", "le", "3e0"}, true},
+		{pto3.MetadataTerm{"typed_test_runs", "ge", "+.3E1"}, true},
+		{pto3.MetadataTerm{"typed_test_version", "eq", "3"}, true},
+		{pto3.MetadataTerm{"typed_test_version", "ge", "1"}, false},
+		{pto3.MetadataTerm{"typed_test_runs", "prefix", "3"}, false},
+		{pto3.MetadataTerm{"typed_test_complete", "eq", "true"}, true},
+		{pto3.MetadataTerm{"typed_test_complete", "ne", "true"}, false},
+		{pto3.MetadataTerm{"typed_test_tags", "contains", "tfo"}, true},
+		{pto3.MetadataTerm{"typed_test_tags", "contains", `["ecn", "tfo"]`}, true},
+		{pto3.MetadataTerm{"typed_test_tags", "contains", "quic"}, false},
+	}
+
+	for i, tt := range testTerms {
+		setIds, err := pto3.ObservationSetIDsWithMetadataTerms(TestDB, []pto3.MetadataTerm{tt.term}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, setid := range setIds {
+			if setid == set.ID {
+				found = true
+			}
+		}
+
+		if found != tt.matches {
+			t.Fatalf("typed metadata term %d (%v): expected match %v, got set IDs %v", i, tt.term, tt.matches, setIds)
+		}
+	}
+
+	if _, err := pto3.ObservationSetIDsWithMetadataTerms(TestDB,
+		[]pto3.MetadataTerm{{"typed_test_runs", "gt", "many"}}, false); err == nil {
+		t.Fatal("numeric comparison with non-numeric value accepted")
+	}
+}
+
+func TestObsetStreamLoad(t *testing.T) {
+	metadata := `{"_analyzer": "https://localhost:8383/stream_test_analyzer.json", ` +
+		`"_sources": ["https://localhost:8383/raw/stream/stream-0.ndjson"], ` +
+		`"_conditions": ["pto.test.stream.up", "pto.test.stream.down"]}`
+	observations := `["", "2017-12-06T10:00:00Z", "2017-12-06T10:00:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.stream.up"]
+["", "2017-12-06T10:00:02Z", "2017-12-06T10:00:03Z", "10.0.0.1 * 10.0.0.3", "pto.test.stream.down"]`
+	undeclared := `["", "2017-12-06T10:00:04Z", "2017-12-06T10:00:05Z", "10.0.0.1 * 10.0.0.4", "pto.test.stream.sideways"]`
+
+	testStreams := []struct {
+		content string
+		ok      bool
+	}{
+		// metadata may precede or follow observations, or both
+		{metadata + "\n" + observations, true},
+		{observations + "\n" + metadata, true},
+		{metadata + "\n" + observations + "\n" + metadata, true},
+		// later metadata need only give the keys it changes
+		{metadata + "\n" + observations + "\n" + `{"stream_test": "merged"}`, true},
+		// and other lines are rejected
+		{metadata + "\n" + observations + "\n# comment", false},
+		// but must be present
+		{observations, false},
+		// conditions are checked in either case
+		{metadata + "\n" + observations + "\n" + undeclared, false},
+		{observations + "\n" + undeclared + "\n" + metadata, false},
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidCache := pto3.NewPathCache(0)
+
+	for i, ts := range testStreams {
+		set, err := pto3.CopySetFromObsStream(strings.NewReader(ts.content), TestDB, TestConfig, cidCache, pidCache)
+		if ts.ok && err != nil {
+			t.Fatalf("valid observation stream %d rejected: %s", i, err.Error())
+		} else if !ts.ok && err == nil {
+			t.Fatalf("invalid observation stream %d accepted", i)
+		}
+
+		if ts.ok {
+			if set.ID == 0 || set.Stats == nil || set.Stats.Observations != 2 {
+				t.Fatalf("observation stream %d loaded incorrectly: %v", i, set)
+			}
+			if len(set.Conditions) != 2 || set.Created == nil {
+				t.Fatalf("observation stream %d created set without metadata: %v", i, set)
+			}
+		}
+	}
+}
@@ -3,12 +3,11 @@ package papi
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"time"
 
 	"github.com/go-pg/pg"
 	"github.com/gorilla/mux"
@@ -16,9 +15,10 @@ import (
 )
 
 type ObsAPI struct {
-	config *pto3.PTOConfiguration
-	azr    Authorizer
-	db     *pg.DB
+	config   *pto3.PTOConfiguration
+	azr      Authorizer
+	db       *pg.DB
+	pidCache *pto3.PathCache
 }
 
 func (oa *ObsAPI) writeMetadataResponse(w http.ResponseWriter, set *pto3.ObservationSet, status int) {
@@ -145,10 +145,14 @@ func intersectSetIds(a []int, b []int, hasSets bool) []int {
 	}
 }
 
-// handleMetadataQuery handles GET/POST /obs/by_metadata. It requires two
-// URL/form parameters: 'k', the key to search for, and 'v', the value to
-// search for.
-
+// handleMetadataQuery handles GET/POST /obs/by_metadata. Metadata is searched
+// with repeated URL/form parameters 'k', 'op', and 'v': each key is paired
+// with the operator and value in the same position, so if any 'op' or 'v' is
+// given there must be one for each 'k'. The operator defaults to eq if a value
+// is given, and exists otherwise. The 'match' parameter is 'all' (the
+// default) if every term must match, or 'any' if any may. A set must also
+// match every other parameter given (source, analyzer, condition, time range,
+// etc.) to be listed.
 func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
 	// fail if not authorized
 	if !oa.azr.IsAuthorized(w, r, "read_obs") {
@@ -186,6 +190,18 @@ func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
 		queryActive = true
 	}
 
+	analyzerName := r.Form.Get("analyzer_name")
+	if analyzerName != "" {
+		// handle registered analyzer query
+		analyzerSetIds, err := pto3.ObservationSetIDsWithRegisteredAnalyzer(oa.db, analyzerName)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting set IDs by registered analyzer", err)
+			return
+		}
+		setIds = intersectSetIds(setIds, analyzerSetIds, queryActive)
+		queryActive = true
+	}
+
 	condition := r.Form.Get("condition")
 	if condition != "" {
 		// create condition caches
@@ -205,28 +221,117 @@ func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
 		queryActive = true
 	}
 
-	k := r.Form.Get("k")
-	if k != "" {
-		v := r.Form.Get("v")
-		if v != "" {
-			// handle metadata key equality query
-			equalitySetIds, err := pto3.ObservationSetIDsWithMetadataValue(oa.db, k, v)
+	timeStartStr := r.Form.Get("time_start")
+	timeEndStr := r.Form.Get("time_end")
+	if timeStartStr != "" || timeEndStr != "" {
+		// handle time range overlap query
+		var timeStart, timeEnd *time.Time
+		if timeStartStr != "" {
+			t, err := pto3.ParseTime(timeStartStr)
 			if err != nil {
-				pto3.HandleErrorHTTP(w, "selecting set IDs by key equality", err)
+				http.Error(w, fmt.Sprintf("bad time_start %s: %s", timeStartStr, err.Error()), http.StatusBadRequest)
 				return
 			}
-			setIds = intersectSetIds(setIds, equalitySetIds, queryActive)
-			queryActive = true
-		} else {
-			// handle metadata key presence query
-			presenceSetIds, err := pto3.ObservationSetIDsWithMetadata(oa.db, k)
+			timeStart = &t
+		}
+		if timeEndStr != "" {
+			t, err := pto3.ParseTime(timeEndStr)
 			if err != nil {
-				pto3.HandleErrorHTTP(w, "selecting set IDs by key existance", err)
+				http.Error(w, fmt.Sprintf("bad time_end %s: %s", timeEndStr, err.Error()), http.StatusBadRequest)
 				return
 			}
-			setIds = intersectSetIds(setIds, presenceSetIds, queryActive)
-			queryActive = true
+			timeEnd = &t
+		}
+
+		timeSetIds, err := pto3.ObservationSetIDsInTimeRange(oa.db, timeStart, timeEnd)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting set IDs by time range", err)
+			return
+		}
+		setIds = intersectSetIds(setIds, timeSetIds, queryActive)
+		queryActive = true
+	}
+
+	createdAfterStr := r.Form.Get("created_after")
+	if createdAfterStr != "" {
+		// handle creation time query
+		createdAfter, err := pto3.ParseTime(createdAfterStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad created_after %s: %s", createdAfterStr, err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		createdSetIds, err := pto3.ObservationSetIDsCreatedAfter(oa.db, createdAfter)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting set IDs by creation time", err)
+			return
+		}
+		setIds = intersectSetIds(setIds, createdSetIds, queryActive)
+		queryActive = true
+	}
+
+	modifiedAfterStr := r.Form.Get("modified_after")
+	if modifiedAfterStr != "" {
+		// handle modification time query
+		modifiedAfter, err := pto3.ParseTime(modifiedAfterStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad modified_after %s: %s", modifiedAfterStr, err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		modifiedSetIds, err := pto3.ObservationSetIDsModifiedAfter(oa.db, modifiedAfter)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting set IDs by modification time", err)
+			return
+		}
+		setIds = intersectSetIds(setIds, modifiedSetIds, queryActive)
+		queryActive = true
+	}
+
+	keys := r.Form["k"]
+	if len(keys) > 0 {
+		// handle metadata queries: each key is paired with the operator and value
+		// in the same position, if any
+		ops := r.Form["op"]
+		vals := r.Form["v"]
+		if (len(ops) > 0 && len(ops) != len(keys)) || (len(vals) > 0 && len(vals) != len(keys)) {
+			http.Error(w, "each k parameter requires a matching op and v parameter, if any are given", http.StatusBadRequest)
+			return
+		}
+
+		terms := make([]pto3.MetadataTerm, len(keys))
+		for i := range keys {
+			terms[i].Key = keys[i]
+			if len(vals) > 0 {
+				terms[i].Value = vals[i]
+			}
+			if len(ops) > 0 && ops[i] != "" {
+				terms[i].Op = ops[i]
+			} else if terms[i].Value != "" {
+				terms[i].Op = "eq"
+			} else {
+				terms[i].Op = "exists"
+			}
+		}
+
+		var matchAny bool
+		switch r.Form.Get("match") {
+		case "", "all":
+			matchAny = false
+		case "any":
+			matchAny = true
+		default:
+			http.Error(w, fmt.Sprintf("unsupported match mode %s", r.Form.Get("match")), http.StatusBadRequest)
+			return
 		}
+
+		metadataSetIds, err := pto3.ObservationSetIDsWithMetadataTerms(oa.db, terms, matchAny)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting set IDs by metadata", err)
+			return
+		}
+		setIds = intersectSetIds(setIds, metadataSetIds, queryActive)
+		queryActive = true
 	}
 
 	if queryActive == false {
@@ -270,6 +375,102 @@ func (oa *ObsAPI) handleConditionQuery(w http.ResponseWriter, r *http.Request) {
 	w.Write(outb)
 }
 
+// handleGetCondition handles GET /obs/conditions/<name>. If the name is
+// that of a condition, it writes the condition's registry entry as a JSON
+// object. If it is the name of a feature or aspect, it writes a JSON object
+// with the names of all conditions under it in the conditions key.
+func (oa *ObsAPI) handleGetCondition(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	var outb []byte
+	c := pto3.Condition{Name: vars["name"]}
+	err := c.SelectByName(oa.db)
+	if err == nil {
+		outb, err = json.Marshal(&c)
+	} else if err == pg.ErrNoRows {
+		var names []string
+		names, err = pto3.ConditionNamesUnder(oa.db, vars["name"])
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "retrieving conditions", err)
+			return
+		}
+
+		if len(names) == 0 {
+			http.Error(w, fmt.Sprintf("Condition %s not found", vars["name"]), http.StatusNotFound)
+			return
+		}
+
+		outb, err = json.Marshal(&struct {
+			Name       string   `json:"name"`
+			Conditions []string `json:"conditions"`
+		}{vars["name"], names})
+	}
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving condition", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handlePutCondition handles PUT /obs/conditions/<name>. It requires a JSON
+// object with the condition's registry entry in the request, which replaces
+// any existing entry, and echoes back the entry in the response.
+func (oa *ObsAPI) handlePutCondition(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "admin_obs") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, fmt.Sprintf("Content-type for condition registry entry must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var c pto3.Condition
+	if err := json.Unmarshal(b, &c); err != nil {
+		pto3.HandleErrorHTTP(w, "parsing condition registry entry", err)
+		return
+	}
+
+	// name comes from the URL
+	c.Name = vars["name"]
+
+	if err := oa.db.RunInTransaction(func(t *pg.Tx) error {
+		return c.Register(t)
+	}); err != nil {
+		pto3.HandleErrorHTTP(w, "registering condition", err)
+		return
+	}
+
+	outb, err := json.Marshal(&c)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling condition", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(outb)
+}
+
 // handleCreateSet handles POST /obs/create. It requires a JSON object with
 // observation set metadata in the request. It echoes back the metadata as a
 // JSON object in the response, with a link to the created object in the __link
@@ -303,7 +504,7 @@ func (oa *ObsAPI) handleCreateSet(w http.ResponseWriter, r *http.Request) {
 	// now insert the set in the database
 	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
 		// then insert the set itself
-		return set.Insert(t, true)
+		return set.Insert(t, oa.config, true)
 	})
 	if err != nil {
 		log.Print(err)
@@ -314,6 +515,129 @@ func (oa *ObsAPI) handleCreateSet(w http.ResponseWriter, r *http.Request) {
 	oa.writeMetadataResponse(w, &set, http.StatusCreated)
 }
 
+// handleUploadSets handles POST /obs/upload. It requires an observation set
+// file stream in the request, containing one or more observation sets, each
+// beginning with its metadata, and creates all of them, or none. It writes a
+// JSON object with links to the created sets, in file order, in the sets key.
+func (oa *ObsAPI) handleUploadSets(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// create condition cache
+	cidCache, err := pto3.LoadConditionCache(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "loading condition cache", err)
+		return
+	}
+
+	// stream the upload into the database, sharing the server's path cache
+	sets, err := pto3.CopySetsFromObsStream(r.Body, oa.db, oa.config, cidCache, oa.pidCache)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "uploading observation sets", err)
+		return
+	}
+
+	out := struct {
+		Sets []string `json:"sets"`
+	}{make([]string, len(sets))}
+
+	for i, set := range sets {
+		out.Sets[i] = pto3.LinkForSetID(oa.config, set.ID)
+	}
+
+	b, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling set list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// handleValidate handles POST /obs/validate. It requires an observation set
+// file stream in the request, and writes a JSON report of the problems found
+// in it without loading it. If the set query parameter is given, the file is
+// validated as data for that existing set; if the upload query parameter is
+// true, as a file for /obs/upload creating one or more sets; otherwise, as a
+// file creating a new set. The max_errors query parameter limits the problems
+// listed.
+func (oa *ObsAPI) handleValidate(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	maxErrors := pto3.DefaultValidationErrorCap
+	if s := r.URL.Query().Get("max_errors"); s != "" {
+		var err error
+		if maxErrors, err = strconv.Atoi(s); err != nil || maxErrors < 1 {
+			http.Error(w, fmt.Sprintf("bad max_errors %s", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// check against the conditions of an existing set if given
+	var declared []pto3.Condition
+	if s := r.URL.Query().Get("set"); s != "" {
+		setid, err := strconv.ParseUint(s, 16, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad set ID %s: %s", s, err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		set := pto3.ObservationSet{ID: int(setid)}
+		if err := set.SelectByID(oa.db); err != nil {
+			if err == pg.ErrNoRows {
+				http.Error(w, fmt.Sprintf("Observation set %s not found", s), http.StatusNotFound)
+			} else {
+				pto3.HandleErrorHTTP(w, "retrieving set metadata", err)
+			}
+			return
+		}
+		declared = set.Conditions
+	}
+
+	// check as a file for /obs/upload, with one or more sets, if requested
+	upload := false
+	if s := r.URL.Query().Get("upload"); s != "" {
+		var err error
+		if upload, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, fmt.Sprintf("bad upload flag %s", s), http.StatusBadRequest)
+			return
+		}
+		if upload && r.URL.Query().Get("set") != "" {
+			http.Error(w, "cannot validate a file for upload against an existing set", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var report *pto3.ObsValidationReport
+	var err error
+	if upload {
+		report, err = pto3.ValidateObsSetsStream(r.Body, oa.db, maxErrors)
+	} else {
+		report, err = pto3.ValidateObsStream(r.Body, oa.db, declared, maxErrors)
+	}
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "validating observations", err)
+		return
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling validation report", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
 // handleGetMetadata handles Get /obs/<set>. It writes a JSON object with
 // observation set metadata in the response.
 func (oa *ObsAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
@@ -388,7 +712,7 @@ func (oa *ObsAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 
 	// now update
 	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
-		return set.Update(t)
+		return set.Update(t, oa.config)
 	})
 	if err != nil {
 		if err == pg.ErrNoRows {
@@ -447,6 +771,46 @@ func (oa *ObsAPI) handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleArchive handles GET /obs/<set>/archive. It writes a zstd-compressed
+// tar archive of the set's metadata, provenance, conditions, and
+// observations, for import into another PTO instance with ptoimport. As the
+// archive contains the set's data, this requires the same permission as
+// downloading it.
+func (oa *ObsAPI) handleArchive(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// make sure the set exists before starting the archive
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", pto3.ObsArchiveContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"obs-%x.tar.zst\"", set.ID))
+	w.WriteHeader(http.StatusOK)
+	if err := pto3.ExportObsArchive(oa.db, oa.config, []int{set.ID}, w); err != nil {
+		// too late to report the error in the status; the archive is truncated
+		log.Printf("error archiving observation set %x: %s", set.ID, err.Error())
+	}
+}
+
 // handleUpload handles PUT /obs/<set>/data. It requires a newline-delimited
 // JSON stream (of content-type application/vnd.mami.ndjson) in observation set
 // file format. Set IDs in the input are ignored. It writes a response
@@ -477,38 +841,27 @@ func (oa *ObsAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// fail if observations exist
-	if set.CountObservations(oa.db) != 0 {
-		http.Error(w, fmt.Sprintf("Observation set %s already uploaded", vars["set"]), http.StatusBadRequest)
-		return
-	}
-
-	// create a temporary file to hold observations
-	tf, err := ioutil.TempFile("", "pto3_obs")
-	if err != nil {
-		pto3.HandleErrorHTTP(w, "creating temporary observation file", err)
+	// fail if retracted
+	if set.Retracted != nil {
+		http.Error(w, fmt.Sprintf("Observation set %s is retracted", vars["set"]), http.StatusConflict)
 		return
 	}
-	defer tf.Close()
-	defer os.Remove(tf.Name())
 
-	// copy observation data to the tempfile
-	if _, err := io.Copy(tf, r.Body); err != nil {
-		pto3.HandleErrorHTTP(w, "uploading to temporary observation file", err)
+	// fail if observations exist
+	if set.CountObservations(oa.db) != 0 {
+		http.Error(w, fmt.Sprintf("Observation set %s already uploaded; POST to append", vars["set"]), http.StatusBadRequest)
 		return
 	}
-	tf.Sync()
 
-	// create condition and path caches
+	// create condition cache
 	cidCache, err := pto3.LoadConditionCache(oa.db)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "loading condition cache", err)
 		return
 	}
-	pidCache := make(pto3.PathCache)
 
-	// now insert the tempfile into the database
-	if err := pto3.CopyDataFromObsFile(tf.Name(), oa.db, &set, cidCache, pidCache); err != nil {
+	// now stream the upload into the database, sharing the server's path cache
+	if err := pto3.CopyDataFromObsStream(r.Body, oa.db, &set, cidCache, oa.pidCache); err != nil {
 		pto3.HandleErrorHTTP(w, "inserting observations", err)
 		return
 	}
@@ -520,32 +873,589 @@ func (oa *ObsAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
 	oa.writeMetadataResponse(w, &set, http.StatusCreated)
 }
 
-func (oa *ObsAPI) CreateTables() error {
-	return pto3.CreateTables(oa.db)
-}
-
-func (oa *ObsAPI) DropTables() error {
-	return pto3.DropTables(oa.db)
-}
+// handleAppend handles POST /obs/<set>/data. It appends the uploaded
+// observations to the set as a new chunk, and writes a JSON object describing
+// the chunk, along with a link to the set and its updated statistics. If the
+// key query parameter names a chunk already appended to the set, the upload is
+// ignored and the existing chunk described instead.
+func (oa *ObsAPI) handleAppend(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
 
-func (oa *ObsAPI) EnableQueryLogging() {
-	pto3.EnableQueryLogging(oa.db)
-}
+	vars := mux.Vars(r)
 
-func (oa *ObsAPI) addRoutes(r *mux.Router, l *log.Logger) {
-	r.HandleFunc("/obs", LogAccess(l, oa.handleListSets)).Methods("GET")
-	r.HandleFunc("/obs/by_metadata", LogAccess(l, oa.handleMetadataQuery)).Methods("GET", "POST")
-	r.HandleFunc("/obs/conditions", LogAccess(l, oa.handleConditionQuery)).Methods("GET")
-	r.HandleFunc("/obs/create", LogAccess(l, oa.handleCreateSet)).Methods("POST")
-	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handleGetMetadata)).Methods("GET")
-	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handlePutMetadata)).Methods("PUT")
-	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleDownload)).Methods("GET")
-	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleUpload)).Methods("PUT")
-}
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
 
-func NewObsAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) *ObsAPI {
-	if config.ObsDatabase.Database == "" {
-		return nil
+	// retrieve set metadata
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err := set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set metadata", err)
+		}
+		return
+	}
+
+	// fail if retracted
+	if set.Retracted != nil {
+		http.Error(w, fmt.Sprintf("Observation set %s is retracted", vars["set"]), http.StatusConflict)
+		return
+	}
+
+	// create condition cache
+	cidCache, err := pto3.LoadConditionCache(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "loading condition cache", err)
+		return
+	}
+
+	// now stream the upload onto the set, sharing the server's path cache
+	chunk, appended, err := pto3.AppendDataFromObsStream(r.Body, oa.db, &set,
+		r.URL.Query().Get("key"), cidCache, oa.pidCache)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "appending observations", err)
+		return
+	}
+
+	// reload statistics if the chunk was appended earlier
+	if !appended {
+		if err := set.SelectByID(oa.db); err != nil {
+			pto3.HandleErrorHTTP(w, "retrieving set metadata", err)
+			return
+		}
+	}
+
+	out := struct {
+		*pto3.ObservationSetChunk
+		Set   string                    `json:"__set"`
+		Stats *pto3.ObservationSetStats `json:"__stats,omitempty"`
+	}{chunk, pto3.LinkForSetID(oa.config, set.ID), set.Stats}
+
+	b, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling chunk", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if appended {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(b)
+}
+
+// handleChunks handles GET /obs/<set>/chunks. It writes a JSON object with the
+// chunks appended to the set, oldest first, in the chunks key.
+func (oa *ObsAPI) handleChunks(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// make sure the set exists
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err := set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set metadata", err)
+		}
+		return
+	}
+
+	chunks, err := pto3.ObservationSetChunks(oa.db, set.ID)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving set chunks", err)
+		return
+	}
+
+	out := struct {
+		Chunks []pto3.ObservationSetChunk `json:"chunks"`
+	}{chunks}
+
+	b, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling chunk list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleVersions handles GET /obs/<set>/versions. It writes a JSON object
+// with links to all observation sets in the same version chain as the set,
+// oldest first, in the versions key, and links to those sets not superseded
+// by any other in the current key.
+func (oa *ObsAPI) handleVersions(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	versionIds, currentIds, err := pto3.ObservationSetVersions(oa.db, int(setid))
+	if err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set versions", err)
+		}
+		return
+	}
+
+	out := struct {
+		Versions []string `json:"versions"`
+		Current  []string `json:"current"`
+	}{make([]string, len(versionIds)), make([]string, len(currentIds))}
+
+	for i, id := range versionIds {
+		out.Versions[i] = pto3.LinkForSetID(oa.config, id)
+	}
+	for i, id := range currentIds {
+		out.Current[i] = pto3.LinkForSetID(oa.config, id)
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling version list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleProvenance handles GET /obs/<set>/provenance. It writes a JSON object
+// listing everything the set was derived from, recursively: links to upstream
+// observation sets in the sets key, links to raw data files in the raw key,
+// and any other source URLs in the other key.
+func (oa *ObsAPI) handleProvenance(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// make sure the set exists
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	prov, err := pto3.ProvenanceOfSets(oa.db, []int{set.ID})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving set provenance", err)
+		return
+	}
+
+	outb, err := json.Marshal(prov.Links(oa.config))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling provenance", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleDerived handles GET /raw/<campaign>/<file>/derived. It writes a JSON
+// object with links to all observation sets derived from the raw data file,
+// directly or indirectly, in the sets key. This lives in the observation API,
+// as it is answered from the observation database.
+func (oa *ObsAPI) handleDerived(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	setIds, err := pto3.ObservationSetIDsDerivedFromRaw(oa.db, vars["campaign"], vars["file"])
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving derived sets", err)
+		return
+	}
+
+	out := struct {
+		Sets []string `json:"sets"`
+	}{make([]string, len(setIds))}
+
+	for i, id := range setIds {
+		out.Sets[i] = pto3.LinkForSetID(oa.config, id)
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling derived set list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleRetract handles POST /obs/<set>/retract. It requires a 'reason'
+// URL/form parameter, which is stored in the set's metadata. Retracted sets
+// are hidden from queries, but their metadata and data remain available. It
+// writes a response containing the set's metadata.
+func (oa *ObsAPI) handleRetract(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	reason := r.Form.Get("reason")
+	if reason == "" {
+		http.Error(w, "retraction requires a reason", http.StatusBadRequest)
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		return set.Retract(t, reason)
+	})
+	if err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retracting set", err)
+		}
+		return
+	}
+
+	oa.writeMetadataResponse(w, &set, http.StatusOK)
+}
+
+// handleDelete handles DELETE /obs/<set>. It permanently removes the set's
+// metadata and observations from the database in a single transaction, and
+// requires the admin_obs permission.
+func (oa *ObsAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "admin_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		return set.Delete(t)
+	})
+	if err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "deleting set", err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeAnalyzerResponse writes an analyzer metadata document, with registry
+// information, to the response.
+func (oa *ObsAPI) writeAnalyzerResponse(w http.ResponseWriter, a *pto3.Analyzer, status int) {
+	a.LinkVia(oa.config)
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling analyzer metadata", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// handleListAnalyzers handles GET /analyzer. It writes a JSON object with
+// links to the latest version of every registered analyzer in the analyzers
+// key.
+func (oa *ObsAPI) handleListAnalyzers(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	names, err := pto3.AnalyzerNames(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "listing analyzers", err)
+		return
+	}
+
+	out := struct {
+		Analyzers []string `json:"analyzers"`
+	}{make([]string, len(names))}
+
+	for i, name := range names {
+		out.Analyzers[i] = pto3.LinkForAnalyzer(oa.config, name, 0)
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling analyzer list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleGetAnalyzer handles GET /analyzer/<name> and
+// GET /analyzer/<name>/<version>. It writes the analyzer metadata document
+// for the given version of the analyzer, or its latest version if none is
+// given, with registry information in __ keys.
+func (oa *ObsAPI) handleGetAnalyzer(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	version := 0
+	if vars["version"] != "" {
+		var err error
+		version, err = strconv.Atoi(vars["version"])
+		if err != nil || version < 1 {
+			http.Error(w, fmt.Sprintf("bad analyzer version %s", vars["version"]), http.StatusBadRequest)
+			return
+		}
+	}
+
+	a, err := pto3.LookupAnalyzer(oa.db, vars["name"], version)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Analyzer %s not found", vars["name"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving analyzer", err)
+		}
+		return
+	}
+
+	oa.writeAnalyzerResponse(w, a, http.StatusOK)
+}
+
+// handleRegisterAnalyzer handles POST /analyzer/<name>. It requires a JSON
+// object with analyzer metadata in the request, and takes an optional 'url'
+// URL/form parameter giving the external analyzer metadata URL to register
+// it under. It registers the metadata as a new version of the analyzer, and
+// writes it to the response.
+func (oa *ObsAPI) handleRegisterAnalyzer(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, fmt.Sprintf("Content-type for analyzer metadata must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a, err := pto3.RegisterAnalyzer(oa.db, vars["name"], r.URL.Query().Get("url"), b)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "registering analyzer", err)
+		return
+	}
+
+	oa.writeAnalyzerResponse(w, a, http.StatusCreated)
+}
+
+// handleAnalyzerVersions handles GET /analyzer/<name>/versions. It writes a
+// JSON object with links to every version of the analyzer, oldest first, in
+// the versions key.
+func (oa *ObsAPI) handleAnalyzerVersions(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	versions, err := pto3.AnalyzerVersions(oa.db, vars["name"])
+	if err != nil {
+		if err == pg.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Analyzer %s not found", vars["name"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving analyzer versions", err)
+		}
+		return
+	}
+
+	out := struct {
+		Versions []string `json:"versions"`
+	}{make([]string, len(versions))}
+
+	for i := range versions {
+		out.Versions[i] = pto3.LinkForAnalyzer(oa.config, versions[i].Name, versions[i].Version)
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling analyzer version list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+func (oa *ObsAPI) CreateTables() error {
+	return pto3.CreateTables(oa.db)
+}
+
+// CheckSchemaVersion returns an error if the schema of the observation
+// database is newer than this server, and logs a warning if it is older, or
+// the database is not initialized.
+func (oa *ObsAPI) CheckSchemaVersion() error {
+	pending, err := pto3.MigrateTables(oa.db, true)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		log.Printf("observation database schema is not at version %d; run ptomigrate or ptosrv -initdb", pto3.LatestSchemaVersion())
+	}
+
+	return nil
+}
+
+func (oa *ObsAPI) DropTables() error {
+	return pto3.DropTables(oa.db)
+}
+
+// MaintainPartitions creates observation partitions for the coming months,
+// now and then periodically in the background, logging any failure.
+func (oa *ObsAPI) MaintainPartitions(interval time.Duration) {
+	monthsAhead := oa.config.PartitionMonthsAhead
+	if monthsAhead == 0 {
+		monthsAhead = pto3.DefaultPartitionMonthsAhead
+	}
+
+	go func() {
+		for {
+			if err := pto3.CreateObservationPartitions(oa.db, monthsAhead); err != nil {
+				log.Printf("error creating observation partitions: %s", err.Error())
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (oa *ObsAPI) EnableQueryLogging() {
+	pto3.EnableQueryLogging(oa.db)
+}
+
+func (oa *ObsAPI) addRoutes(r *mux.Router, l *log.Logger) {
+	r.HandleFunc("/obs", LogAccess(l, oa.handleListSets)).Methods("GET")
+	r.HandleFunc("/obs/by_metadata", LogAccess(l, oa.handleMetadataQuery)).Methods("GET", "POST")
+	r.HandleFunc("/obs/conditions", LogAccess(l, oa.handleConditionQuery)).Methods("GET")
+	r.HandleFunc("/obs/conditions/{name}", LogAccess(l, oa.handleGetCondition)).Methods("GET")
+	r.HandleFunc("/obs/conditions/{name}", LogAccess(l, oa.handlePutCondition)).Methods("PUT")
+	r.HandleFunc("/obs/create", LogAccess(l, oa.handleCreateSet)).Methods("POST")
+	r.HandleFunc("/obs/upload", LogAccess(l, oa.handleUploadSets)).Methods("POST")
+	r.HandleFunc("/obs/validate", LogAccess(l, oa.handleValidate)).Methods("POST")
+	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handleGetMetadata)).Methods("GET")
+	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handlePutMetadata)).Methods("PUT")
+	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handleDelete)).Methods("DELETE")
+	r.HandleFunc("/obs/{set}/retract", LogAccess(l, oa.handleRetract)).Methods("POST")
+	r.HandleFunc("/obs/{set}/versions", LogAccess(l, oa.handleVersions)).Methods("GET")
+	r.HandleFunc("/obs/{set}/provenance", LogAccess(l, oa.handleProvenance)).Methods("GET")
+	r.HandleFunc("/raw/{campaign}/{file}/derived", LogAccess(l, oa.handleDerived)).Methods("GET")
+	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleDownload)).Methods("GET")
+	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleUpload)).Methods("PUT")
+	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleAppend)).Methods("POST")
+	r.HandleFunc("/obs/{set}/chunks", LogAccess(l, oa.handleChunks)).Methods("GET")
+	r.HandleFunc("/obs/{set}/archive", LogAccess(l, oa.handleArchive)).Methods("GET")
+	r.HandleFunc("/analyzer", LogAccess(l, oa.handleListAnalyzers)).Methods("GET")
+	r.HandleFunc("/analyzer/{name}", LogAccess(l, oa.handleGetAnalyzer)).Methods("GET")
+	r.HandleFunc("/analyzer/{name}", LogAccess(l, oa.handleRegisterAnalyzer)).Methods("POST")
+	r.HandleFunc("/analyzer/{name}/versions", LogAccess(l, oa.handleAnalyzerVersions)).Methods("GET")
+	r.HandleFunc("/analyzer/{name}/{version}", LogAccess(l, oa.handleGetAnalyzer)).Methods("GET")
+}
+
+func NewObsAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) *ObsAPI {
+	if config.ObsDatabase.Database == "" {
+		return nil
 	}
 
 	oa := new(ObsAPI)
@@ -553,6 +1463,12 @@ func NewObsAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) *Ob
 	oa.azr = azr
 	oa.db = pg.Connect(&config.ObsDatabase)
 
+	// warm the path cache shared by all uploads; the tables may not exist yet
+	oa.pidCache = pto3.NewPathCache(config.PathCacheSize)
+	if err := oa.pidCache.Warm(oa.db); err != nil {
+		log.Printf("not warming path cache: %s", err.Error())
+	}
+
 	oa.addRoutes(r, config.AccessLogger())
 
 	return oa
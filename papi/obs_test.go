@@ -21,6 +21,14 @@ type ClientObservationSet struct {
 	Link        string   `json:"__link"`
 	Datalink    string   `json:"__data"`
 	Count       int      `json:"__obs_count"`
+	Retracted   string   `json:"__retracted,omitempty"`
+	Reason      string   `json:"_retraction_reason,omitempty"`
+	Supersedes  []string `json:"_supersedes,omitempty"`
+}
+
+type ClientVersionList struct {
+	Versions []string `json:"versions"`
+	Current  []string `json:"current"`
 }
 
 type ClientSetList struct {
@@ -29,6 +37,20 @@ type ClientSetList struct {
 	Next string   `json:"next"`
 }
 
+type ClientChunk struct {
+	Chunk        int    `json:"chunk"`
+	Key          string `json:"key"`
+	Observations int    `json:"observations"`
+	Set          string `json:"__set"`
+	Stats        struct {
+		Observations int `json:"observations"`
+	} `json:"__stats"`
+}
+
+type ClientChunkList struct {
+	Chunks []ClientChunk `json:"chunks"`
+}
+
 type ClientConditionList struct {
 	Conditions []string `json:"conditions"`
 }
@@ -209,8 +231,8 @@ func TestObsRoundtrip(t *testing.T) {
 	observations_up_bytes := []byte(`["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
 	["e1337", "2017-10-01T10:06:01Z", "2017-10-01T10:06:02Z", "10.0.0.1 AS1 * AS2 10.0.0.2", "pto.test.schroedinger"]
 	["e1337", "2017-10-01T10:06:03Z", "2017-10-01T10:06:05Z", "* AS2 10.0.0.0/24", "pto.test.failed"]
-	["e1337", "2017-10-01T10:06:07Z", "2017-10-01T10:06:11Z", "[2001:db8::33:a4] * [2001:db8:3]/64", "pto.test.succeeded"]
-	["e1337", "2017-10-01T10:06:09Z", "2017-10-01T10:06:14Z", "[2001:db8::33:a4] * [2001:db8:3]/64", "pto.test.succeeded"]`)
+	["e1337", "2017-10-01T10:06:07Z", "2017-10-01T10:06:11Z", "[2001:db8::33:a4] * [2001:db8:3::]/64", "pto.test.succeeded"]
+	["e1337", "2017-10-01T10:06:09Z", "2017-10-01T10:06:14Z", "[2001:db8::33:a4] * [2001:db8:3::]/64", "pto.test.succeeded"]`)
 
 	observations_up, err := ReadObservations(bytes.NewBuffer(observations_up_bytes))
 	if err != nil {
@@ -247,6 +269,385 @@ func TestObsRoundtrip(t *testing.T) {
 	}
 }
 
+func TestObsRetractDelete(t *testing.T) {
+	// create a new observation set with some data
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/test001.json"},
+		Conditions:  []string{"pto.test.failed"},
+		Description: "An observation set to exercise retraction and deletion",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	setlink := setDown.Link
+
+	observations_up_bytes := []byte(`["e1337", "2017-10-02T10:06:00Z", "2017-10-02T10:06:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.failed"]`)
+
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBuffer(observations_up_bytes),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	// retraction requires a reason
+	executeRequest(TestRouter, t, "POST", setlink+"/retract", nil, "", GoodAPIKey, http.StatusBadRequest)
+
+	// retract the set and check the reason is recorded
+	res = executeRequest(TestRouter, t, "POST", setlink+"/retract?reason=bad+analyzer+build", nil, "", GoodAPIKey, http.StatusOK)
+
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	if setDown.Retracted == "" || setDown.Reason != "bad analyzer build" {
+		t.Fatalf("bad retraction metadata: __retracted %s, _retraction_reason %s", setDown.Retracted, setDown.Reason)
+	}
+
+	// retracted sets stay readable, but are frozen
+	executeRequest(TestRouter, t, "GET", setlink, nil, "", GoodAPIKey, http.StatusOK)
+	executeWithJSON(TestRouter, t, "PUT", setlink, setDown, GoodAPIKey, http.StatusConflict)
+
+	// even if the update would otherwise be rejected as invalid
+	setBad := setDown
+	setBad.Analyzer = ""
+	setBad.Conditions = []string{"pto.test.undeclared"}
+	executeWithJSON(TestRouter, t, "PUT", setlink, setBad, GoodAPIKey, http.StatusConflict)
+
+	// hard deletion requires admin permission
+	executeRequest(TestRouter, t, "DELETE", setlink, nil, "", GoodAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "DELETE", setlink, nil, "", AdminAPIKey, http.StatusNoContent)
+
+	// and the set is gone
+	executeRequest(TestRouter, t, "GET", setlink, nil, "", GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "DELETE", setlink, nil, "", AdminAPIKey, http.StatusNotFound)
+}
+
+func TestObsAppend(t *testing.T) {
+	// create a new observation set without data
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/test001.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "An observation set to exercise appending data in chunks",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	day1 := []byte(`["e1337", "2017-10-03T10:06:00Z", "2017-10-03T10:06:00Z", "10.0.0.1 * 10.0.0.4", "pto.test.succeeded"]
+	["e1337", "2017-10-03T10:07:00Z", "2017-10-03T10:07:00Z", "10.0.0.1 * 10.0.0.5", "pto.test.failed"]`)
+	day2 := []byte(`["e1337", "2017-10-04T10:06:00Z", "2017-10-04T10:06:00Z", "10.0.0.1 * 10.0.0.4", "pto.test.failed"]`)
+
+	// append two chunks
+	res = executeRequest(TestRouter, t, "POST", setDown.Datalink+"?key=2017-10-03", bytes.NewBuffer(day1),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	chunk1 := ClientChunk{}
+	if err := json.Unmarshal(res.Body.Bytes(), &chunk1); err != nil {
+		t.Fatal(err)
+	}
+	if chunk1.Key != "2017-10-03" || chunk1.Observations != 2 || chunk1.Stats.Observations != 2 || chunk1.Set != setDown.Link {
+		t.Fatalf("bad first chunk %v", chunk1)
+	}
+
+	res = executeRequest(TestRouter, t, "POST", setDown.Datalink+"?key=2017-10-04", bytes.NewBuffer(day2),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	chunk2 := ClientChunk{}
+	if err := json.Unmarshal(res.Body.Bytes(), &chunk2); err != nil {
+		t.Fatal(err)
+	}
+	if chunk2.Chunk == chunk1.Chunk || chunk2.Observations != 1 || chunk2.Stats.Observations != 3 {
+		t.Fatalf("bad second chunk %v", chunk2)
+	}
+
+	// retrying the first chunk does nothing
+	res = executeRequest(TestRouter, t, "POST", setDown.Datalink+"?key=2017-10-03", bytes.NewBuffer(day1),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusOK)
+
+	retry := ClientChunk{}
+	if err := json.Unmarshal(res.Body.Bytes(), &retry); err != nil {
+		t.Fatal(err)
+	}
+	if retry.Chunk != chunk1.Chunk || retry.Stats.Observations != 3 {
+		t.Fatalf("retried chunk %v appended again", retry)
+	}
+
+	// check the chunk list and the data
+	res = executeRequest(TestRouter, t, "GET", setDown.Link+"/chunks", nil, "", GoodAPIKey, http.StatusOK)
+
+	chunks := ClientChunkList{}
+	if err := json.Unmarshal(res.Body.Bytes(), &chunks); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks.Chunks) != 2 || chunks.Chunks[0].Chunk != chunk1.Chunk || chunks.Chunks[1].Chunk != chunk2.Chunk {
+		t.Fatalf("bad chunk list %v", chunks)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", setDown.Datalink, nil, "", GoodAPIKey, http.StatusOK)
+
+	observations, err := ReadObservations(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observations) != 3 {
+		t.Fatalf("expected 3 observations after appending, got %d", len(observations))
+	}
+
+	// whole-set upload is refused once data is present
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBuffer(day2),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	// the appended set can be archived
+	res = executeRequest(TestRouter, t, "GET", setDown.Link+"/archive", nil, "", GoodAPIKey, http.StatusOK)
+	if ct := res.Header().Get("Content-Type"); ct != pto3.ObsArchiveContentType {
+		t.Fatalf("archive has content type %s", ct)
+	}
+	if res.Body.Len() == 0 {
+		t.Fatal("empty archive")
+	}
+
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/ffffffff/archive", nil, "", GoodAPIKey, http.StatusNotFound)
+}
+
+func TestObsBulkUpload(t *testing.T) {
+	// two sets, as written by ptocat, with an observation of the first set
+	// after the second set's metadata
+	upload := []byte(`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"], "bulk_upload_test": "first"}
+["a1", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]
+{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.failed"], "bulk_upload_test": "second"}
+["a2", "2017-10-05T10:07:00Z", "2017-10-05T10:07:00Z", "10.0.0.1 * 10.0.0.7", "pto.test.failed"]
+["a1", "2017-10-05T10:08:00Z", "2017-10-05T10:08:00Z", "10.0.0.1 * 10.0.0.8", "pto.test.succeeded"]`)
+
+	res := executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/upload", bytes.NewBuffer(upload),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var setlist ClientSetList
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 2 {
+		t.Fatalf("expected 2 sets from bulk upload, got %v", setlist.Sets)
+	}
+
+	for i, count := range []int{2, 1} {
+		res = executeRequest(TestRouter, t, "GET", setlist.Sets[i], nil, "", GoodAPIKey, http.StatusOK)
+
+		setDown := ClientObservationSet{}
+		if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+			t.Fatal(err)
+		}
+		if setDown.Count != count {
+			t.Fatalf("expected %d observations in bulk uploaded set %d, got %d", count, i, setDown.Count)
+		}
+	}
+
+	// a bad set fails the whole upload
+	bad := []byte(`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"], "bulk_upload_test": "good"}
+["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]
+{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.failed"], "bulk_upload_test": "bad"}
+["", "2017-10-05T10:07:00Z", "2017-10-05T10:07:00Z", "10.0.0.1 * 10.0.0.7", "pto.test.succeeded"]`)
+
+	executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/upload", bytes.NewBuffer(bad),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=bulk_upload_test&v=good", nil, "", GoodAPIKey, http.StatusOK)
+
+	setlist = ClientSetList{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 0 {
+		t.Fatalf("set from failed bulk upload created: %v", setlist.Sets)
+	}
+}
+
+func TestObsValidate(t *testing.T) {
+	obs := []byte(`["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]
+["", "not a time", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]
+["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.undeclared"]
+{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"]}`)
+
+	res := executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/validate", bytes.NewBuffer(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusOK)
+
+	var report pto3.ObsValidationReport
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() || report.Observations != 3 || len(report.Errors) != 2 ||
+		report.Errors[0].Line != 2 || report.Errors[1].Line != 3 {
+		t.Fatalf("unexpected validation report %+v", report)
+	}
+
+	// the error cap is configurable
+	res = executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/validate?max_errors=1", bytes.NewBuffer(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusOK)
+
+	report = pto3.ObsValidationReport{}
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 2 || len(report.Errors) != 1 || !report.Truncated {
+		t.Fatalf("unexpected truncated validation report %+v", report)
+	}
+
+	executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/validate?max_errors=none", bytes.NewBuffer(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	// files for upload are checked set by set
+	sets := []byte(`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"]}
+["a", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]
+{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.failed"]}
+["b", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`)
+
+	res = executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/validate?upload=true", bytes.NewBuffer(sets),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusOK)
+
+	report = pto3.ObsValidationReport{}
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 1 || report.Errors[0].Line != 4 {
+		t.Fatalf("unexpected validation report for upload %+v", report)
+	}
+
+	executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/validate?upload=maybe", bytes.NewBuffer(sets),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsVersions(t *testing.T) {
+	// create an original set
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/test001.json"},
+		Conditions:  []string{"pto.test.failed"},
+		Description: "An observation set to be superseded",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	original := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &original); err != nil {
+		t.Fatal(err)
+	}
+
+	// supersede it with a fixed set
+	setUp.Description = "An observation set superseding another"
+	setUp.Supersedes = []string{original.Link}
+
+	res = executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	fixed := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &fixed); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fixed.Supersedes) != 1 || fixed.Supersedes[0] != original.Link {
+		t.Fatalf("bad _supersedes in superseding set: %v", fixed.Supersedes)
+	}
+
+	// the version chain should be the same from either end
+	for _, link := range []string{original.Link, fixed.Link} {
+		res = executeRequest(TestRouter, t, "GET", link+"/versions", nil, "", GoodAPIKey, http.StatusOK)
+
+		var versions ClientVersionList
+		if err := json.Unmarshal(res.Body.Bytes(), &versions); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(versions.Versions) != 2 || versions.Versions[0] != original.Link || versions.Versions[1] != fixed.Link {
+			t.Fatalf("bad version chain for %s: %v", link, versions.Versions)
+		}
+
+		if len(versions.Current) != 1 || versions.Current[0] != fixed.Link {
+			t.Fatalf("bad current versions for %s: %v", link, versions.Current)
+		}
+	}
+
+	// supersession cycles are refused
+	original.Supersedes = []string{fixed.Link}
+	executeWithJSON(TestRouter, t, "PUT", original.Link, original, GoodAPIKey, http.StatusBadRequest)
+}
+
+type ClientProvenance struct {
+	Sets  []string `json:"sets"`
+	Raw   []string `json:"raw"`
+	Other []string `json:"other"`
+}
+
+func TestObsProvenance(t *testing.T) {
+	rawlink := "https://ptotest.mami-project.eu/raw/provtest/provtest-0.ndjson"
+
+	// create a set derived from a raw file
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{rawlink},
+		Conditions:  []string{"pto.test.failed"},
+		Description: "An observation set derived from raw data",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	first := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &first); err != nil {
+		t.Fatal(err)
+	}
+
+	// and a set derived from that set
+	setUp.Sources = []string{first.Link}
+	setUp.Description = "An observation set derived from an observation set"
+
+	res = executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	second := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &second); err != nil {
+		t.Fatal(err)
+	}
+
+	// walk upstream from the second set
+	res = executeRequest(TestRouter, t, "GET", second.Link+"/provenance", nil, "", GoodAPIKey, http.StatusOK)
+
+	var prov ClientProvenance
+	if err := json.Unmarshal(res.Body.Bytes(), &prov); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prov.Sets) != 1 || prov.Sets[0] != first.Link {
+		t.Fatalf("bad upstream sets for %s: %v", second.Link, prov.Sets)
+	}
+
+	if len(prov.Raw) != 1 || prov.Raw[0] != rawlink {
+		t.Fatalf("bad upstream raw files for %s: %v", second.Link, prov.Raw)
+	}
+
+	// and downstream from the raw file
+	res = executeRequest(TestRouter, t, "GET", rawlink+"/derived", nil, "", GoodAPIKey, http.StatusOK)
+
+	var setlist ClientSetList
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(setlist.Sets) != 2 || setlist.Sets[0] != first.Link || setlist.Sets[1] != second.Link {
+		t.Fatalf("bad derived sets for %s: %v", rawlink, setlist.Sets)
+	}
+}
+
 func TestObsQuery(t *testing.T) {
 
 	res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=this_is_the_query_test_obset", nil, "", GoodAPIKey, http.StatusOK)
@@ -280,6 +681,44 @@ func TestObsQuery(t *testing.T) {
 		t.Fatalf("unexpected result for analyzer query: %v", setlist.Sets)
 	}
 
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=this_is_the_query_test_obset&time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A30%3A00Z&created_after=2017-01-01", nil, "", GoodAPIKey, http.StatusOK)
+
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf("https://ptotest.mami-project.eu/obs/%x", TestQueryCacheSetID) {
+		t.Fatalf("unexpected result for overlapping time range query: %v", setlist.Sets)
+	}
+
+	for _, nomatch := range []string{"time_start=2018-04-01&time_end=2018-06-30", "modified_after=2100-01-01"} {
+		res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=this_is_the_query_test_obset&"+nomatch, nil, "", GoodAPIKey, http.StatusOK)
+
+		setlist = ClientSetList{}
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(setlist.Sets) != 0 {
+			t.Fatalf("unexpected result for ?%s: %v", nomatch, setlist.Sets)
+		}
+	}
+
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?time_start=last+tuesday", nil, "", GoodAPIKey, http.StatusBadRequest)
+
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=test_obset_type&op=prefix&v=qu&k=no_such_key&op=absent&v=", nil, "", GoodAPIKey, http.StatusOK)
+
+	setlist = ClientSetList{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf("https://ptotest.mami-project.eu/obs/%x", TestQueryCacheSetID) {
+		t.Fatalf("unexpected result for multiple key query: %v", setlist.Sets)
+	}
+
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=test_obset_type&k=this_is_the_query_test_obset&op=eq", nil, "", GoodAPIKey, http.StatusBadRequest)
+
 	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/conditions", nil, "", GoodAPIKey, http.StatusOK)
 
 	var condlist ClientConditionList
@@ -309,3 +748,187 @@ func TestObsQuery(t *testing.T) {
 	}
 
 }
+
+type ClientAnalyzer struct {
+	Owner   string `json:"_owner"`
+	Name    string `json:"__name"`
+	Version int    `json:"__version"`
+	Link    string `json:"__link"`
+	URL     string `json:"__url"`
+}
+
+type ClientAnalyzerList struct {
+	Analyzers []string `json:"analyzers"`
+	Versions  []string `json:"versions"`
+}
+
+func TestAnalyzerAPI(t *testing.T) {
+	const analyzerURL = "https://ptotest.mami-project.eu/analysis/registered"
+
+	analyzerDoc := []byte(`{
+		"_owner": "ptotest@example.com",
+		"_conditions": ["pto.test.registered.*"],
+		"_metadata_schema": {"type": "object", "required": ["description"]}
+	}`)
+
+	// registration requires write permission and a well-formed document
+	executeRequest(TestRouter, t, "POST", TestBaseURL+"/analyzer/papi_registered",
+		bytes.NewBuffer(analyzerDoc), "application/json", "", http.StatusForbidden)
+	executeRequest(TestRouter, t, "POST", TestBaseURL+"/analyzer/papi_registered",
+		bytes.NewBufferString(`{"description": "no owner"}`), "application/json", GoodAPIKey, http.StatusBadRequest)
+
+	for i := 1; i <= 2; i++ {
+		res := executeRequest(TestRouter, t, "POST", TestBaseURL+"/analyzer/papi_registered?url="+analyzerURL,
+			bytes.NewBuffer(analyzerDoc), "application/json", GoodAPIKey, http.StatusCreated)
+
+		var a ClientAnalyzer
+		if err := json.Unmarshal(res.Body.Bytes(), &a); err != nil {
+			t.Fatal(err)
+		}
+		if a.Version != i || a.URL != analyzerURL || a.Link != fmt.Sprintf("%s/analyzer/papi_registered/%d", TestBaseURL, i) {
+			t.Fatalf("unexpected registration response %v", a)
+		}
+	}
+
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/analyzer", nil, "", GoodAPIKey, http.StatusOK)
+	var analyzers ClientAnalyzerList
+	if err := json.Unmarshal(res.Body.Bytes(), &analyzers); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, link := range analyzers.Analyzers {
+		if link == TestBaseURL+"/analyzer/papi_registered" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("registered analyzer missing from list %v", analyzers.Analyzers)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/analyzer/papi_registered/versions", nil, "", GoodAPIKey, http.StatusOK)
+	var versions ClientAnalyzerList
+	if err := json.Unmarshal(res.Body.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions.Versions) != 2 {
+		t.Fatalf("expected two analyzer versions, got %v", versions.Versions)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", versions.Versions[0], nil, "", GoodAPIKey, http.StatusOK)
+	var a ClientAnalyzer
+	if err := json.Unmarshal(res.Body.Bytes(), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Version != 1 || a.URL != "" || a.Owner != "ptotest@example.com" {
+		t.Fatalf("unexpected first analyzer version %v", a)
+	}
+
+	executeRequest(TestRouter, t, "GET", TestBaseURL+"/analyzer/papi_unregistered", nil, "", GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "GET", TestBaseURL+"/analyzer/papi_registered/3", nil, "", GoodAPIKey, http.StatusNotFound)
+
+	// sets must conform to the registered analyzer
+	setUp := ClientObservationSet{
+		Analyzer:    analyzerURL,
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/test001.json"},
+		Conditions:  []string{"pto.test.registered.works"},
+		Description: "An observation set to exercise the analyzer registry",
+	}
+	executeWithJSON(TestRouter, t, "POST", TestBaseURL+"/obs/create", setUp, GoodAPIKey, http.StatusCreated)
+
+	setUp.Conditions = []string{"pto.test.unregistered"}
+	executeWithJSON(TestRouter, t, "POST", TestBaseURL+"/obs/create", setUp, GoodAPIKey, http.StatusBadRequest)
+
+	setUp.Conditions = []string{"pto.test.registered.works"}
+	setUp.Description = ""
+	executeWithJSON(TestRouter, t, "POST", TestBaseURL+"/obs/create", setUp, GoodAPIKey, http.StatusBadRequest)
+
+	// and sets with unknown analyzers are rejected if so configured
+	setUp.Analyzer = "https://ptotest.mami-project.eu/analysis/unregistered"
+	setUp.Description = "An observation set with an unregistered analyzer"
+	TestConfig.RequireRegisteredAnalyzer = true
+	defer func() { TestConfig.RequireRegisteredAnalyzer = false }()
+	executeWithJSON(TestRouter, t, "POST", TestBaseURL+"/obs/create", setUp, GoodAPIKey, http.StatusBadRequest)
+
+	setUp.Analyzer = TestBaseURL + "/analyzer/papi_registered/2"
+	setUp.Description = "An observation set with a registered analyzer link"
+	executeWithJSON(TestRouter, t, "POST", TestBaseURL+"/obs/create", setUp, GoodAPIKey, http.StatusCreated)
+
+	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/obs/by_metadata?analyzer_name=papi_registered",
+		nil, "", GoodAPIKey, http.StatusOK)
+	var sets ClientSetList
+	if err := json.Unmarshal(res.Body.Bytes(), &sets); err != nil {
+		t.Fatal(err)
+	}
+	if len(sets.Sets) != 2 {
+		t.Fatalf("expected two sets with registered analyzer, got %v", sets.Sets)
+	}
+}
+
+type ClientCondition struct {
+	Name        string   `json:"name"`
+	Feature     string   `json:"feature"`
+	Aspect      string   `json:"aspect"`
+	Description string   `json:"description"`
+	ValueType   string   `json:"value_type"`
+	Unit        string   `json:"unit"`
+	Deprecated  bool     `json:"deprecated"`
+	Conditions  []string `json:"conditions"`
+}
+
+func TestConditionRegistryAPI(t *testing.T) {
+	entry := ClientCondition{
+		Description: "round trip time to target",
+		ValueType:   "number",
+		Unit:        "ms",
+	}
+
+	// registration requires admin permission
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/obs/conditions/pto.test.timing.rtt", entry, GoodAPIKey, http.StatusForbidden)
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/obs/conditions/pto.test.timing.rtt", entry, AdminAPIKey, http.StatusCreated)
+
+	entry.ValueType = "duration"
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/obs/conditions/pto.test.timing.jitter", entry, AdminAPIKey, http.StatusBadRequest)
+
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/obs/conditions/pto.test.timing.rtt", nil, "", GoodAPIKey, http.StatusOK)
+	var c ClientCondition
+	if err := json.Unmarshal(res.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "pto.test.timing.rtt" || c.Feature != "pto" || c.Aspect != "pto.test.timing" ||
+		c.ValueType != "number" || c.Unit != "ms" || c.Deprecated {
+		t.Fatalf("unexpected condition registry entry %+v", c)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/obs/conditions/pto.test.timing", nil, "", GoodAPIKey, http.StatusOK)
+	c = ClientCondition{}
+	if err := json.Unmarshal(res.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Conditions) != 1 || c.Conditions[0] != "pto.test.timing.rtt" {
+		t.Fatalf("unexpected conditions under pto.test.timing: %v", c.Conditions)
+	}
+
+	executeRequest(TestRouter, t, "GET", TestBaseURL+"/obs/conditions/pto.test.nonexistent", nil, "", GoodAPIKey, http.StatusNotFound)
+
+	// observation values must match the registered value type
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/timing",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/test001.json"},
+		Conditions:  []string{"pto.test.timing.rtt"},
+		Description: "An observation set to exercise condition value types",
+	}
+
+	res = executeWithJSON(TestRouter, t, "POST", TestBaseURL+"/obs/create", setUp, GoodAPIKey, http.StatusCreated)
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink,
+		bytes.NewBufferString(`["e1337", "2017-10-02T10:06:00Z", "2017-10-02T10:06:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.timing.rtt", "slow"]`),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink,
+		bytes.NewBufferString(`["e1337", "2017-10-02T10:06:00Z", "2017-10-02T10:06:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.timing.rtt", "12.5"]`),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+}
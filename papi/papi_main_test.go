@@ -127,6 +127,7 @@ func teardownQuery(config *pto3.PTOConfiguration) {
 }
 
 const GoodAPIKey = "07e57ab18e70"
+const AdminAPIKey = "ad3170c0ffee"
 
 func setupAZR() papi.Authorizer {
 	return &papi.APIKeyAuthorizer{
@@ -143,6 +144,11 @@ func setupAZR() papi.Authorizer {
 				"read_query":     true,
 				"update_query":   true,
 			},
+			AdminAPIKey: map[string]bool{
+				"read_obs":  true,
+				"write_obs": true,
+				"admin_obs": true,
+			},
 		},
 	}
 }
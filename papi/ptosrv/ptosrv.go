@@ -6,6 +6,7 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	pto3 "github.com/mami-project/pto3-go"
@@ -60,6 +61,10 @@ func main() {
 			}
 			log.Printf("...initialized observation database")
 		}
+		if err := obsapi.CheckSchemaVersion(); err != nil {
+			log.Fatal(err)
+		}
+		obsapi.MaintainPartitions(24 * time.Hour)
 	}
 
 	qapi, err := papi.NewQueryAPI(config, azr, r)
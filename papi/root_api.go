@@ -25,6 +25,7 @@ func (ra *RootAPI) handleRoot(w http.ResponseWriter, r *http.Request) {
 
 	if ra.config.ObsDatabase.Database != "" {
 		links["obs"], _ = ra.config.LinkTo("obs")
+		links["analyzer"], _ = ra.config.LinkTo("analyzer")
 	}
 
 	if ra.config.QueryCacheRoot != "" {
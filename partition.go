@@ -0,0 +1,172 @@
+package pto3
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Time partitioning of observations for PTO3 obs.
+// Observations are stored in a table partitioned by start time, with one
+// partition per calendar month (in UTC), so that queries bounded in time only
+// scan the partitions for the months they cover. Partitions for the coming
+// months are created ahead of time by CreateObservationPartitions, which
+// ptosrv runs periodically; loading observations starting in a month without
+// a partition (e.g. from an old campaign) creates the partition as well.
+
+// DefaultPartitionMonthsAhead is the default number of months after the
+// current one for which to create observation partitions ahead of time.
+const DefaultPartitionMonthsAhead = 3
+
+// createObservationsTable creates the partitioned observations table. The
+// partition key must be part of the primary key, and is never NULL.
+const createObservationsTable = `CREATE TABLE IF NOT EXISTS observations (
+	id bigserial,
+	set_id bigint NOT NULL REFERENCES observation_sets (id),
+	time_start timestamptz NOT NULL,
+	time_end timestamptz,
+	path_id bigint REFERENCES paths (id),
+	condition_id bigint REFERENCES conditions (id),
+	value text,
+	PRIMARY KEY (id, time_start)
+) PARTITION BY RANGE (time_start)`
+
+// createObservationSetIndex allows observations to be selected by set ID.
+const createObservationSetIndex = "CREATE INDEX IF NOT EXISTS observations_set_id_idx ON observations (set_id)"
+
+// createObservationSetPathIndex allows the paths of a set to be looked up, to
+// count distinct paths as chunks are appended.
+const createObservationSetPathIndex = "CREATE INDEX IF NOT EXISTS observations_set_path_idx ON observations (set_id, path_id)"
+
+// observationPartitionLock is the advisory lock key serializing creation of
+// observation partitions.
+const observationPartitionLock = 0x70746f33
+
+// observationMonth returns the start of the month in which a time falls.
+func observationMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// observationPartitionName returns the name of the partition holding
+// observations starting in a given month.
+func observationPartitionName(month time.Time) string {
+	return fmt.Sprintf("observations_%04d%02d", month.Year(), int(month.Month()))
+}
+
+// observationsPartitioned returns true if the observations table is
+// partitioned. Databases created before partitioning have a single
+// observations table, which is used as is.
+func observationsPartitioned(db orm.DB) (bool, error) {
+	var n int
+	if _, err := db.QueryOne(pg.Scan(&n),
+		"SELECT count(*) FROM pg_partitioned_table WHERE partrelid = to_regclass('observations')"); err != nil {
+		return false, PTOWrapError(err)
+	}
+	return n > 0, nil
+}
+
+// ensureObservationPartition creates the partition for observations starting
+// in a given month, if it does not exist. Creation is serialized by an
+// advisory lock held until the end of the transaction in which it runs.
+func ensureObservationPartition(t *pg.Tx, month time.Time) error {
+	name := observationPartitionName(month)
+
+	// check first, to avoid taking locks on the common path
+	var n int
+	if _, err := t.QueryOne(pg.Scan(&n), "SELECT count(*) FROM pg_class WHERE relname = ?", name); err != nil {
+		return PTOWrapError(err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	if _, err := t.Exec("SELECT pg_advisory_xact_lock(?)", observationPartitionLock); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := t.Exec(
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF observations FOR VALUES FROM (?) TO (?)", name),
+		month, month.AddDate(0, 1, 0)); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// CreateObservationPartitions creates partitions for observations starting
+// in the current month and in the given number of months after it, if they do
+// not already exist. It does nothing if the observations table is not
+// partitioned.
+func CreateObservationPartitions(db *pg.DB, monthsAhead int) error {
+	month := observationMonth(time.Now())
+
+	return db.RunInTransaction(func(t *pg.Tx) error {
+		partitioned, err := observationsPartitioned(t)
+		if err != nil || !partitioned {
+			return err
+		}
+
+		for i := 0; i <= monthsAhead; i++ {
+			if err := ensureObservationPartition(t, month.AddDate(0, i, 0)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// partitionObservations converts the observations table of a database
+// created before observations were partitioned into a partitioned table,
+// creating partitions for every month in which observations start.
+func partitionObservations(t *pg.Tx) error {
+	partitioned, err := observationsPartitioned(t)
+	if err != nil || partitioned {
+		return err
+	}
+
+	var unstarted int
+	if _, err := t.QueryOne(pg.Scan(&unstarted), "SELECT count(*) FROM observations WHERE time_start IS NULL"); err != nil {
+		return PTOWrapError(err)
+	}
+	if unstarted > 0 {
+		return PTOErrorf("%d observations have no start time, and cannot be partitioned", unstarted)
+	}
+
+	// move the old table aside, freeing the names of its primary key and
+	// index, and create the partitioned table in its place
+	if err := execAll(t,
+		"ALTER TABLE observations RENAME TO observations_unpartitioned",
+		"ALTER TABLE observations_unpartitioned DROP CONSTRAINT IF EXISTS observations_pkey",
+		"DROP INDEX IF EXISTS observations_set_id_idx",
+		createObservationsTable,
+		createObservationSetIndex); err != nil {
+		return err
+	}
+
+	var months []struct {
+		Month time.Time
+	}
+	if _, err := t.Query(&months, `
+		SELECT DISTINCT date_trunc('month', time_start AT TIME ZONE 'UTC') AS month
+		FROM observations_unpartitioned`); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, m := range months {
+		if err := ensureObservationPartition(t, observationMonth(m.Month)); err != nil {
+			return err
+		}
+	}
+
+	// copy observations, keeping their IDs, and continue IDs after them
+	return execAll(t,
+		`INSERT INTO observations (id, set_id, time_start, time_end, path_id, condition_id, value)
+			SELECT id, set_id, time_start, time_end, path_id, condition_id, value
+			FROM observations_unpartitioned`,
+		"SELECT setval(pg_get_serial_sequence('observations', 'id'), coalesce(max(id), 0) + 1, false) FROM observations",
+		"DROP TABLE observations_unpartitioned")
+}
@@ -0,0 +1,65 @@
+package pto3_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func partitionExists(t *testing.T, name string) bool {
+	var n int
+	if _, err := TestDB.QueryOne(pg.Scan(&n), "SELECT count(*) FROM pg_inherits WHERE inhparent = 'observations'::regclass AND inhrelid = to_regclass(?)", name); err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestObservationPartitions(t *testing.T) {
+	// partitions are created ahead of time
+	if err := pto3.CreateObservationPartitions(TestDB, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	month := time.Now().UTC()
+	month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 2; i++ {
+		m := month.AddDate(0, i, 0)
+		name := fmt.Sprintf("observations_%04d%02d", m.Year(), int(m.Month()))
+		if !partitionExists(t, name) {
+			t.Fatalf("partition %s not created ahead of time", name)
+		}
+	}
+
+	// and as needed when loading older observations
+	obs := `{"_analyzer": "https://localhost:8383/partition_test_analyzer.json", "_sources": ["https://localhost:8383/raw/partition/partition-0.ndjson"], "_conditions": ["pto.test.partition.old"]}
+["", "2001-02-03T04:05:06Z", "2001-02-03T04:05:07Z", "10.0.0.1 * 10.0.0.2", "pto.test.partition.old"]
+["", "2001-03-31T23:59:59Z", "2001-04-01T00:00:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.partition.old"]`
+
+	if partitionExists(t, "observations_200102") {
+		t.Fatal("partition observations_200102 exists before loading")
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := pto3.CopySetFromObsStream(strings.NewReader(obs), TestDB, TestConfig, cidCache, pto3.NewPathCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"observations_200102", "observations_200103"} {
+		if !partitionExists(t, name) {
+			t.Fatalf("partition %s not created on load", name)
+		}
+	}
+
+	if set.CountObservations(TestDB) != 2 {
+		t.Fatalf("expected 2 observations in partitioned set, got %d", set.CountObservations(TestDB))
+	}
+}
@@ -1,117 +1,483 @@
 package pto3
 
 import (
-	"encoding/csv"
+	"container/list"
 	"fmt"
-	"os"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
 )
 
-// Path represents a PTO path: a sequence of path elements. Paths are
-// currently stored as white-space separated element lists in strings.
+// Path represents a PTO path: a sequence of path elements. Paths are stored
+// as white-space separated element lists in strings, along with the parsed
+// elements, normalized, and the type of each element, for querying.
 type Path struct {
-	ID     int
-	String string
-	Source string
-	Target string
+	ID           int
+	String       string
+	Source       string
+	Target       string
+	Elements     []string `pg:",array"`
+	ElementTypes []string `pg:",array"`
 }
 
-func extractSource(pathstring string) string {
-	elements := strings.Split(pathstring, " ")
-	if len(elements) > 0 && elements[0] != "*" {
-		return elements[0]
-	} else {
-		return ""
+// Path element types.
+const (
+	// Zero or more unknown hops
+	PathElementWildcard = "wildcard"
+	// IPv4 address
+	PathElementIPv4 = "ipv4"
+	// IPv6 address, with or without brackets
+	PathElementIPv6 = "ipv6"
+	// IPv4 or IPv6 prefix in CIDR notation
+	PathElementPrefix = "prefix"
+	// BGP autonomous system number, e.g. AS65000
+	PathElementAS = "as"
+	// DNS hostname
+	PathElementHostname = "hostname"
+	// Pseudonym of a given type, e.g. host|XXXXX
+	PathElementPseudonym = "pseudonym"
+)
+
+var asElementRegexp = regexp.MustCompile(`^[Aa][Ss]([0-9]+)$`)
+
+var hostnameLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+var numericLabelRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+// ParsePathElement determines the type of a path element, and returns it
+// along with the element in normalized form: addresses in their canonical
+// text form without brackets, AS numbers with an upper-case AS prefix, and
+// hostnames in lower case without a trailing dot.
+func ParsePathElement(element string) (string, string, error) {
+	if element == "*" {
+		return element, PathElementWildcard, nil
+	}
+
+	if bar := strings.Index(element, "|"); bar >= 0 {
+		if bar == 0 || bar == len(element)-1 {
+			return "", "", PTOErrorf("bad path element %s: pseudonym requires type and value", element).StatusIs(http.StatusBadRequest)
+		}
+		return element, PathElementPseudonym, nil
+	}
+
+	if m := asElementRegexp.FindStringSubmatch(element); m != nil {
+		asn, err := strconv.ParseUint(m[1], 10, 32)
+		if err != nil {
+			return "", "", PTOErrorf("bad path element %s: AS number out of range", element).StatusIs(http.StatusBadRequest)
+		}
+		return fmt.Sprintf("AS%d", asn), PathElementAS, nil
+	}
+
+	if slash := strings.Index(element, "/"); slash >= 0 {
+		addr, addrType, err := ParsePathElement(element[:slash])
+		if err != nil || (addrType != PathElementIPv4 && addrType != PathElementIPv6) {
+			return "", "", PTOErrorf("bad path element %s: prefix requires an address", element).StatusIs(http.StatusBadRequest)
+		}
+		maxlen := 32
+		if addrType == PathElementIPv6 {
+			maxlen = 128
+		}
+		masklen, err := strconv.Atoi(element[slash+1:])
+		if err != nil || masklen < 0 || masklen > maxlen {
+			return "", "", PTOErrorf("bad path element %s: bad prefix length", element).StatusIs(http.StatusBadRequest)
+		}
+		return fmt.Sprintf("%s/%d", addr, masklen), PathElementPrefix, nil
+	}
+
+	if strings.HasPrefix(element, "[") && strings.HasSuffix(element, "]") {
+		ip := net.ParseIP(element[1 : len(element)-1])
+		if ip == nil || !strings.Contains(element, ":") {
+			return "", "", PTOErrorf("bad path element %s: bad IPv6 address", element).StatusIs(http.StatusBadRequest)
+		}
+		return ip.String(), PathElementIPv6, nil
+	}
+
+	if ip := net.ParseIP(element); ip != nil {
+		if strings.Contains(element, ":") {
+			return ip.String(), PathElementIPv6, nil
+		}
+		return ip.String(), PathElementIPv4, nil
 	}
+
+	// anything else must be a hostname, whose last label is not numeric
+	hostname := strings.TrimSuffix(element, ".")
+	labels := strings.Split(hostname, ".")
+	if len(hostname) == 0 || len(hostname) > 253 || numericLabelRegexp.MatchString(labels[len(labels)-1]) {
+		return "", "", PTOErrorf("bad path element %s", element).StatusIs(http.StatusBadRequest)
+	}
+	for _, label := range labels {
+		if len(label) > 63 || !hostnameLabelRegexp.MatchString(label) {
+			return "", "", PTOErrorf("bad path element %s", element).StatusIs(http.StatusBadRequest)
+		}
+	}
+	return strings.ToLower(hostname), PathElementHostname, nil
 }
 
-func extractTarget(pathstring string) string {
-	elements := strings.Split(pathstring, " ")
-	if len(elements) > 0 && elements[len(elements)-1] != "*" {
-		return elements[len(elements)-1]
-	} else {
-		return ""
+// PathCache maps path strings to path IDs. It is safe for concurrent use, and
+// holds at most a fixed number of paths, evicting the least recently used
+// when full, so a single cache can be shared by every upload a server handles.
+type PathCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type pathCacheEntry struct {
+	pathstring string
+	id         int
+}
+
+// DefaultPathCacheSize is the number of paths a path cache holds if no size
+// is configured.
+const DefaultPathCacheSize = 1000000
+
+// pathUpsertBatchSize is the number of paths inserted or looked up in the
+// database in a single statement.
+const pathUpsertBatchSize = 10000
+
+// NewPathCache creates a new, empty path cache holding up to size paths. A
+// size of zero selects DefaultPathCacheSize.
+func NewPathCache(size int) *PathCache {
+	if size <= 0 {
+		size = DefaultPathCacheSize
+	}
+
+	return &PathCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
 	}
 }
 
-// PathCache maps a path string to a path ID
-type PathCache map[string]int
+// Get returns the ID of a path string, and whether it was in the cache.
+func (cache *PathCache) Get(pathstring string) (int, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if e, ok := cache.entries[pathstring]; ok {
+		cache.lru.MoveToFront(e)
+		return e.Value.(*pathCacheEntry).id, true
+	}
+	return 0, false
+}
+
+// Len returns the number of paths in the cache.
+func (cache *PathCache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.lru.Len()
+}
+
+// put adds a path string and ID to the cache, evicting the least recently
+// used paths if the cache is full. The caller must hold the lock.
+func (cache *PathCache) put(pathstring string, id int) {
+	if e, ok := cache.entries[pathstring]; ok {
+		e.Value.(*pathCacheEntry).id = id
+		cache.lru.MoveToFront(e)
+		return
+	}
+
+	cache.entries[pathstring] = cache.lru.PushFront(&pathCacheEntry{pathstring, id})
+
+	for cache.lru.Len() > cache.size {
+		e := cache.lru.Back()
+		delete(cache.entries, e.Value.(*pathCacheEntry).pathstring)
+		cache.lru.Remove(e)
+	}
+}
+
+// Warm fills the cache with the most recently inserted paths in the database.
+func (cache *PathCache) Warm(db orm.DB) error {
+	var paths []Path
+	if err := db.Model(&paths).Column("id", "string").Order("id DESC").Limit(cache.size).Select(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	// insert oldest first, so the newest paths are the most recently used
+	for i := len(paths) - 1; i >= 0; i-- {
+		cache.put(paths[i].String, paths[i].ID)
+	}
+
+	return nil
+}
+
+// PathIDs returns a map from each path string in a set to its ID in the
+// database, inserting paths which are not yet in the database. Paths not
+// found in the cache are inserted or looked up in bulk. Only paths which
+// already existed in the database are added to the cache: paths inserted here
+// are not, since the transaction inserting them may yet be rolled back. They
+// will be cached the next time they are looked up.
+func (cache *PathCache) PathIDs(db orm.DB, pathSet map[string]struct{}) (map[string]int, error) {
+	out := make(map[string]int, len(pathSet))
 
-// CacheNewPaths takes a set of path names, and adds those not already
-// appearing to the cache and the underlying database. It modifies the pathSet
-// to contain only those paths added. Note that duplicate paths may be added
-// to the database using this function: it only checks the cache, not the
-// database, before adding, for performance reasons.
-func (cache PathCache) CacheNewPaths(db orm.DB, pathSet map[string]struct{}) error {
 	// first, reduce to paths not already in the cache
+	missing := make([]string, 0)
 	for ps := range pathSet {
-		if cache[ps] > 0 {
-			delete(pathSet, ps)
+		if id, ok := cache.Get(ps); ok {
+			out[ps] = id
+		} else {
+			missing = append(missing, ps)
 		}
 	}
 
-	// allocate a range of IDs in the database
-	var nv struct {
-		Nextval int
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > pathUpsertBatchSize {
+			batch = batch[:pathUpsertBatchSize]
+		}
+		missing = missing[len(batch):]
+
+		if err := cache.upsertPaths(db, batch, out); err != nil {
+			return nil, err
+		}
 	}
 
-	if _, err := db.QueryOne(&nv, "SELECT nextval('paths_id_seq')"); err != nil {
-		return PTOWrapError(err)
+	return out, nil
+}
+
+// upsertPaths inserts a batch of path strings into the database if not
+// already present, and adds the IDs of all of them to the given map.
+func (cache *PathCache) upsertPaths(db orm.DB, pathstrings []string, out map[string]int) error {
+	// elements and their types are passed space-separated, since arrays of
+	// arrays cannot be unnested row by row
+	sources := make([]string, len(pathstrings))
+	targets := make([]string, len(pathstrings))
+	elements := make([]string, len(pathstrings))
+	elementTypes := make([]string, len(pathstrings))
+	for i, ps := range pathstrings {
+		p := Path{String: ps}
+		if err := p.Parse(); err != nil {
+			return PTOErrorf("bad path %s: %s", ps, err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		sources[i] = p.Source
+		targets[i] = p.Target
+		elements[i] = strings.Join(p.Elements, " ")
+		elementTypes[i] = strings.Join(p.ElementTypes, " ")
 	}
-	pidseq := nv.Nextval
 
-	if _, err := db.Exec("SELECT setval('paths_id_seq', ?)", pidseq+len(pathSet)); err != nil {
-		return PTOWrapError(err)
+	var found []struct {
+		ID       int
+		String   string
+		Inserted bool
 	}
 
-	// now add entries to the path cache while streaming into the database
-	streamerr := make(chan error, 1)
-	dbpipe, pathpipe, err := os.Pipe()
+	_, err := db.Query(&found, `
+		WITH input AS (
+			SELECT * FROM unnest(?::text[], ?::text[], ?::text[], ?::text[], ?::text[])
+				AS input(string, source, target, elements, element_types)
+		), inserted AS (
+			INSERT INTO paths (string, source, target, elements, element_types)
+			SELECT string, nullif(source, ''), nullif(target, ''),
+				string_to_array(elements, ' '), string_to_array(element_types, ' ') FROM input
+			ON CONFLICT (string) DO NOTHING
+			RETURNING id, string
+		) SELECT id, string, true AS inserted FROM inserted
+		UNION ALL
+		SELECT paths.id, paths.string, false AS inserted FROM paths JOIN input ON paths.string = input.string`,
+		pg.Array(pathstrings), pg.Array(sources), pg.Array(targets), pg.Array(elements), pg.Array(elementTypes))
 	if err != nil {
 		return PTOWrapError(err)
 	}
-	defer dbpipe.Close()
 
-	go func() {
-		out := csv.NewWriter(pathpipe)
-		defer pathpipe.Close()
+	cache.lock.Lock()
+	for _, f := range found {
+		out[f.String] = f.ID
+		if !f.Inserted {
+			cache.put(f.String, f.ID)
+		}
+	}
+	cache.lock.Unlock()
 
-		for pathstring := range pathSet {
-			p := []string{fmt.Sprintf("%d", pidseq), pathstring, extractSource(pathstring), extractTarget(pathstring)}
-			cache[pathstring] = pidseq
+	// a path inserted by a concurrent transaction after this statement's
+	// snapshot was taken is neither inserted nor visible above; look again.
+	stragglers := make([]string, 0)
+	for _, ps := range pathstrings {
+		if _, ok := out[ps]; !ok {
+			stragglers = append(stragglers, ps)
+		}
+	}
 
-			if err := out.Write(p); err != nil {
-				streamerr <- PTOWrapError(err)
+	if len(stragglers) > 0 {
+		var paths []Path
+		if err := db.Model(&paths).Column("id", "string").Where("string IN (?)", pg.In(stragglers)).Select(); err != nil {
+			return PTOWrapError(err)
+		}
+		for _, p := range paths {
+			out[p.String] = p.ID
+		}
+		for _, ps := range stragglers {
+			if _, ok := out[ps]; !ok {
+				return PTOErrorf("could not insert path %s", ps)
 			}
-
-			pidseq++
 		}
+	}
 
-		out.Flush()
-		streamerr <- nil
-	}()
+	return nil
+}
 
-	// copy from the goroutine to the database
-	if _, err = db.CopyFrom(dbpipe, "COPY paths (id, string, source, target) FROM STDIN WITH CSV"); err != nil {
-		return PTOWrapError(err)
+// DeduplicatePaths merges paths with identical strings in the database,
+// repointing observations to the path with the lowest ID, then adds the
+// unique constraint on path strings that prevents further duplicates. It
+// returns the number of duplicate paths removed. This is only necessary for
+// databases created before the constraint existed.
+func DeduplicatePaths(db *pg.DB) (int, error) {
+	var removed int
+
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		var err error
+		removed, err = deduplicatePaths(tx)
+		return err
+	})
+
+	return removed, err
+}
+
+// deduplicatePaths merges duplicate paths and adds the unique constraint on
+// path strings within a transaction, as DeduplicatePaths.
+func deduplicatePaths(tx *pg.Tx) (int, error) {
+	if _, err := tx.Exec(`
+		CREATE TEMPORARY TABLE path_duplicates ON COMMIT DROP AS
+		SELECT id, min(id) OVER (PARTITION BY string) AS canonical_id FROM paths`); err != nil {
+		return 0, PTOWrapError(err)
 	}
 
-	// wait for goroutine to complete and return its error
-	return <-streamerr
+	if _, err := tx.Exec("DELETE FROM path_duplicates WHERE id = canonical_id"); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE observations SET path_id = d.canonical_id
+		FROM path_duplicates AS d WHERE observations.path_id = d.id`); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	res, err := tx.Exec("DELETE FROM paths USING path_duplicates AS d WHERE paths.id = d.id")
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	if _, err := tx.Exec(createPathStringIndex); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	return res.RowsAffected(), nil
 }
 
-func (p *Path) Parse() {
-	p.Source = extractSource(p.String)
-	p.Target = extractTarget(p.String)
+// fillPathElements fills in the elements and element types of paths stored
+// before they were, in batches, and replaces their sources and targets with
+// the canonical forms of their first and last elements. As when paths are
+// inserted, elements of unknown type are stored with an empty type.
+func fillPathElements(tx *pg.Tx) error {
+	lastID := 0
+	for {
+		var paths []Path
+		if err := tx.Model(&paths).Column("id", "string").
+			Where("elements IS NULL").Where("id > ?", lastID).
+			Order("id").Limit(pathUpsertBatchSize).Select(); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if len(paths) == 0 {
+			return nil
+		}
+
+		// elements and their types are passed space-separated, as in upsertPaths
+		ids := make([]int, len(paths))
+		sources := make([]string, len(paths))
+		targets := make([]string, len(paths))
+		elements := make([]string, len(paths))
+		elementTypes := make([]string, len(paths))
+		for i := range paths {
+			paths[i].Parse()
+			ids[i] = paths[i].ID
+			sources[i] = paths[i].Source
+			targets[i] = paths[i].Target
+			elements[i] = strings.Join(paths[i].Elements, " ")
+			elementTypes[i] = strings.Join(paths[i].ElementTypes, " ")
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE paths SET
+				source = nullif(input.source, ''),
+				target = nullif(input.target, ''),
+				elements = string_to_array(input.elements, ' '),
+				element_types = string_to_array(input.element_types, ' ')
+			FROM unnest(?::bigint[], ?::text[], ?::text[], ?::text[], ?::text[])
+				AS input(id, source, target, elements, element_types)
+			WHERE paths.id = input.id`,
+			pg.Array(ids), pg.Array(sources), pg.Array(targets), pg.Array(elements), pg.Array(elementTypes)); err != nil {
+			return PTOWrapError(err)
+		}
+
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// createPathStringIndex ensures path strings are unique.
+const createPathStringIndex = "CREATE UNIQUE INDEX IF NOT EXISTS paths_string_idx ON paths (string)"
+
+// createPathElementsIndex allows paths to be selected by the elements on them.
+const createPathElementsIndex = "CREATE INDEX IF NOT EXISTS paths_elements_idx ON paths USING GIN (elements)"
+
+// Parse fills in the source, target, and elements of a path from its string.
+// It returns an error if any element is not of a known type; such elements
+// are kept as they are, with an empty type.
+func (p *Path) Parse() error {
+	p.Source = ""
+	p.Target = ""
+
+	fields := strings.Fields(p.String)
+	if len(fields) == 0 {
+		p.Elements = nil
+		p.ElementTypes = nil
+		return PTOErrorf("empty path").StatusIs(http.StatusBadRequest)
+	}
+
+	var firstErr error
+	p.Elements = make([]string, len(fields))
+	p.ElementTypes = make([]string, len(fields))
+	for i, field := range fields {
+		element, elementType, err := ParsePathElement(field)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			element = field
+		}
+		p.Elements[i] = element
+		p.ElementTypes[i] = elementType
+	}
+
+	// source and target are the canonical first and last elements, so that
+	// every spelling of an endpoint selects and groups alike
+	if p.ElementTypes[0] != PathElementWildcard {
+		p.Source = p.Elements[0]
+	}
+	if last := len(fields) - 1; p.ElementTypes[last] != PathElementWildcard {
+		p.Target = p.Elements[last]
+	}
+
+	return firstErr
 }
 
 // InsertOnce retrieves a path's ID if it has already been inserted into the
 // database, inserting it into the database if it's not already there.
 func (p *Path) InsertOnce(db orm.DB) error {
-	// force source and target before insertion
-	p.Parse()
+	// force source, target, and elements before insertion
+	if err := p.Parse(); err != nil {
+		return err
+	}
 
 	if p.ID == 0 {
 		_, err := db.Model(p).
@@ -126,6 +492,8 @@ func (p *Path) InsertOnce(db orm.DB) error {
 	return nil
 }
 
+// NewPath creates a path from a path string. Elements of unknown type are
+// kept as they are; use Parse to check for them.
 func NewPath(pathstring string) *Path {
 	p := new(Path)
 	p.String = pathstring
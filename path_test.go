@@ -0,0 +1,207 @@
+package pto3_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/mami-project/pto3-go"
+)
+
+func TestPathCache(t *testing.T) {
+	pathSet := map[string]struct{}{
+		"10.99.0.1 * 10.99.0.2": {},
+		"10.99.0.1 * 10.99.0.3": {},
+		"* 10.99.0.4":           {},
+	}
+
+	// paths inserted by a lookup are not cached until seen in the database
+	cache := pto3.NewPathCache(2)
+	first, err := cache.PathIDs(TestDB, pathSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != len(pathSet) {
+		t.Fatalf("expected %d path IDs, got %v", len(pathSet), first)
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("newly inserted paths cached")
+	}
+
+	// a second lookup, through another cache, finds the same paths
+	second, err := pto3.NewPathCache(0).PathIDs(TestDB, pathSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ps, id := range first {
+		if second[ps] != id {
+			t.Fatalf("path %s inserted twice: IDs %d and %d", ps, id, second[ps])
+		}
+	}
+
+	// and fills the cache, up to its size
+	if _, err := cache.PathIDs(TestDB, pathSet); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("expected cache of size 2 to hold 2 paths, holds %d", cache.Len())
+	}
+
+	for ps, id := range first {
+		if cached, ok := cache.Get(ps); ok && cached != id {
+			t.Fatalf("path %s cached with ID %d, expected %d", ps, cached, id)
+		}
+	}
+
+	// there are no duplicates left to remove
+	removed, err := pto3.DeduplicatePaths(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Fatalf("removed %d duplicate paths from a database with a unique constraint", removed)
+	}
+}
+
+func TestDeduplicatePaths(t *testing.T) {
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obs := `{"_analyzer": "https://localhost:8383/dedupe_test_analyzer.json", "_sources": ["https://localhost:8383/raw/dedupe/dedupe-0.ndjson"], "_conditions": ["pto.test.dedupe"]}
+["", "2017-12-10T04:05:06Z", "2017-12-10T04:05:07Z", "10.97.0.1 * 10.97.0.2", "pto.test.dedupe"]
+["", "2017-12-10T04:05:08Z", "2017-12-10T04:05:09Z", "10.97.0.1 * 10.97.0.3", "pto.test.dedupe"]`
+
+	set, err := pto3.CopySetFromObsStream(strings.NewReader(obs), TestDB, TestConfig, cidCache, pto3.NewPathCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var canonicalID int
+	if _, err := TestDB.QueryOne(pg.Scan(&canonicalID), "SELECT id FROM paths WHERE string = ?", "10.97.0.1 * 10.97.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a database from before the unique constraint, with a
+	// duplicate path which observations also refer to
+	if _, err := TestDB.Exec("DROP INDEX paths_string_idx"); err != nil {
+		t.Fatal(err)
+	}
+	defer TestDB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS paths_string_idx ON paths (string)")
+
+	var duplicateID int
+	if _, err := TestDB.QueryOne(pg.Scan(&duplicateID),
+		"INSERT INTO paths (string) VALUES (?) RETURNING id", "10.97.0.1 * 10.97.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TestDB.Exec(`
+		INSERT INTO observations (set_id, time_start, time_end, path_id, condition_id, value)
+		SELECT set_id, time_start + interval '1 minute', time_end + interval '1 minute', ?, condition_id, value
+		FROM observations WHERE set_id = ? AND path_id = ?`, duplicateID, set.ID, canonicalID); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := pto3.DeduplicatePaths(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed %d duplicate paths, expected 1", removed)
+	}
+
+	// observations on the duplicate now refer to the surviving path...
+	var n int
+	if _, err := TestDB.QueryOne(pg.Scan(&n),
+		"SELECT count(*) FROM observations WHERE set_id = ? AND path_id = ?", set.ID, canonicalID); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 observations on path %d after deduplication, got %d", canonicalID, n)
+	}
+
+	if _, err := TestDB.QueryOne(pg.Scan(&n), "SELECT count(*) FROM paths WHERE id = ?", duplicateID); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("duplicate path %d not removed", duplicateID)
+	}
+
+	// ...and the unique constraint is back
+	if _, err := TestDB.QueryOne(pg.Scan(&n), "SELECT count(*) FROM pg_indexes WHERE indexname = 'paths_string_idx'"); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatal("path string index not recreated")
+	}
+
+	if _, err := TestDB.Exec("INSERT INTO paths (string) VALUES (?)", "10.97.0.1 * 10.97.0.2"); err == nil {
+		t.Fatal("duplicate path inserted after deduplication")
+	}
+}
+
+func TestParsePathElement(t *testing.T) {
+	goodElements := []struct {
+		element     string
+		normalized  string
+		elementType string
+	}{
+		{"*", "*", pto3.PathElementWildcard},
+		{"192.0.2.1", "192.0.2.1", pto3.PathElementIPv4},
+		{"2001:DB8::0:1", "2001:db8::1", pto3.PathElementIPv6},
+		{"[2001:db8::1]", "2001:db8::1", pto3.PathElementIPv6},
+		{"192.0.2.0/24", "192.0.2.0/24", pto3.PathElementPrefix},
+		{"[2001:db8::]/32", "2001:db8::/32", pto3.PathElementPrefix},
+		{"as65000", "AS65000", pto3.PathElementAS},
+		{"Example.COM.", "example.com", pto3.PathElementHostname},
+		{"host|a8f3e2", "host|a8f3e2", pto3.PathElementPseudonym},
+	}
+
+	for _, ge := range goodElements {
+		normalized, elementType, err := pto3.ParsePathElement(ge.element)
+		if err != nil {
+			t.Fatalf("path element %s failed to parse: %s", ge.element, err.Error())
+		}
+		if normalized != ge.normalized || elementType != ge.elementType {
+			t.Fatalf("path element %s parsed as %s %s, expected %s %s",
+				ge.element, elementType, normalized, ge.elementType, ge.normalized)
+		}
+	}
+
+	badElements := []string{
+		"", "192.0.2", "192.0.2.256", "[192.0.2.1]", "192.0.2.0/33", "2001:db8::/129",
+		"AS4294967296", "AS1/8", "-example.com", "exa_mple.com", "|a8f3e2", "host|",
+	}
+
+	for _, be := range badElements {
+		if _, _, err := pto3.ParsePathElement(be); err == nil {
+			t.Fatalf("bad path element %s parsed without error", be)
+		}
+	}
+
+	// paths keep elements of unknown type, but fail to parse
+	p := pto3.Path{String: "10.99.0.1 * bad_element"}
+	if err := p.Parse(); err == nil {
+		t.Fatalf("path %s with bad element parsed without error", p.String)
+	}
+	if len(p.Elements) != 3 || p.Source != "10.99.0.1" || p.Target != "bad_element" {
+		t.Fatalf("path %s parsed incorrectly: %v", p.String, p)
+	}
+	// sources and targets are canonical, and wildcards are not endpoints
+	p = pto3.Path{String: "[2001:DB8::1] * 2001:db8:0::2"}
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Source != "2001:db8::1" || p.Target != "2001:db8::2" {
+		t.Fatalf("path %s has source %s and target %s", p.String, p.Source, p.Target)
+	}
+
+	p = pto3.Path{String: "* Example.COM."}
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Source != "" || p.Target != "example.com" {
+		t.Fatalf("path %s has source %s and target %s", p.String, p.Source, p.Target)
+	}
+}
@@ -0,0 +1,213 @@
+package pto3
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Provenance index for PTO3 obs.
+// Each entry in an observation set's _sources metadata is a URL referring to a
+// raw data file or another observation set. These are parsed on insertion and
+// update into the observation_set_sources table, indexed by raw campaign and
+// file and by source set ID, so the provenance graph can be traversed in
+// either direction without pattern-matching URLs.
+
+// ObservationSetSource is a single parsed entry in an observation set's
+// _sources array.
+type ObservationSetSource struct {
+	ObservationSetID int
+	// Source URL as given in the _sources array
+	Source string
+	// Campaign and filename, if the source is a raw data file
+	Campaign string
+	Filename string
+	// Set ID, if the source is an observation set
+	SourceSetID int
+}
+
+// createSourceIndexes index the provenance index by raw file and source set,
+// to traverse it in either direction, by observation set, and by source URL
+// prefix.
+var createSourceIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS observation_set_sources_raw_idx ON observation_set_sources (campaign, filename)",
+	"CREATE INDEX IF NOT EXISTS observation_set_sources_set_idx ON observation_set_sources (source_set_id)",
+	"CREATE INDEX IF NOT EXISTS observation_set_sources_obs_idx ON observation_set_sources (observation_set_id)",
+	"CREATE INDEX IF NOT EXISTS observation_set_sources_source_idx ON observation_set_sources (source text_pattern_ops)",
+}
+
+// parseSourceLink fills in the campaign and filename, or the set ID, of this
+// source from its URL. Sources which are neither raw data file nor
+// observation set URLs are left unparsed.
+func (src *ObservationSetSource) parseSourceLink() {
+	u, err := url.Parse(src.Source)
+	if err != nil {
+		return
+	}
+
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	if len(path) >= 3 && path[len(path)-3] == "raw" {
+		src.Campaign = path[len(path)-2]
+		src.Filename = path[len(path)-1]
+	} else if len(path) >= 2 && path[len(path)-2] == "obs" {
+		if setid, err := strconv.ParseUint(path[len(path)-1], 16, 32); err == nil {
+			src.SourceSetID = int(setid)
+		}
+	}
+}
+
+// storeSourceIndex replaces the provenance index entries for this
+// ObservationSet with entries parsed from its Sources.
+func (set *ObservationSet) storeSourceIndex(db orm.DB) error {
+	if _, err := db.Exec("DELETE FROM observation_set_sources WHERE observation_set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, source := range set.Sources {
+		src := ObservationSetSource{ObservationSetID: set.ID, Source: source}
+		src.parseSourceLink()
+		if err := db.Insert(&src); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// RebuildSourceIndex rebuilds the provenance index for all observation sets
+// in the database. This is only necessary for databases created before the
+// index existed.
+func RebuildSourceIndex(db orm.DB) error {
+	var sets []ObservationSet
+	if err := db.Model(&sets).Column("id", "sources").Select(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for i := range sets {
+		if err := sets[i].storeSourceIndex(db); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Provenance describes the upstream provenance of one or more observation
+// sets: all the observation sets and raw data files they were derived from,
+// directly or indirectly.
+type Provenance struct {
+	// IDs of upstream observation sets
+	SetIDs []int
+	// Upstream raw data files, as campaign/filename
+	RawFiles []string
+	// Upstream source URLs which refer to neither observation sets nor raw data
+	Other []string
+}
+
+// ProvenanceLinks is the JSON representation of a Provenance, with upstream
+// observation sets and raw data files given as links.
+type ProvenanceLinks struct {
+	Sets  []string `json:"sets"`
+	Raw   []string `json:"raw"`
+	Other []string `json:"other"`
+}
+
+// Links returns this Provenance with upstream observation sets and raw data
+// files as links via the given configuration.
+func (prov *Provenance) Links(config *PTOConfiguration) *ProvenanceLinks {
+	out := ProvenanceLinks{
+		Sets:  make([]string, len(prov.SetIDs)),
+		Raw:   make([]string, len(prov.RawFiles)),
+		Other: prov.Other,
+	}
+
+	for i, id := range prov.SetIDs {
+		out.Sets[i] = LinkForSetID(config, id)
+	}
+	for i, rawFile := range prov.RawFiles {
+		out.Raw[i], _ = config.LinkTo("raw/" + rawFile)
+	}
+
+	return &out
+}
+
+// ProvenanceOfSets traverses the provenance index upstream from the given
+// observation sets, returning everything they were derived from.
+func ProvenanceOfSets(db orm.DB, setIds []int) (*Provenance, error) {
+	var sources []ObservationSetSource
+
+	_, err := db.Query(&sources, `
+		WITH RECURSIVE upstream(id) AS (
+			SELECT unnest(?::int[])
+			UNION
+			SELECT s.source_set_id FROM observation_set_sources AS s
+			JOIN upstream ON s.observation_set_id = upstream.id
+			WHERE s.source_set_id IS NOT NULL
+		) SELECT DISTINCT s.source, s.campaign, s.filename, s.source_set_id
+		FROM observation_set_sources AS s JOIN upstream ON s.observation_set_id = upstream.id`,
+		pg.Array(setIds))
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	out := Provenance{SetIDs: make([]int, 0), RawFiles: make([]string, 0), Other: make([]string, 0)}
+	seenSets := make(map[int]struct{})
+	seenRaw := make(map[string]struct{})
+
+	for _, src := range sources {
+		if src.SourceSetID != 0 {
+			if _, ok := seenSets[src.SourceSetID]; !ok {
+				seenSets[src.SourceSetID] = struct{}{}
+				out.SetIDs = append(out.SetIDs, src.SourceSetID)
+			}
+		} else if src.Campaign != "" {
+			rawFile := src.Campaign + "/" + src.Filename
+			if _, ok := seenRaw[rawFile]; !ok {
+				seenRaw[rawFile] = struct{}{}
+				out.RawFiles = append(out.RawFiles, rawFile)
+			}
+		} else {
+			out.Other = append(out.Other, src.Source)
+		}
+	}
+
+	sort.Ints(out.SetIDs)
+	sort.Strings(out.RawFiles)
+	sort.Strings(out.Other)
+
+	return &out, nil
+}
+
+// ObservationSetIDsDerivedFromRaw traverses the provenance index downstream
+// from the given raw data file, returning the IDs of all observation sets
+// derived from it, directly or indirectly.
+func ObservationSetIDsDerivedFromRaw(db orm.DB, campaign string, filename string) ([]int, error) {
+	var derived []struct {
+		ID int
+	}
+
+	_, err := db.Query(&derived, `
+		WITH RECURSIVE downstream(id) AS (
+			SELECT observation_set_id FROM observation_set_sources
+			WHERE campaign = ? AND filename = ?
+			UNION
+			SELECT s.observation_set_id FROM observation_set_sources AS s
+			JOIN downstream ON s.source_set_id = downstream.id
+		) SELECT id FROM downstream ORDER BY id`,
+		campaign, filename)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	setIds := make([]int, len(derived))
+	for i := range derived {
+		setIds[i] = derived[i].ID
+	}
+
+	return setIds, nil
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -43,6 +44,10 @@ type QueryCache struct {
 
 	// Lock for submitted and cached maps
 	lock sync.RWMutex
+
+	// Locks serializing staleness checks and reruns, by query identifier;
+	// guarded by lock
+	staleLocks map[string]*sync.Mutex
 }
 
 // NewQueryCache creates a query cache given a configuration and an
@@ -56,6 +61,7 @@ func NewQueryCache(config *PTOConfiguration) (*QueryCache, error) {
 		path:       config.QueryCacheRoot,
 		query:      make(map[string]*Query),
 		exectokens: make(chan struct{}, config.ConcurrentQueries),
+		staleLocks: make(map[string]*sync.Mutex),
 	}
 
 	var err error
@@ -71,8 +77,8 @@ func NewQueryCache(config *PTOConfiguration) (*QueryCache, error) {
 // of the setup for testing the query cache, and should not be called in the
 // normal case.
 func (qc *QueryCache) LoadTestData(obsFilename string) (int, error) {
-	pidCache := make(PathCache)
-	set, err := CopySetFromObsFile(obsFilename, qc.db, qc.cidCache, pidCache)
+	pidCache := NewPathCache(0)
+	set, err := CopySetFromObsFile(obsFilename, qc.db, qc.config, qc.cidCache, pidCache)
 	if err != nil {
 		return 0, err
 	} else {
@@ -101,6 +107,11 @@ func (qc *QueryCache) fetchQuery(identifier string) (*Query, error) {
 	qc.lock.Lock()
 	defer qc.lock.Unlock()
 
+	// another caller may have fetched the query while we waited for the lock
+	if q := qc.query[identifier]; q != nil {
+		return q, nil
+	}
+
 	in, err := qc.readMetadataFile(identifier)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -117,7 +128,7 @@ func (qc *QueryCache) fetchQuery(identifier string) (*Query, error) {
 		return nil, PTOWrapError(err)
 	}
 
-	var q Query
+	q := Query{qc: qc}
 	if err := json.Unmarshal(b, &q); err != nil {
 		return nil, PTOWrapError(err)
 	}
@@ -150,12 +161,38 @@ func (qc *QueryCache) QueryByIdentifier(identifier string) (*Query, error) {
 
 	}()
 
-	if q != nil {
-		return q, nil
+	if q == nil {
+		// nope, check on disk
+		var err error
+		if q, err = qc.fetchQuery(identifier); err != nil || q == nil {
+			return q, err
+		}
 	}
 
-	// nope, check on disk
-	return qc.fetchQuery(identifier)
+	// make sure the results still reflect the sets they came from
+	staleLock := qc.staleLockFor(identifier)
+	staleLock.Lock()
+	defer staleLock.Unlock()
+
+	if err := q.checkStale(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// staleLockFor returns the lock serializing staleness checks and reruns of
+// the query with the given identifier.
+func (qc *QueryCache) staleLockFor(identifier string) *sync.Mutex {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+
+	l := qc.staleLocks[identifier]
+	if l == nil {
+		l = new(sync.Mutex)
+		qc.staleLocks[identifier] = l
+	}
+	return l
 }
 
 func (qc *QueryCache) CachedQueryLinks() ([]string, error) {
@@ -201,39 +238,253 @@ func (gs *SimpleGroupSpec) ColumnSpec() string {
 	return gs.Column
 }
 
-// DateTruncGroupSpec groups a pg-go query by applying PostgreSQL's date_trunc function to a column
+// Default IPv6 prefix length for prefix groups with only an IPv4 length given
+const defaultV6PrefixLength = 48
+
+// Patterns matching path elements which can be treated as addresses. These
+// are strict, as every value they match is cast to inet: values such as
+// abc:443, which may remain in paths stored before path elements were typed,
+// must not match.
+const (
+	ipv4Address = `((25[0-5]|2[0-4][0-9]|1?[0-9]?[0-9])\.){3}(25[0-5]|2[0-4][0-9]|1?[0-9]?[0-9])`
+	ipv6Group   = `[0-9A-Fa-f]{1,4}`
+
+	ipv4ElementPattern = `^` + ipv4Address + `$`
+	ipv6ElementPattern = `^(` +
+		`(` + ipv6Group + `:){7}` + ipv6Group + `|` +
+		`(` + ipv6Group + `:){1,7}:|` +
+		`(` + ipv6Group + `:){1,6}:` + ipv6Group + `|` +
+		`(` + ipv6Group + `:){1,5}(:` + ipv6Group + `){1,2}|` +
+		`(` + ipv6Group + `:){1,4}(:` + ipv6Group + `){1,3}|` +
+		`(` + ipv6Group + `:){1,3}(:` + ipv6Group + `){1,4}|` +
+		`(` + ipv6Group + `:){1,2}(:` + ipv6Group + `){1,5}|` +
+		ipv6Group + `:(:` + ipv6Group + `){1,6}|` +
+		`:((:` + ipv6Group + `){1,7}|:)|` +
+		`(` + ipv6Group + `:){6}` + ipv4Address + `|` +
+		`::([Ff]{4}(:0{1,4})?:)?` + ipv4Address + `|` +
+		`(` + ipv6Group + `:){1,4}:` + ipv4Address +
+		`)$`
+)
+
+// parsePrefixGroup parses a prefix group name of the form
+// source_prefix/<v4len>[/<v6len>] or target_prefix/<v4len>[/<v6len>] into
+// the path element it groups, and the IPv4 and IPv6 prefix lengths.
+func parsePrefixGroup(groupStr string) (string, int, int, error) {
+	parts := strings.Split(groupStr, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", 0, 0, PTOErrorf("bad prefix group %s", groupStr).StatusIs(http.StatusBadRequest)
+	}
+
+	element := strings.TrimSuffix(parts[0], "_prefix")
+
+	v4len, err := strconv.Atoi(parts[1])
+	if err != nil || v4len < 0 || v4len > 32 {
+		return "", 0, 0, PTOErrorf("bad IPv4 prefix length in group %s", groupStr).StatusIs(http.StatusBadRequest)
+	}
+
+	v6len := defaultV6PrefixLength
+	if len(parts) == 3 {
+		v6len, err = strconv.Atoi(parts[2])
+		if err != nil || v6len < 0 || v6len > 128 {
+			return "", 0, 0, PTOErrorf("bad IPv6 prefix length in group %s", groupStr).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	return element, v4len, v6len, nil
+}
+
+// prefixColumnSpec returns an expression aggregating an address column into
+// its containing network prefix. Values which are not addresses are grouped
+// as is.
+func prefixColumnSpec(column string, v4len int, v6len int) string {
+	return fmt.Sprintf("(CASE WHEN %s ~ '%s' THEN network(set_masklen(%s::inet, %d))::text "+
+		"WHEN %s ~ '%s' THEN network(set_masklen(%s::inet, %d))::text ELSE %s END)",
+		column, ipv4ElementPattern, column, v4len,
+		column, ipv6ElementPattern, column, v6len, column)
+}
+
+// prefixGroupSpec parses a prefix group name, and returns a group
+// specification aggregating the source or target of each path into its
+// containing network prefix.
+func prefixGroupSpec(groupStr string) (*SimpleGroupSpec, error) {
+	element, v4len, v6len, err := parsePrefixGroup(groupStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SimpleGroupSpec{
+		Name:     fmt.Sprintf("%s_prefix/%d/%d", element, v4len, v6len),
+		Column:   prefixColumnSpec("path."+element, v4len, v6len),
+		ExtTable: "paths",
+	}, nil
+}
+
+// normalizePathElements parses path elements given as query parameters, and
+// returns them in the normalized form in which they are stored. If an element
+// type is given, all elements must be of that type.
+func normalizePathElements(elementStrs []string, elementType string) ([]string, error) {
+	if elementStrs == nil {
+		return nil, nil
+	}
+
+	out := make([]string, len(elementStrs))
+	for i, elementStr := range elementStrs {
+		element, foundType, err := ParsePathElement(elementStr)
+		if err != nil {
+			return nil, err
+		}
+		if elementType != "" && foundType != elementType {
+			return nil, PTOErrorf("path element %s is not of type %s", elementStr, elementType).StatusIs(http.StatusBadRequest)
+		}
+		out[i] = element
+	}
+	return out, nil
+}
+
+// normalizeEndpoints returns sources or targets given as query parameters in
+// the normalized form in which they are stored. Endpoints which do not parse
+// as path elements are kept as given, as paths stored before elements were
+// typed may still contain them.
+func normalizeEndpoints(endpointStrs []string) []string {
+	if endpointStrs == nil {
+		return nil
+	}
+
+	out := make([]string, len(endpointStrs))
+	for i, endpointStr := range endpointStrs {
+		if element, _, err := ParsePathElement(endpointStr); err == nil {
+			out[i] = element
+		} else {
+			out[i] = endpointStr
+		}
+	}
+	return out
+}
+
+// zonedColumn returns an expression converting a timestamp column to local
+// time in the given time zone, or the bare column if no zone is given.
+func zonedColumn(column string, timeZone string) string {
+	if timeZone == "" {
+		return column
+	}
+	return fmt.Sprintf("(%s AT TIME ZONE '%s')", column, strings.Replace(timeZone, "'", "''", -1))
+}
+
+// DateTruncGroupSpec groups a pg-go query by applying PostgreSQL's date_trunc
+// function to a column, optionally in a given time zone
 type DateTruncGroupSpec struct {
 	Truncation string
 	Column     string
+	TimeZone   string
+}
+
+// temporalGroupName prefixes a temporal group name with end_ if it groups by
+// the end of the observation rather than the start
+func temporalGroupName(name string, column string) string {
+	if column == "time_end" {
+		return "end_" + name
+	}
+	return name
 }
 
 func (gs *DateTruncGroupSpec) URLEncoded() string {
-	return gs.Truncation
+	return temporalGroupName(gs.Truncation, gs.Column)
 }
 
 func (gs *DateTruncGroupSpec) ColumnSpec() string {
-	return fmt.Sprintf("date_trunc('%s', %s)", gs.Truncation, gs.Column)
+	return fmt.Sprintf("date_trunc('%s', %s)", gs.Truncation, zonedColumn(gs.Column, gs.TimeZone))
 }
 
-// DatePartGroupSpec groups a pg-go query by applying PostgreSQL's date_part function to a column
+// DatePartGroupSpec groups a pg-go query by applying PostgreSQL's date_part
+// function to a column, optionally in a given time zone
 type DatePartGroupSpec struct {
-	Part   string
-	Column string
+	Part     string
+	Column   string
+	TimeZone string
 }
 
 func (gs *DatePartGroupSpec) URLEncoded() string {
 	switch gs.Part {
 	case "dow":
-		return "week_day"
+		return temporalGroupName("week_day", gs.Column)
 	case "hour":
-		return "day_hour"
+		return temporalGroupName("day_hour", gs.Column)
 	default:
 		panic("bad date part group specification")
 	}
 }
 
 func (gs *DatePartGroupSpec) ColumnSpec() string {
-	return fmt.Sprintf("date_part('%s', %s)", gs.Part, gs.Column)
+	return fmt.Sprintf("date_part('%s', %s)", gs.Part, zonedColumn(gs.Column, gs.TimeZone))
+}
+
+// BucketGroupSpec groups a pg-go query into fixed-width time buckets on a
+// column, aligned to the Unix epoch (as PostgreSQL's date_bin), optionally in
+// a given time zone
+type BucketGroupSpec struct {
+	Width    time.Duration
+	Column   string
+	TimeZone string
+}
+
+func (gs *BucketGroupSpec) URLEncoded() string {
+	return temporalGroupName("bucket", gs.Column)
+}
+
+func (gs *BucketGroupSpec) ColumnSpec() string {
+	// zoned columns are timestamps without time zone, so need a matching origin
+	origin := "'epoch'::timestamptz"
+	if gs.TimeZone != "" {
+		origin = "'epoch'::timestamp"
+	}
+
+	column := zonedColumn(gs.Column, gs.TimeZone)
+	width := int64(gs.Width / time.Second)
+
+	return fmt.Sprintf("(%s + floor(extract(epoch from (%s - %s)) / %d) * %d * interval '1 second')",
+		origin, column, origin, width, width)
+}
+
+// DurationGroupSpec groups a pg-go query by observation duration (time_end -
+// time_start) in log-scaled buckets. Each group is named by the lower bound
+// of its bucket in seconds: 0 for durations under one second, then powers of two.
+type DurationGroupSpec struct{}
+
+func (gs *DurationGroupSpec) URLEncoded() string {
+	return "duration"
+}
+
+func (gs *DurationGroupSpec) ColumnSpec() string {
+	duration := "extract(epoch from (time_end - time_start))"
+	return fmt.Sprintf("(CASE WHEN %s < 1 THEN 0 ELSE (2 ^ floor(ln(%s) / ln(2) + 1e-9))::bigint END)",
+		duration, duration)
+}
+
+// ParseBucketWidth parses a bucket width for time bucket grouping. Widths are
+// given as Go durations (e.g. 15m, 6h), or as a whole number of days (e.g. 7d),
+// and must be a whole number of seconds.
+func ParseBucketWidth(s string) (time.Duration, error) {
+	var width time.Duration
+
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseUint(s[:len(s)-1], 10, 32)
+		if err != nil {
+			return 0, PTOErrorf("Error parsing bucket width %s: %s", s, err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		width = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		width, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, PTOErrorf("Error parsing bucket width %s: %s", s, err.Error()).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	if width < time.Second || width%time.Second != 0 {
+		return 0, PTOErrorf("Bucket width %s must be a positive whole number of seconds", s).StatusIs(http.StatusBadRequest)
+	}
+
+	return width, nil
 }
 
 type Query struct {
@@ -256,23 +507,41 @@ type Query struct {
 	ExtRef         string
 	Sources        []int
 
+	// Generation of each source set at execution time, by set ID
+	SourceGenerations map[int]int
+
+	// True if any source set has changed since execution
+	Stale bool
+
+	// Whether a group query was answered from observations or from rollups
+	AnsweredFrom string
+
 	// Arbitrary metadata
 	Metadata map[string]string
 
 	// Parsed query parameters
 	timeStart        *time.Time
 	timeEnd          *time.Time
+	timeZone         string
+	bucketWidth      time.Duration
 	selectSets       []int
 	selectOnPath     []string
+	selectOnPathAS   []string
 	selectSources    []string
 	selectTargets    []string
 	selectConditions []Condition
 	selectValues     []string
 	groups           []GroupSpec
 
+	// Conditions for ratio aggregation
+	ratioNumerator   []Condition
+	ratioDenominator []Condition
+
 	// Query options
 	optionSetsOnly             bool
 	optionCountDistinctTargets bool
+	optionIncludeSuperseded    bool
+	optionNoRollups            bool
 }
 
 func (q *Query) populateFromForm(form url.Values) error {
@@ -316,10 +585,18 @@ func (q *Query) populateFromForm(form url.Values) error {
 		}
 	}
 
-	// Can't really validate paths or values so just store these slices directly from the form.
-	q.selectOnPath = form["on_path"]
-	q.selectSources = form["source"]
-	q.selectTargets = form["target"]
+	// Normalize path elements, so they can be matched against stored paths
+	if q.selectOnPath, err = normalizePathElements(form["on_path"], ""); err != nil {
+		return err
+	}
+	if q.selectOnPathAS, err = normalizePathElements(form["on_path_as"], PathElementAS); err != nil {
+		return err
+	}
+
+	// Sources and targets are normalized as paths' are, but not validated.
+	// Can't really validate values so just store these directly from the form.
+	q.selectSources = normalizeEndpoints(form["source"])
+	q.selectTargets = normalizeEndpoints(form["target"])
 	q.selectValues = form["value"]
 
 	// Validate and expand conditions
@@ -337,6 +614,42 @@ func (q *Query) populateFromForm(form url.Values) error {
 		}
 	}
 
+	// Validate and expand ratio conditions
+	if q.ratioNumerator, err = q.expandConditions(form["numerator"]); err != nil {
+		return err
+	}
+	if q.ratioDenominator, err = q.expandConditions(form["denominator"]); err != nil {
+		return err
+	}
+
+	// Parse and validate time zone for temporal grouping
+	tzStrs, ok := form["tz"]
+	if ok && len(tzStrs) > 0 && tzStrs[0] != "" {
+		if len(tzStrs) > 1 {
+			return PTOErrorf("Query may have only one tz parameter").StatusIs(http.StatusBadRequest)
+		}
+		if tzStrs[0] == "Local" {
+			// the server's local zone means nothing to the database
+			return PTOErrorf("Unsupported time zone %s", tzStrs[0]).StatusIs(http.StatusBadRequest)
+		}
+		loc, err := time.LoadLocation(tzStrs[0])
+		if err != nil {
+			return PTOErrorf("Error parsing tz: %s", err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		q.timeZone = loc.String()
+	}
+
+	// Parse width for time bucket grouping
+	bucketStrs, ok := form["bucket"]
+	if ok && len(bucketStrs) > 0 && bucketStrs[0] != "" {
+		if len(bucketStrs) > 1 {
+			return PTOErrorf("Query may have only one bucket parameter").StatusIs(http.StatusBadRequest)
+		}
+		if q.bucketWidth, err = ParseBucketWidth(bucketStrs[0]); err != nil {
+			return err
+		}
+	}
+
 	groupStrs, ok := form["group"]
 	if ok {
 		if len(groupStrs) > 2 {
@@ -346,19 +659,44 @@ func (q *Query) populateFromForm(form url.Values) error {
 		for i, groupStr := range groupStrs {
 			switch groupStr {
 			case "year":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "year", Column: "time_start"}
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "year", Column: "time_start", TimeZone: q.timeZone}
 			case "month":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "month", Column: "time_start"}
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "month", Column: "time_start", TimeZone: q.timeZone}
 			case "week":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "week", Column: "time_start"}
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "week", Column: "time_start", TimeZone: q.timeZone}
 			case "day":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "day", Column: "time_start"}
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "day", Column: "time_start", TimeZone: q.timeZone}
 			case "hour":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "hour", Column: "time_start"}
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "hour", Column: "time_start", TimeZone: q.timeZone}
 			case "week_day":
-				q.groups[i] = &DatePartGroupSpec{Part: "dow", Column: "time_start"}
+				q.groups[i] = &DatePartGroupSpec{Part: "dow", Column: "time_start", TimeZone: q.timeZone}
 			case "day_hour":
-				q.groups[i] = &DatePartGroupSpec{Part: "hour", Column: "time_start"}
+				q.groups[i] = &DatePartGroupSpec{Part: "hour", Column: "time_start", TimeZone: q.timeZone}
+			case "end_year":
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "year", Column: "time_end", TimeZone: q.timeZone}
+			case "end_month":
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "month", Column: "time_end", TimeZone: q.timeZone}
+			case "end_week":
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "week", Column: "time_end", TimeZone: q.timeZone}
+			case "end_day":
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "day", Column: "time_end", TimeZone: q.timeZone}
+			case "end_hour":
+				q.groups[i] = &DateTruncGroupSpec{Truncation: "hour", Column: "time_end", TimeZone: q.timeZone}
+			case "end_week_day":
+				q.groups[i] = &DatePartGroupSpec{Part: "dow", Column: "time_end", TimeZone: q.timeZone}
+			case "end_day_hour":
+				q.groups[i] = &DatePartGroupSpec{Part: "hour", Column: "time_end", TimeZone: q.timeZone}
+			case "bucket", "end_bucket":
+				if q.bucketWidth == 0 {
+					return PTOErrorf("group %s requires a bucket parameter", groupStr).StatusIs(http.StatusBadRequest)
+				}
+				column := "time_start"
+				if groupStr == "end_bucket" {
+					column = "time_end"
+				}
+				q.groups[i] = &BucketGroupSpec{Width: q.bucketWidth, Column: column, TimeZone: q.timeZone}
+			case "duration":
+				q.groups[i] = &DurationGroupSpec{}
 			case "condition":
 				q.groups[i] = &SimpleGroupSpec{Name: "condition", Column: "condition.name", ExtTable: "conditions"}
 			case "feature":
@@ -370,11 +708,27 @@ func (q *Query) populateFromForm(form url.Values) error {
 			case "value":
 				q.groups[i] = &SimpleGroupSpec{Name: "value", Column: "value", ExtTable: ""}
 			default:
-				return PTOErrorf("unsupported group name %s", groupStr).StatusIs(http.StatusBadRequest)
+				if strings.HasPrefix(groupStr, "source_prefix/") || strings.HasPrefix(groupStr, "target_prefix/") {
+					if q.groups[i], err = prefixGroupSpec(groupStr); err != nil {
+						return err
+					}
+				} else {
+					return PTOErrorf("unsupported group name %s", groupStr).StatusIs(http.StatusBadRequest)
+				}
 			}
 		}
 	}
 
+	// ratios are only meaningful for group queries, and need both sides
+	if len(q.ratioNumerator) > 0 || len(q.ratioDenominator) > 0 {
+		if len(q.ratioNumerator) == 0 || len(q.ratioDenominator) == 0 {
+			return PTOErrorf("Ratio query requires both numerator and denominator").StatusIs(http.StatusBadRequest)
+		}
+		if len(q.groups) == 0 {
+			return PTOErrorf("Ratio query requires at least one group").StatusIs(http.StatusBadRequest)
+		}
+	}
+
 	// parse options
 	optionStrs, ok := form["option"]
 	if ok {
@@ -384,6 +738,10 @@ func (q *Query) populateFromForm(form url.Values) error {
 				q.optionSetsOnly = true
 			case "count_targets":
 				q.optionCountDistinctTargets = true
+			case "include_superseded":
+				q.optionIncludeSuperseded = true
+			case "no_rollups":
+				q.optionNoRollups = true
 			}
 		}
 	}
@@ -394,6 +752,20 @@ func (q *Query) populateFromForm(form url.Values) error {
 	return nil
 }
 
+// expandConditions expands a list of condition names, possibly containing
+// wildcards, into a list of conditions.
+func (q *Query) expandConditions(conditionStrs []string) ([]Condition, error) {
+	var out []Condition
+	for _, conditionStr := range conditionStrs {
+		conditions, err := q.qc.cidCache.ConditionsByName(q.qc.db, conditionStr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, conditions...)
+	}
+	return out, nil
+}
+
 func (q *Query) populateFromEncoded(urlencoded string) error {
 	v, err := url.ParseQuery(urlencoded)
 	if err != nil {
@@ -535,6 +907,14 @@ func (q *Query) URLEncoded() string {
 		out += fmt.Sprintf("&on_path=%s", q.selectOnPath[i])
 	}
 
+	// add sorted AS numbers on path
+	sort.SliceStable(q.selectOnPathAS, func(i, j int) bool {
+		return q.selectOnPathAS[i] < q.selectOnPathAS[j]
+	})
+	for i := range q.selectOnPathAS {
+		out += fmt.Sprintf("&on_path_as=%s", q.selectOnPathAS[i])
+	}
+
 	// add sorted sources
 	sort.SliceStable(q.selectSources, func(i, j int) bool {
 		return q.selectSources[i] < q.selectSources[j]
@@ -559,6 +939,19 @@ func (q *Query) URLEncoded() string {
 		out += fmt.Sprintf("&condition=%s", q.selectConditions[i].Name)
 	}
 
+	// add sorted ratio conditions
+	for _, rc := range []struct {
+		key        string
+		conditions []Condition
+	}{{"numerator", q.ratioNumerator}, {"denominator", q.ratioDenominator}} {
+		sort.SliceStable(rc.conditions, func(i, j int) bool {
+			return rc.conditions[i].Name < rc.conditions[j].Name
+		})
+		for i := range rc.conditions {
+			out += fmt.Sprintf("&%s=%s", rc.key, rc.conditions[i].Name)
+		}
+	}
+
 	// add sorted values
 	sort.SliceStable(q.selectValues, func(i, j int) bool {
 		return q.selectValues[i] < q.selectValues[j]
@@ -575,6 +968,14 @@ func (q *Query) URLEncoded() string {
 		out += fmt.Sprintf("&group=%s", q.groups[i].URLEncoded())
 	}
 
+	// add time zone and bucket width
+	if q.timeZone != "" {
+		out += fmt.Sprintf("&tz=%s", url.QueryEscape(q.timeZone))
+	}
+	if q.bucketWidth != 0 {
+		out += fmt.Sprintf("&bucket=%s", q.bucketWidth.String())
+	}
+
 	// add options
 	if q.optionSetsOnly {
 		out += "&option=sets_only"
@@ -582,6 +983,12 @@ func (q *Query) URLEncoded() string {
 	if q.optionCountDistinctTargets {
 		out += "&option=count_targets"
 	}
+	if q.optionIncludeSuperseded {
+		out += "&option=include_superseded"
+	}
+	if q.optionNoRollups {
+		out += "&option=no_rollups"
+	}
 
 	return out
 }
@@ -592,20 +999,83 @@ func (q *Query) generateIdentifier() {
 	q.Identifier = hex.EncodeToString(hashbytes[:])
 }
 
+// generateSources notes the observation sets this query covers. If the query
+// does not select sets, these are the sets which may contribute to it
+// according to their statistics and declared conditions, which avoids
+// scanning observations twice.
 func (q *Query) generateSources() error {
 	if len(q.selectSets) > 0 {
 		// Sets specified in query. Let's just use them.
 		q.Sources = q.selectSets
 	} else {
-		// We have to actually run a query here.
 		var err error
-		if q.Sources, err = q.selectObservationSetIDs(); err != nil {
+		if q.Sources, err = q.selectCandidateSetIDs(); err != nil {
+			return err
+		}
+	}
+
+	// note the generation of each source, so we can tell when they change
+	var err error
+	q.SourceGenerations, err = ObservationSetGenerations(q.qc.db, q.Sources)
+	return err
+}
+
+// checkStale compares the generations of the observation sets this query was
+// executed against with their current generations in the database, marking
+// the query stale if any have changed or disappeared. If the cache is
+// configured to rerun stale queries, it resubmits the query for execution.
+// The caller must hold the cache's stale lock for the query's identifier, so
+// that a stale query is only rerun once.
+func (q *Query) checkStale() error {
+	// only completed, successful queries can go stale; queries being rerun
+	// have no completion time
+	if q.Completed == nil || q.ExecutionError != nil || q.SourceGenerations == nil {
+		return nil
+	}
+
+	if !q.Stale {
+		currentGenerations, err := ObservationSetGenerations(q.qc.db, q.Sources)
+		if err != nil {
+			return err
+		}
+
+		for setid, gen := range q.SourceGenerations {
+			if currentGenerations[setid] != gen {
+				q.Stale = true
+				break
+			}
+		}
+
+		if !q.Stale {
+			return nil
+		}
+
+		if err := q.FlushMetadata(); err != nil {
 			return err
 		}
 	}
+
+	// rerun if configured to, but never overwrite permanent results
+	if q.qc.config.RerunStaleQueries && q.ExtRef == "" {
+		q.Rerun(make(chan struct{}))
+	}
+
 	return nil
 }
 
+// Rerun clears this query's results and execution state, and executes it
+// again. Used to refresh stale queries.
+func (q *Query) Rerun(done chan struct{}) {
+	q.Executed = nil
+	q.Completed = nil
+	q.ExecutionError = nil
+	q.Stale = false
+	q.AnsweredFrom = ""
+	q.resultRowCount = 0
+
+	q.Execute(done)
+}
+
 func (q *Query) ResultRowCount() int {
 	if q.resultRowCount > 0 {
 		return q.resultRowCount
@@ -679,11 +1149,32 @@ func (q *Query) MarshalJSON() ([]byte, error) {
 			jobj["_ext_ref"] = q.ExtRef
 			jobj["__result"] = jobj["__link"].(string) + "/result"
 			jobj["__row_count"] = q.ResultRowCount()
+		} else if q.Stale {
+			jobj["__state"] = "stale"
+			jobj["__result"] = jobj["__link"].(string) + "/result"
+			jobj["__row_count"] = q.ResultRowCount()
 		} else {
 			jobj["__state"] = "complete"
 			jobj["__result"] = jobj["__link"].(string) + "/result"
 			jobj["__row_count"] = q.ResultRowCount()
 		}
+
+		if q.Stale {
+			jobj["__stale"] = true
+		}
+
+		if q.AnsweredFrom != "" {
+			jobj["__answered_from"] = q.AnsweredFrom
+		}
+
+		if q.SourceGenerations != nil {
+			jobj["__sources"] = q.SourceLinks()
+			generations := make(map[string]int)
+			for setid, gen := range q.SourceGenerations {
+				generations[fmt.Sprintf("%x", setid)] = gen
+			}
+			jobj["__source_generations"] = generations
+		}
 		jobj["__completed"] = q.Completed.Format(time.RFC3339)
 		jobj["__executed"] = q.Executed.Format(time.RFC3339)
 		jobj["__created"] = q.Submitted.Format(time.RFC3339)
@@ -722,13 +1213,38 @@ func (q *Query) setMetadata(jmap map[string]string) {
 	}
 }
 
+// parseQueryTimestamp parses the first of the given keys present in a query
+// metadata map as a timestamp, returning nil if none are present.
+func parseQueryTimestamp(jmap map[string]string, keys ...string) (*time.Time, error) {
+	for _, k := range keys {
+		if jmap[k] != "" {
+			ts, err := time.Parse(time.RFC3339, jmap[k])
+			if err != nil {
+				return nil, PTOWrapError(err)
+			}
+			return &ts, nil
+		}
+	}
+	return nil, nil
+}
+
 func (q *Query) UnmarshalJSON(b []byte) error {
 	// get a JSON map
-	var jmap map[string]string
-	if err := json.Unmarshal(b, &jmap); err != nil {
+	var jobj map[string]interface{}
+	if err := json.Unmarshal(b, &jobj); err != nil {
 		return PTOWrapError(err)
 	}
 
+	// flatten to strings for everything but structured system metadata
+	jmap := make(map[string]string)
+	for k, v := range jobj {
+		switch k {
+		case "__sources", "__source_generations", "__stale":
+		default:
+			jmap[k] = AsString(v)
+		}
+	}
+
 	// parse the query from its encoded representation
 	encoded := jmap["__encoded"]
 	if err := q.populateFromEncoded(encoded); err != nil {
@@ -736,34 +1252,44 @@ func (q *Query) UnmarshalJSON(b []byte) error {
 	}
 
 	// store timestamps
-	if jmap["__time_submitted"] != "" {
-		ts, err := time.Parse(time.RFC3339, jmap["__time_submitted"])
-		if err != nil {
-			return PTOWrapError(err)
-		}
-		q.Submitted = &ts
+	var err error
+	if q.Submitted, err = parseQueryTimestamp(jmap, "__created", "__time_submitted"); err != nil {
+		return err
 	}
 
-	if jmap["__time_executed"] != "" {
-		ts, err := time.Parse(time.RFC3339, jmap["__time_executed"])
-		if err != nil {
-			return PTOWrapError(err)
-		}
-		q.Executed = &ts
+	if q.Executed, err = parseQueryTimestamp(jmap, "__executed", "__time_executed"); err != nil {
+		return err
 	}
 
-	if jmap["__time_completed"] != "" {
-		ts, err := time.Parse(time.RFC3339, jmap["__time_completed"])
-		if err != nil {
-			return PTOWrapError(err)
-		}
-		q.Completed = &ts
+	if q.Completed, err = parseQueryTimestamp(jmap, "__completed", "__time_completed"); err != nil {
+		return err
 	}
 
 	if jmap["__error"] != "" {
 		q.ExecutionError = errors.New(jmap["__error"])
 	}
 
+	q.AnsweredFrom = jmap["__answered_from"]
+
+	// restore source generations, and sources from them
+	if generations, ok := jobj["__source_generations"].(map[string]interface{}); ok {
+		q.SourceGenerations = make(map[int]int)
+		q.Sources = make([]int, 0, len(generations))
+		for k, v := range generations {
+			setid, err := strconv.ParseUint(k, 16, 64)
+			if err != nil {
+				return PTOWrapError(err)
+			}
+			q.SourceGenerations[int(setid)] = AsInt(v)
+			q.Sources = append(q.Sources, int(setid))
+		}
+		sort.Ints(q.Sources)
+	}
+
+	if stale, ok := jobj["__stale"].(bool); ok {
+		q.Stale = stale
+	}
+
 	q.setMetadata(jmap)
 
 	return nil
@@ -846,10 +1372,62 @@ func (q *Query) PaginateResultObject(offset int, count int) (map[string]interfac
 	return out, lineno > offset+count, nil
 }
 
+// selectsPaths returns true if this query selects observations by path, and
+// so must join the paths table.
+func (q *Query) selectsPaths() bool {
+	return len(q.selectSources) > 0 || len(q.selectTargets) > 0 ||
+		len(q.selectOnPath) > 0 || len(q.selectOnPathAS) > 0
+}
+
 func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 	// time
 	pq = pq.Where("time_start > ?", q.timeStart).Where("time_end < ?", q.timeEnd)
 
+	// the end bound on time_start is implied by that on time_end, but lets
+	// PostgreSQL skip observation partitions after the end of the query
+	pq = pq.Where("time_start < ?", q.timeEnd)
+
+	// sets and conditions
+	pq = q.setConditionClauses(pq)
+
+	// values
+	if len(q.selectValues) > 0 {
+		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
+			for _, val := range q.selectValues {
+				qq = qq.WhereOr("value = ?", val)
+			}
+			return qq, nil
+		})
+	}
+
+	// source and target
+	pq = q.endpointClauses(pq, "path")
+
+	// on path: any of the given elements, using the path elements index
+	if len(q.selectOnPath) > 0 {
+		pq = pq.Where("path.elements && ?::text[]", pg.Array(q.selectOnPath))
+	}
+
+	// AS on path
+	if len(q.selectOnPathAS) > 0 {
+		pq = pq.Where("path.elements && ?::text[]", pg.Array(q.selectOnPathAS))
+	}
+
+	return pq
+}
+
+// setConditionClauses adds clauses selecting the observation sets and
+// conditions this query covers to a query on a table with set_id and
+// condition_id columns.
+func (q *Query) setConditionClauses(pq *orm.Query) *orm.Query {
+	// never include retracted sets
+	pq = pq.Where("set_id NOT IN (SELECT id FROM observation_sets WHERE retracted IS NOT NULL)")
+
+	// and don't double count superseded sets unless asked to
+	if !q.optionIncludeSuperseded {
+		pq = pq.Where("set_id NOT IN (" + supersededSetsSubquery + ")")
+	}
+
 	// sets
 	if len(q.selectSets) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
@@ -870,21 +1448,30 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 		})
 	}
 
-	// values
-	if len(q.selectValues) > 0 {
+	// ratio conditions: only observations on either side can count
+	if len(q.ratioNumerator) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
-			for _, val := range q.selectValues {
-				qq = qq.WhereOr("value = ?", val)
+			for _, c := range q.ratioNumerator {
+				qq = qq.WhereOr("condition_id = ?", c.ID)
+			}
+			for _, c := range q.ratioDenominator {
+				qq = qq.WhereOr("condition_id = ?", c.ID)
 			}
 			return qq, nil
 		})
 	}
 
+	return pq
+}
+
+// endpointClauses adds clauses selecting the sources and targets this query
+// covers to a query on a table (or alias) with source and target columns.
+func (q *Query) endpointClauses(pq *orm.Query, table string) *orm.Query {
 	// source
 	if len(q.selectSources) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
 			for _, src := range q.selectSources {
-				qq = qq.WhereOr("path.source = ?", src)
+				qq = qq.WhereOr(table+".source = ?", src)
 			}
 			return qq, nil
 		})
@@ -894,17 +1481,7 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 	if len(q.selectTargets) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
 			for _, tgt := range q.selectTargets {
-				qq = qq.WhereOr("path.target = ?", tgt)
-			}
-			return qq, nil
-		})
-	}
-
-	// on path
-	if len(q.selectOnPath) > 0 {
-		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
-			for _, onpath := range q.selectOnPath {
-				qq = qq.WhereOr("position(? in path.string) > 0", onpath)
+				qq = qq.WhereOr(table+".target = ?", tgt)
 			}
 			return qq, nil
 		})
@@ -942,9 +1519,52 @@ func (q *Query) selectAndStoreObservations() error {
 func (q *Query) selectObservationSetIDs() ([]int, error) {
 	var setids []int
 
-	pq := q.qc.db.Model(&setids).ColumnExpr("DISTINCT set_id")
+	pq := q.qc.db.Model((*Observation)(nil)).ColumnExpr("array_agg(DISTINCT observation.set_id)")
+	if q.selectsPaths() {
+		pq = joinGroupExtTable(pq, "paths")
+	}
 	pq = q.whereClauses(pq)
-	if err := pq.Select(); err != nil {
+	if err := pq.Select(pg.Array(&setids)); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return setids, nil
+}
+
+// selectCandidateSetIDs selects the IDs of observation sets which may contain
+// observations responding to this query, without scanning observations: sets
+// visible to the query whose observations overlap its time range, and which
+// declare a condition it selects. Sets without statistics are assumed to
+// overlap.
+func (q *Query) selectCandidateSetIDs() ([]int, error) {
+	var setids []int
+
+	pq := q.qc.db.Model((*ObservationSet)(nil)).
+		ColumnExpr("array_agg(observation_set.id ORDER BY observation_set.id)").
+		Where("observation_set.retracted IS NULL")
+
+	if !q.optionIncludeSuperseded {
+		pq = pq.Where("observation_set.id NOT IN (" + supersededSetsSubquery + ")")
+	}
+
+	pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
+		qq = qq.WhereOr("observation_set.stats IS NULL").
+			WhereOr("(observation_set.stats->>'time_start')::timestamptz < ? AND "+
+				"(observation_set.stats->>'time_end')::timestamptz > ?", q.timeEnd, q.timeStart)
+		return qq, nil
+	})
+
+	conditions := append(append(append([]Condition{}, q.selectConditions...), q.ratioNumerator...), q.ratioDenominator...)
+	if len(conditions) > 0 {
+		ids := make([]int, len(conditions))
+		for i := range conditions {
+			ids[i] = conditions[i].ID
+		}
+		pq = pq.Where("observation_set.id IN "+
+			"(SELECT observation_set_id FROM observation_set_conditions WHERE condition_id IN (?))", pg.In(ids))
+	}
+
+	if err := pq.Select(pg.Array(&setids)); err != nil {
 		return nil, PTOWrapError(err)
 	}
 
@@ -987,26 +1607,87 @@ func joinGroupExtTable(q *orm.Query, extTable string) *orm.Query {
 	}
 }
 
+// countClause returns the aggregate column expression for a group query:
+// either a single count, or numerator and denominator counts for a ratio query.
+func (q *Query) countClause() string {
+	var count string
+	if q.optionCountDistinctTargets {
+		count = "count(distinct path.target)"
+	} else {
+		count = "count(*)"
+	}
+
+	if len(q.ratioNumerator) == 0 {
+		return count
+	}
+
+	return fmt.Sprintf("%s FILTER (WHERE %s) AS numerator, %s FILTER (WHERE %s) AS denominator",
+		count, conditionIDClause(q.ratioNumerator), count, conditionIDClause(q.ratioDenominator))
+}
+
+// conditionIDClause returns a SQL expression matching observations with any
+// of the given conditions.
+func conditionIDClause(conditions []Condition) string {
+	ids := make([]string, len(conditions))
+	for i := range conditions {
+		ids[i] = strconv.Itoa(conditions[i].ID)
+	}
+	return fmt.Sprintf("condition_id IN (%s)", strings.Join(ids, ", "))
+}
+
+// groupResultCounts returns the count elements of a group result row: the
+// count for a plain group query, or numerator, denominator, and ratio
+// (null if the denominator is zero) for a ratio query.
+func (q *Query) groupResultCounts(count, numerator, denominator int) []interface{} {
+	if len(q.ratioNumerator) == 0 {
+		return []interface{}{count}
+	}
+
+	var ratio interface{}
+	if denominator > 0 {
+		ratio = float64(numerator) / float64(denominator)
+	}
+	return []interface{}{numerator, denominator, ratio}
+}
+
+// writeGroupResult writes a group result row, consisting of group names
+// followed by counts, to a result file as a line of NDJSON.
+func (q *Query) writeGroupResult(out io.Writer, groups []string, count, numerator, denominator int) error {
+	row := make([]interface{}, len(groups))
+	for i := range groups {
+		row[i] = groups[i]
+	}
+	row = append(row, q.groupResultCounts(count, numerator, denominator)...)
+
+	b, err := json.Marshal(row)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
 func (q *Query) selectAndStoreOneGroup() error {
 
 	var results []struct {
-		tableName struct{} `sql:"observations,alias:observation"` // OMG this is a freaking hack
-		Group0    string
-		Count     int
+		tableName   struct{} `sql:"observations,alias:observation"` // OMG this is a freaking hack
+		Group0      string
+		Count       int
+		Numerator   int
+		Denominator int
 	}
 
-	var countClause string
-	if q.optionCountDistinctTargets {
-		countClause = "count(distinct path.target)"
-	} else {
-		countClause = "count(*)"
-	}
+	countClause := q.countClause()
 
 	pq := q.qc.db.Model(&results).ColumnExpr(q.groups[0].ColumnSpec() + " as group0, " + countClause)
 
 	// add join clause if necessary
 	joinedPaths := false
-	if q.optionCountDistinctTargets {
+	if q.optionCountDistinctTargets || q.selectsPaths() {
 		pq = joinGroupExtTable(pq, "paths")
 		joinedPaths = true
 	}
@@ -1031,17 +1712,9 @@ func (q *Query) selectAndStoreOneGroup() error {
 	defer outfile.Close()
 
 	for _, result := range results {
-		out := make([]interface{}, 2)
-		out[0] = result.Group0
-		out[1] = result.Count
-
-		b, err := json.Marshal(out)
-		if err != nil {
-			return PTOWrapError(err)
-		}
-
-		if _, err := fmt.Fprintf(outfile, "%s\n", b); err != nil {
-			return PTOWrapError(err)
+		if err := q.writeGroupResult(outfile, []string{result.Group0},
+			result.Count, result.Numerator, result.Denominator); err != nil {
+			return err
 		}
 	}
 
@@ -1051,18 +1724,15 @@ func (q *Query) selectAndStoreOneGroup() error {
 func (q *Query) selectAndStoreTwoGroups() error {
 
 	var results []struct {
-		tableName struct{} `sql:"observations,alias:observation"` // OMG this is a freaking hack
-		Group0    string
-		Group1    string
-		Count     int
+		tableName   struct{} `sql:"observations,alias:observation"` // OMG this is a freaking hack
+		Group0      string
+		Group1      string
+		Count       int
+		Numerator   int
+		Denominator int
 	}
 
-	var countClause string
-	if q.optionCountDistinctTargets {
-		countClause = "count(distinct path.target)"
-	} else {
-		countClause = "count(*)"
-	}
+	countClause := q.countClause()
 
 	pq := q.qc.db.Model(&results).ColumnExpr(
 		q.groups[0].ColumnSpec() + " as group0, " +
@@ -1071,7 +1741,7 @@ func (q *Query) selectAndStoreTwoGroups() error {
 	// now join as necessary
 	extTableSet := make(map[string]struct{})
 
-	if q.optionCountDistinctTargets {
+	if q.optionCountDistinctTargets || q.selectsPaths() {
 		extTableSet["paths"] = struct{}{}
 	}
 
@@ -1099,18 +1769,9 @@ func (q *Query) selectAndStoreTwoGroups() error {
 	defer outfile.Close()
 
 	for _, result := range results {
-		out := make([]interface{}, 3)
-		out[0] = result.Group0
-		out[1] = result.Group1
-		out[2] = result.Count
-
-		b, err := json.Marshal(out)
-		if err != nil {
-			return PTOWrapError(err)
-		}
-
-		if _, err := fmt.Fprintf(outfile, "%s\n", b); err != nil {
-			return PTOWrapError(err)
+		if err := q.writeGroupResult(outfile, []string{result.Group0, result.Group1},
+			result.Count, result.Numerator, result.Denominator); err != nil {
+			return err
 		}
 	}
 
@@ -1120,18 +1781,33 @@ func (q *Query) selectAndStoreTwoGroups() error {
 // selectAndStoreGroups selects groups responding to this query and dumps them
 // to the data file as NDJSON, one line containing a JSON array per group,
 // with elements 0 to n-1 being group names, and element n being the count of
-// observations in the group.
+// observations in the group. For ratio queries, elements n to n+2 are the
+// numerator count, the denominator count, and their ratio. Queries which can
+// be answered from observation rollups are, unless the no_rollups option is
+// given; AnsweredFrom notes which were used.
 func (q *Query) selectAndStoreGroups() error {
 	switch len(q.groups) {
 	case 0:
 		panic("Programmer error: Query.selectAndStoreGroups() called on a non-group query")
-	case 1:
-		return q.selectAndStoreOneGroup()
-	case 2:
-		return q.selectAndStoreTwoGroups()
+	case 1, 2:
 	default:
 		return PTOErrorf("Group by more than two dimensions not presently supported").StatusIs(http.StatusBadRequest)
 	}
+
+	columns, joinConditions, err := q.rollupGroupColumns()
+	if err != nil {
+		return err
+	}
+	if columns != nil {
+		q.AnsweredFrom = AnsweredFromRollups
+		return q.selectAndStoreRollupGroups(columns, joinConditions)
+	}
+
+	q.AnsweredFrom = AnsweredFromObservations
+	if len(q.groups) == 1 {
+		return q.selectAndStoreOneGroup()
+	}
+	return q.selectAndStoreTwoGroups()
 }
 
 func (q *Query) executionFunc() func() error {
@@ -1181,8 +1857,13 @@ func (q *Query) Execute(done chan struct{}) {
 		// flush to disk
 		q.FlushMetadata()
 
+		// note which sets (at which generations) the query covers
+		q.ExecutionError = q.generateSources()
+
 		// switch and run query
-		q.ExecutionError = q.executionFunc()()
+		if q.ExecutionError == nil {
+			q.ExecutionError = q.executionFunc()()
+		}
 
 		// mark query as done
 		endTime := time.Now()
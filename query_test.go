@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"testing"
 
 	pto3 "github.com/mami-project/pto3-go"
@@ -68,6 +70,12 @@ func TestQueryParsing(t *testing.T) {
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&group=condition&group=week",
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&option=sets_only",
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&value=0",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=week_day&tz=Asia%2FTokyo",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=end_day_hour&group=duration",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=bucket&bucket=15m",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=day&numerator=pto.test.color.red&denominator=pto.test.color.*",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=target_prefix/24&group=source_prefix/16/32",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=end_bucket&group=condition&bucket=7d&tz=Europe%2FZurich",
 	}
 
 	for i := range encodedTestQueries {
@@ -92,6 +100,124 @@ func TestQueryParsing(t *testing.T) {
 	}
 }
 
+func TestBadTimeZone(t *testing.T) {
+	badTimeZoneQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&group=day_hour&tz=Mars%2FOlympus_Mons",
+		"time_start=2017-12-05&time_end=2017-12-06&group=day_hour&tz=Local",
+	}
+
+	for _, encoded := range badTimeZoneQueries {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded(encoded); err == nil {
+			t.Fatalf("query %s with bad time zone parsed without error", encoded)
+		}
+	}
+}
+
+func TestBadBucket(t *testing.T) {
+	badBucketQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&group=bucket",
+		"time_start=2017-12-05&time_end=2017-12-06&group=bucket&bucket=0s",
+		"time_start=2017-12-05&time_end=2017-12-06&group=bucket&bucket=1500ms",
+		"time_start=2017-12-05&time_end=2017-12-06&group=end_bucket&bucket=fortnight",
+	}
+
+	for _, encoded := range badBucketQueries {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded(encoded); err == nil {
+			t.Fatalf("query %s with bad bucket parsed without error", encoded)
+		}
+	}
+}
+
+func TestBadPrefixGroup(t *testing.T) {
+	badPrefixQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&group=target_prefix/",
+		"time_start=2017-12-05&time_end=2017-12-06&group=target_prefix/33",
+		"time_start=2017-12-05&time_end=2017-12-06&group=source_prefix/24/129",
+		"time_start=2017-12-05&time_end=2017-12-06&group=source_prefix/24/48/64",
+		"time_start=2017-12-05&time_end=2017-12-06&group=path_prefix/24",
+	}
+
+	for _, encoded := range badPrefixQueries {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded(encoded); err == nil {
+			t.Fatalf("query %s with bad prefix group parsed without error", encoded)
+		}
+	}
+}
+
+func TestBadPathElementQuery(t *testing.T) {
+	badPathQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&on_path=10.33",
+		"time_start=2017-12-05&time_end=2017-12-06&on_path=10.33.44.55%2F33",
+		"time_start=2017-12-05&time_end=2017-12-06&on_path_as=10.33.44.55",
+		"time_start=2017-12-05&time_end=2017-12-06&on_path_as=AS4294967296",
+	}
+
+	for _, encoded := range badPathQueries {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded(encoded); err == nil {
+			t.Fatalf("query %s with bad path element parsed without error", encoded)
+		}
+	}
+}
+
+func TestBadRatioQuery(t *testing.T) {
+	badRatioQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&group=day&numerator=pto.test.color.red",
+		"time_start=2017-12-05&time_end=2017-12-06&group=day&denominator=pto.test.color.*",
+		"time_start=2017-12-05&time_end=2017-12-06&numerator=pto.test.color.red&denominator=pto.test.color.*",
+	}
+
+	for _, encoded := range badRatioQueries {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded(encoded); err == nil {
+			t.Fatalf("bad ratio query %s parsed without error", encoded)
+		}
+	}
+}
+
+func TestRatioQuery(t *testing.T) {
+	encoded := fmt.Sprintf("time_start=2017-12-05&time_end=2017-12-06&group=day"+
+		"&numerator=pto.test.color.red&denominator=pto.test.color.*&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatalf("ratio query failed: %v", q.ExecutionError)
+	}
+
+	resfile, err := q.ReadResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resfile.Close()
+
+	// each line is group, numerator, denominator, ratio
+	var numerator, denominator int
+	s := bufio.NewScanner(resfile)
+	for s.Scan() {
+		var line []interface{}
+		if err := json.Unmarshal([]byte(s.Text()), &line); err != nil {
+			t.Fatal(err)
+		}
+		if len(line) != 4 {
+			t.Fatalf("expected four elements in ratio result, got %v", line)
+		}
+		n, d, r := line[1].(float64), line[2].(float64), line[3].(float64)
+		if r != n/d {
+			t.Fatalf("bad ratio in result %v", line)
+		}
+		numerator += int(n)
+		denominator += int(d)
+	}
+
+	if numerator != 3195 || denominator != 14400 {
+		t.Fatalf("expected ratio 3195/14400, got %d/%d", numerator, denominator)
+	}
+}
+
 func TestSelectQueries(t *testing.T) {
 	testSelectQueries := []struct {
 		encoded string
@@ -101,6 +227,10 @@ func TestSelectQueries(t *testing.T) {
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&condition=pto.test.color.green&condition=pto.test.color.indigo", 124},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&target=10.13.14.253", 0},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&value=nonesuch", 0},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&on_path=10.33.44.55", 454},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&on_path=%5B2001%3Adb8%3Ae55%3A5%3A%3A33%5D", 147},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&on_path=10.33.44.55&on_path=2001%3Adb8%3Ae55%3A5%3A%3A33", 601},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&on_path_as=AS3303", 0},
 	}
 
 	for i, qspec := range testSelectQueries {
@@ -153,8 +283,12 @@ func TestOneGroupQueries(t *testing.T) {
 	}{
 		{"time_start=2017-12-05&time_end=2017-12-06&group=condition", "pto.test.color.red", 3195},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=source", "2001:db8:e55:5::33", 3273},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=source&source=%5B2001%3ADB8%3AE55%3A5%3A0%3A%3A33%5D", "2001:db8:e55:5::33", 3273},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=target", "10.15.16.17", 7},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=target_prefix/24", "10.15.16.0/24", 2208},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=source_prefix/16/48", "2001:db8:e55::/48", 3273},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=day_hour", "14", 3412},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=day_hour&tz=Asia%2FTokyo", "23", 3412},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=count_targets", "pto.test.color.red", 1832},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=value", "0", 14400},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=feature", "pto", 14400},
@@ -212,6 +346,56 @@ func TestOneGroupQueries(t *testing.T) {
 	}
 }
 
+func TestDurationGroupQuery(t *testing.T) {
+	// durations in the test data are 0, 1, or 2 seconds, falling exactly on
+	// bucket boundaries, so each lands in the bucket it bounds from below
+	expected := map[string]int{
+		"0": 3545,
+		"1": 7160,
+		"2": 3695,
+	}
+
+	encoded := fmt.Sprintf("time_start=2017-12-05&time_end=2017-12-06&group=duration&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.Completed == nil {
+		t.Fatal("duration query did not complete")
+	}
+	if q.ExecutionError != nil {
+		t.Fatalf("duration query failed: %v", q.ExecutionError)
+	}
+
+	resfile, err := q.ReadResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resfile.Close()
+
+	groupResults, err := parseGroupQueryResults(resfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groupResults) != len(expected) {
+		t.Fatalf("expected %d duration groups, got %v", len(expected), groupResults)
+	}
+	for _, result := range groupResults {
+		count, ok := expected[result.groups[0]]
+		if !ok {
+			t.Fatalf("unexpected duration group %s", result.groups[0])
+		}
+		if result.count != count {
+			t.Fatalf("expected count %d for duration group %s, got %d", count, result.groups[0], result.count)
+		}
+	}
+}
+
 func TestTwoGroupQueries(t *testing.T) {
 
 	testQueries := []struct {
@@ -275,3 +459,155 @@ func TestTwoGroupQueries(t *testing.T) {
 		}
 	}
 }
+
+func TestStaleQuery(t *testing.T) {
+	encoded := fmt.Sprintf("time_start=2017-12-05&time_end=2017-12-06&group=condition&set=%x", TestQueryCacheSetID)
+
+	// submit query and wait for result
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatalf("Query failed: %v", q.ExecutionError)
+	}
+
+	if gen, ok := q.SourceGenerations[TestQueryCacheSetID]; !ok || gen == 0 {
+		t.Fatalf("Query missing generation for source set %x: %v", TestQueryCacheSetID, q.SourceGenerations)
+	}
+
+	// unchanged sets leave the query fresh
+	q, err = TestQueryCache.QueryByIdentifier(q.Identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Stale {
+		t.Fatal("Query stale before source set changed")
+	}
+
+	// touch the source set's metadata
+	set := pto3.ObservationSet{ID: TestQueryCacheSetID}
+	if err := set.SelectByID(TestDB); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Update(TestDB, TestConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// and verify the query has noticed
+	q, err = TestQueryCache.QueryByIdentifier(q.Identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.Stale {
+		t.Fatal("Query not stale after source set changed")
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var md map[string]interface{}
+	if err := json.Unmarshal(b, &md); err != nil {
+		t.Fatal(err)
+	}
+	if md["__state"] != "stale" {
+		t.Fatalf("Stale query has state %v", md["__state"])
+	}
+}
+
+func TestConcurrentQueryFetch(t *testing.T) {
+	encoded := fmt.Sprintf("time_start=2017-12-05&time_end=2017-12-06&group=source&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// a second cache over the same directory must fetch the query from disk
+	qc, err := pto3.NewQueryCache(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent fetches all get the same instance
+	fetched := make([]*pto3.Query, 8)
+	errs := make([]error, len(fetched))
+	var wg sync.WaitGroup
+	for i := range fetched {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fetched[i], errs[i] = qc.QueryByIdentifier(q.Identifier)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range fetched {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if fetched[i] == nil || fetched[i] != fetched[0] {
+			t.Fatalf("concurrent fetch %d returned a different query instance", i)
+		}
+	}
+}
+
+func TestUnselectedSetQueries(t *testing.T) {
+	testQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=no_rollups",
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&target=10.15.16.17&option=no_rollups",
+		"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&on_path=10.33.44.55",
+		"time_start=2017-12-05&time_end=2017-12-06&target=10.15.16.17&option=sets_only",
+	}
+
+	setLink := pto3.LinkForSetID(TestConfig, TestQueryCacheSetID)
+
+	for i, encoded := range testQueries {
+		// no set given, so the query runs over every set in the database
+		done := make(chan struct{})
+		q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+
+		if q.ExecutionError != nil {
+			t.Fatalf("Query %d failed: %v", i, q.ExecutionError)
+		}
+
+		foundSource := false
+		for _, setid := range q.Sources {
+			foundSource = foundSource || setid == TestQueryCacheSetID
+		}
+		if !foundSource {
+			t.Fatalf("Query %d sources %v missing test set %x", i, q.Sources, TestQueryCacheSetID)
+		}
+
+		resfile, err := q.ReadResultFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resfile.Close()
+
+		lines := 0
+		foundSet := false
+		resscan := bufio.NewScanner(resfile)
+		for resscan.Scan() {
+			lines++
+			foundSet = foundSet || resscan.Text() == fmt.Sprintf("%q", setLink)
+		}
+		if lines == 0 {
+			t.Fatalf("Query %d has no results", i)
+		}
+		if strings.Contains(encoded, "sets_only") && !foundSet {
+			t.Fatalf("Query %d results missing test set %s", i, setLink)
+		}
+	}
+}
@@ -43,8 +43,8 @@ type RawMetadata struct {
 	timeStart *time.Time
 	// End time for records in the file
 	timeEnd *time.Time
-	// Arbitrary metadata
-	Metadata map[string]string
+	// Arbitrary metadata, as JSON values
+	Metadata map[string]interface{}
 	// Link to data object
 	datalink string
 	// Size of data object
@@ -122,9 +122,24 @@ func (md *RawMetadata) TimeEnd(inherit bool) *time.Time {
 	}
 }
 
+// Get returns the value of an arbitrary metadata key as a string, or the empty
+// string if not present. Non-string values are rendered as strings; use
+// GetValue to retrieve them as JSON values.
 func (md *RawMetadata) Get(k string, inherit bool) string {
-	out := md.Metadata[k]
-	if out == "" && inherit && md.Parent != nil {
+	v := md.GetValue(k, inherit)
+	if v == nil {
+		return ""
+	}
+	return AsString(v)
+}
+
+// GetValue returns the value of an arbitrary metadata key as a JSON value
+// (string, float64, bool, []interface{}, or map[string]interface{}), or nil if
+// not present. If inherit is true, a key not present on this object is looked
+// up in its parent.
+func (md *RawMetadata) GetValue(k string, inherit bool) interface{} {
+	out, ok := md.Metadata[k]
+	if !ok && inherit && md.Parent != nil {
 		out = md.Parent.Metadata[k]
 	}
 	return out
@@ -184,7 +199,7 @@ func (md *RawMetadata) DumpJSONObject(inherit bool) ([]byte, error) {
 
 	// dump arbitrary keys
 	for _, k := range md.Keys(inherit) {
-		jmap[k] = md.Get(k, inherit)
+		jmap[k] = md.GetValue(k, inherit)
 	}
 
 	return json.Marshal(jmap)
@@ -200,7 +215,7 @@ func (md *RawMetadata) MarshalJSON() ([]byte, error) {
 
 // UnmarshalJSON fills in a RawMetadata object from JSON.
 func (md *RawMetadata) UnmarshalJSON(b []byte) error {
-	md.Metadata = make(map[string]string)
+	md.Metadata = make(map[string]interface{})
 
 	var jmap map[string]interface{}
 
@@ -229,7 +244,7 @@ func (md *RawMetadata) UnmarshalJSON(b []byte) error {
 		} else if strings.HasPrefix(k, "__") {
 			// Ignore all (incoming) __ keys instead of stuffing them in metadata
 		} else {
-			md.Metadata[k] = AsString(v)
+			md.Metadata[k] = v
 		}
 	}
 
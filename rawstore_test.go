@@ -1,10 +1,12 @@
 package pto3_test
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -211,3 +213,44 @@ func TestRawRoundtrip(t *testing.T) {
 	}
 
 }
+
+func TestRawTypedMetadata(t *testing.T) {
+	cammd, err := pto3.RawMetadataFromReader(strings.NewReader(
+		`{"_file_type": "test", "_owner": "ops@example.com", "vantage": {"as": 3303, "city": "Zurich"}}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err := pto3.RawMetadataFromReader(strings.NewReader(
+		`{"runs": 3, "complete": true, "tags": ["ecn", "tfo"]}`), cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip through JSON, with inheritance
+	b, err := filemd.DumpJSONObject(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err = pto3.RawMetadataFromReader(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runs, ok := filemd.GetValue("runs", false).(float64); !ok || runs != 3 {
+		t.Fatalf("numeric metadata not preserved: %v", filemd.GetValue("runs", false))
+	}
+
+	if complete, ok := filemd.GetValue("complete", false).(bool); !ok || !complete {
+		t.Fatalf("boolean metadata not preserved: %v", filemd.GetValue("complete", false))
+	}
+
+	if tags, ok := filemd.GetValue("tags", false).([]interface{}); !ok || len(tags) != 2 || tags[1] != "tfo" {
+		t.Fatalf("list metadata not preserved: %v", filemd.GetValue("tags", false))
+	}
+
+	if vantage, ok := filemd.GetValue("vantage", false).(map[string]interface{}); !ok || vantage["as"] != float64(3303) {
+		t.Fatalf("inherited object metadata not preserved: %v", filemd.GetValue("vantage", false))
+	}
+}
@@ -0,0 +1,322 @@
+package pto3
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Aggregate rollups for PTO3 obs.
+// Group queries over long time ranges (e.g. monthly counts of each condition
+// per target) would otherwise count raw observations each time they run. The
+// observations in each set are therefore also counted by condition, source,
+// target, and the days (in UTC) on which they start and end, in the
+// observation_rollups table. A set's rollups are rebuilt when its data is
+// loaded, extended with the rollups of each chunk appended to it, and removed
+// when it is retracted or deleted. A set may therefore have several rollups
+// for the same group; queries sum them. Group queries bounded
+// by UTC midnights, which do not select by value or path element, and whose
+// groups are no finer than a day, are answered from rollups instead of
+// observations. Rollups keep the ID of their set, so retracted and superseded
+// sets are excluded from them as they are from observations.
+
+// Values of Query.AnsweredFrom, noting how a group query was answered.
+const (
+	AnsweredFromObservations = "observations"
+	AnsweredFromRollups      = "rollups"
+)
+
+// createObservationRollupsTable creates the rollup table. start_midnight is
+// true for observations starting exactly at the start of their day, which
+// lets rollups answer queries excluding observations starting at the start
+// of the query.
+const createObservationRollupsTable = `CREATE TABLE IF NOT EXISTS observation_rollups (
+	set_id bigint NOT NULL REFERENCES observation_sets (id),
+	condition_id bigint REFERENCES conditions (id),
+	source text,
+	target text,
+	day_start timestamptz NOT NULL,
+	day_end timestamptz,
+	start_midnight boolean NOT NULL,
+	observations bigint NOT NULL
+)`
+
+// createRollupIndexes allow rollups to be selected by set, and by day.
+var createRollupIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS observation_rollups_set_id_idx ON observation_rollups (set_id)",
+	"CREATE INDEX IF NOT EXISTS observation_rollups_day_start_idx ON observation_rollups (day_start)",
+	createRollupTargetIndex,
+}
+
+// createRollupTargetIndex allows the targets of a set to be looked up in its
+// rollups, to count distinct targets as chunks are appended.
+const createRollupTargetIndex = "CREATE INDEX IF NOT EXISTS observation_rollups_set_target_idx ON observation_rollups (set_id, target)"
+
+// utcDay returns an expression truncating a timestamp column to the start of
+// its day in UTC, regardless of the session time zone.
+func utcDay(column string) string {
+	return fmt.Sprintf("(date_trunc('day', %s AT TIME ZONE 'UTC') AT TIME ZONE 'UTC')", column)
+}
+
+// deleteRollups removes the rollups of this ObservationSet.
+func (set *ObservationSet) deleteRollups(db orm.DB) error {
+	if _, err := db.Exec("DELETE FROM observation_rollups WHERE set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// updateRollups rebuilds the rollups of this ObservationSet from its
+// observations. This is called whenever a set's observation data is loaded
+// as a whole, along with updateStats. Retracted sets have no rollups.
+func (set *ObservationSet) updateRollups(db orm.DB) error {
+	if err := set.deleteRollups(db); err != nil {
+		return err
+	}
+
+	if set.Retracted != nil {
+		return nil
+	}
+
+	return set.insertRollups(db, "observations")
+}
+
+// insertRollups adds rollups counting this ObservationSet's observations in
+// a table with the columns of the observations table. Appending a chunk adds
+// the rollups of the chunk, staged in its own table, to those of the set.
+func (set *ObservationSet) insertRollups(db orm.DB, table string) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		INSERT INTO observation_rollups
+			(set_id, condition_id, source, target, day_start, day_end, start_midnight, observations)
+		SELECT observation.set_id, observation.condition_id, path.source, path.target,
+			%s, %s, observation.time_start = %s, count(*)
+		FROM %s AS observation
+		LEFT JOIN paths AS path ON path.id = observation.path_id
+		WHERE observation.set_id = ?
+		GROUP BY 1, 2, 3, 4, 5, 6, 7`,
+		utcDay("observation.time_start"), utcDay("observation.time_end"), utcDay("observation.time_start"), table),
+		set.ID)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// fillRollups builds rollups for observation sets loaded before rollups
+// were maintained.
+func fillRollups(db orm.DB) error {
+	var sets []ObservationSet
+	if err := db.Model(&sets).Column("id", "retracted").Where("retracted IS NULL").Select(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for i := range sets {
+		if err := sets[i].updateRollups(db); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// utcMidnight returns true if a time is the start of a day in UTC.
+func utcMidnight(t time.Time) bool {
+	return t.UTC().Equal(t.UTC().Truncate(24 * time.Hour))
+}
+
+// sessionTimeZoneUTC returns true if the database session's time zone is
+// UTC, such that timestamps grouped without a time zone are grouped by UTC
+// days.
+func sessionTimeZoneUTC(db orm.DB) (bool, error) {
+	var tz string
+	if _, err := db.QueryOne(pg.Scan(&tz), "SELECT current_setting('TimeZone')"); err != nil {
+		return false, PTOWrapError(err)
+	}
+	return tz == "UTC" || tz == "Etc/UTC", nil
+}
+
+// rollupDayColumns maps observation time columns to the rollup columns
+// holding the UTC days in which they fall.
+var rollupDayColumns = map[string]string{
+	"time_start": "rollup.day_start",
+	"time_end":   "rollup.day_end",
+}
+
+// rollupColumnSpec returns an expression grouping rollups as a group
+// specification groups observations, and whether it needs the conditions
+// table joined. It returns an empty expression if the group is finer than
+// rollups. If utc is true, temporal groups without a time zone group by UTC
+// days.
+func rollupColumnSpec(gs GroupSpec, utc bool) (string, bool) {
+	dayAligned := func(timeZone string) bool {
+		return timeZone == "UTC" || (timeZone == "" && utc)
+	}
+
+	switch gs := gs.(type) {
+	case *SimpleGroupSpec:
+		switch gs.Name {
+		case "condition", "feature":
+			return gs.Column, true
+		case "source", "target":
+			return "rollup." + gs.Name, false
+		}
+		if strings.Contains(gs.Name, "_prefix/") {
+			element, v4len, v6len, err := parsePrefixGroup(gs.Name)
+			if err == nil {
+				return prefixColumnSpec("rollup."+element, v4len, v6len), false
+			}
+		}
+	case *DateTruncGroupSpec:
+		switch gs.Truncation {
+		case "day", "week", "month", "year":
+			if dayAligned(gs.TimeZone) {
+				rgs := *gs
+				rgs.Column = rollupDayColumns[gs.Column]
+				return rgs.ColumnSpec(), false
+			}
+		}
+	case *DatePartGroupSpec:
+		if gs.Part == "dow" && dayAligned(gs.TimeZone) {
+			rgs := *gs
+			rgs.Column = rollupDayColumns[gs.Column]
+			return rgs.ColumnSpec(), false
+		}
+	case *BucketGroupSpec:
+		// buckets are aligned to the epoch, so whole-day buckets without a
+		// time zone are aligned to UTC days whatever the session time zone
+		if gs.Width%(24*time.Hour) == 0 && (gs.TimeZone == "" || gs.TimeZone == "UTC") {
+			rgs := *gs
+			rgs.Column = rollupDayColumns[gs.Column]
+			return rgs.ColumnSpec(), false
+		}
+	}
+
+	return "", false
+}
+
+// rollupGroupColumns returns expressions grouping rollups as this query's
+// groups group observations, and whether they need the conditions table
+// joined. It returns nil if this query cannot be answered from rollups.
+func (q *Query) rollupGroupColumns() ([]string, bool, error) {
+	if q.optionNoRollups {
+		return nil, false, nil
+	}
+
+	// rollups count observations by day, condition, source, and target only
+	if len(q.selectValues) > 0 || len(q.selectOnPath) > 0 || len(q.selectOnPathAS) > 0 {
+		return nil, false, nil
+	}
+
+	if !utcMidnight(*q.timeStart) || !utcMidnight(*q.timeEnd) {
+		return nil, false, nil
+	}
+
+	utc, err := sessionTimeZoneUTC(q.qc.db)
+	if err != nil {
+		return nil, false, err
+	}
+
+	columns := make([]string, len(q.groups))
+	joinConditions := false
+	for i := range q.groups {
+		var join bool
+		columns[i], join = rollupColumnSpec(q.groups[i], utc)
+		if columns[i] == "" {
+			return nil, false, nil
+		}
+		joinConditions = joinConditions || join
+	}
+
+	return columns, joinConditions, nil
+}
+
+// rollupWhereClauses adds clauses selecting the rollups counting
+// observations this query covers. As the query is bounded by midnights, an
+// observation starts after the start of the query if it starts on a later
+// day, or later on the same day, and ends before the end of the query if it
+// ends on an earlier day.
+func (q *Query) rollupWhereClauses(pq *orm.Query) *orm.Query {
+	pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
+		qq = qq.WhereOr("rollup.day_start > ?", q.timeStart).
+			WhereOr("rollup.day_start = ? AND NOT rollup.start_midnight", q.timeStart)
+		return qq, nil
+	})
+	pq = pq.Where("rollup.day_end < ?", q.timeEnd).Where("rollup.day_start < ?", q.timeEnd)
+
+	pq = q.setConditionClauses(pq)
+	return q.endpointClauses(pq, "rollup")
+}
+
+// rollupCountClause returns the aggregate column expression for a group
+// query answered from rollups, as countClause does for observations.
+func (q *Query) rollupCountClause() string {
+	var count string
+	if q.optionCountDistinctTargets {
+		count = "count(DISTINCT rollup.target)"
+	} else {
+		count = "sum(rollup.observations)"
+	}
+
+	if len(q.ratioNumerator) == 0 {
+		return fmt.Sprintf("coalesce(%s, 0) AS count", count)
+	}
+
+	return fmt.Sprintf("coalesce(%s FILTER (WHERE %s), 0) AS numerator, coalesce(%s FILTER (WHERE %s), 0) AS denominator",
+		count, conditionIDClause(q.ratioNumerator), count, conditionIDClause(q.ratioDenominator))
+}
+
+// selectAndStoreRollupGroups selects groups responding to this query from
+// observation rollups, given expressions grouping them, and dumps them to the
+// data file as selectAndStoreGroups does.
+func (q *Query) selectAndStoreRollupGroups(columns []string, joinConditions bool) error {
+
+	var results []struct {
+		tableName   struct{} `sql:"observation_rollups,alias:rollup"`
+		Group0      string
+		Group1      string
+		Count       int
+		Numerator   int
+		Denominator int
+	}
+
+	exprs := make([]string, 0, len(columns)+1)
+	for i := range columns {
+		exprs = append(exprs, fmt.Sprintf("%s AS group%d", columns[i], i))
+	}
+	exprs = append(exprs, q.rollupCountClause())
+
+	pq := q.qc.db.Model(&results).ColumnExpr(strings.Join(exprs, ", "))
+
+	if joinConditions {
+		pq = pq.Join("JOIN conditions AS condition ON condition.id = rollup.condition_id")
+	}
+
+	pq = q.rollupWhereClauses(pq)
+	for i := range columns {
+		pq = pq.Group(fmt.Sprintf("group%d", i))
+	}
+
+	if err := pq.Select(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	outfile, err := q.writeResultFile()
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+
+	for _, result := range results {
+		groups := []string{result.Group0, result.Group1}[:len(columns)]
+		if err := q.writeGroupResult(outfile, groups,
+			result.Count, result.Numerator, result.Denominator); err != nil {
+			return err
+		}
+	}
+
+	return outfile.Sync()
+}
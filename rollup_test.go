@@ -0,0 +1,173 @@
+package pto3_test
+
+import (
+	"bufio"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// executeRollupTestQuery runs a query against the query test set, and
+// returns its result lines in sorted order, and how it was answered.
+func executeRollupTestQuery(t *testing.T, encoded string) ([]string, string) {
+	encoded += fmt.Sprintf("&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatalf("query %s failed: %v", encoded, q.ExecutionError)
+	}
+
+	resfile, err := q.ReadResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resfile.Close()
+
+	lines := make([]string, 0)
+	s := bufio.NewScanner(resfile)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	sort.Strings(lines)
+
+	return lines, q.AnsweredFrom
+}
+
+func TestRollupQueries(t *testing.T) {
+	testQueries := []struct {
+		encoded string
+		rollups bool
+	}{
+		{"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=count_targets&target=10.15.16.17", true},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=target_prefix/24/56", true},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=feature&group=week_day&tz=UTC", true},
+		{"time_start=2017-12-04&time_end=2017-12-07&group=source&group=bucket&bucket=2d", true},
+		{"time_start=2017-12-01&time_end=2018-01-01&group=end_month&tz=UTC&condition=pto.test.color.red", true},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=end_day&tz=UTC&numerator=pto.test.color.red&denominator=pto.test.color.*", true},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=source&numerator=pto.test.color.red&denominator=pto.test.color.*&option=count_targets", true},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=end_hour&tz=UTC", false},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=week_day&tz=Asia%2FTokyo", false},
+		{"time_start=2017-12-05T12%3A00%3A00Z&time_end=2017-12-06&group=condition&tz=UTC", false},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=target&on_path=10.33.44.55", false},
+	}
+
+	for i, qspec := range testQueries {
+		expected, answeredFrom := executeRollupTestQuery(t, qspec.encoded+"&option=no_rollups")
+		if answeredFrom != pto3.AnsweredFromObservations {
+			t.Fatalf("query %d with no_rollups answered from %s", i, answeredFrom)
+		}
+
+		results, answeredFrom := executeRollupTestQuery(t, qspec.encoded)
+		if qspec.rollups && answeredFrom != pto3.AnsweredFromRollups {
+			t.Fatalf("query %d answered from %s, expected rollups", i, answeredFrom)
+		} else if !qspec.rollups && answeredFrom != pto3.AnsweredFromObservations {
+			t.Fatalf("query %d answered from %s, expected observations", i, answeredFrom)
+		}
+
+		if len(expected) == 0 {
+			t.Fatalf("query %d has no results", i)
+		}
+		if !reflect.DeepEqual(results, expected) {
+			t.Fatalf("query %d results differ from counting observations: got %v, expected %v", i, results, expected)
+		}
+	}
+}
+
+func countSetRollups(t *testing.T, setID int) int {
+	var n int
+	if _, err := TestDB.QueryOne(pg.Scan(&n), "SELECT count(*) FROM observation_rollups WHERE set_id = ?", setID); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRollupRetraction(t *testing.T) {
+	obs := `{"_analyzer": "https://localhost:8383/rollup_test_analyzer.json", "_sources": ["https://localhost:8383/raw/rollup/rollup-0.ndjson"], "_conditions": ["pto.test.rollup.counted"]}
+["", "2017-12-07T04:05:06Z", "2017-12-07T04:05:07Z", "10.0.0.1 * 10.0.0.2", "pto.test.rollup.counted"]
+["", "2017-12-07T00:00:00Z", "2017-12-08T00:00:01Z", "10.0.0.1 * 10.0.0.3", "pto.test.rollup.counted"]`
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := pto3.CopySetFromObsStream(strings.NewReader(obs), TestDB, TestConfig, cidCache, pto3.NewPathCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countSetRollups(t, set.ID); n != 2 {
+		t.Fatalf("expected 2 rollups for loaded set, got %d", n)
+	}
+
+	if err := set.Retract(TestDB, "rollup test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countSetRollups(t, set.ID); n != 0 {
+		t.Fatalf("expected no rollups for retracted set, got %d", n)
+	}
+}
+
+func TestChunkRollups(t *testing.T) {
+	obs := `{"_analyzer": "https://localhost:8383/chunk_rollup_test_analyzer.json", "_sources": ["https://localhost:8383/raw/rollup/rollup-1.ndjson"], "_conditions": ["pto.test.rollup.first", "pto.test.rollup.second"]}
+["", "2017-12-09T04:05:06Z", "2017-12-09T04:05:07Z", "10.0.2.1 * 10.0.2.2", "pto.test.rollup.first"]
+["", "2017-12-09T05:05:06Z", "2017-12-09T05:05:07Z", "10.0.2.1 * 10.0.2.3", "pto.test.rollup.first"]`
+
+	chunk := `["", "2017-12-10T04:05:06Z", "2017-12-10T04:05:07Z", "10.0.2.1 * 10.0.2.2", "pto.test.rollup.second"]
+["", "2017-12-08T04:05:06Z", "2017-12-08T04:05:07Z", "10.0.2.1 * 10.0.2.4", "pto.test.rollup.first"]`
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidCache := pto3.NewPathCache(0)
+
+	set, err := pto3.CopySetFromObsStream(strings.NewReader(obs), TestDB, TestConfig, cidCache, pidCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := pto3.AppendDataFromObsStream(strings.NewReader(chunk), TestDB, set, "", cidCache, pidCache); err != nil {
+		t.Fatal(err)
+	}
+
+	// statistics merged from the chunk match those over the whole set
+	stored := pto3.ObservationSet{ID: set.ID}
+	if err := stored.SelectByID(TestDB); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := stored.Stats
+	if stats == nil || stats.Observations != 4 || stats.DistinctPaths != 3 || stats.DistinctTargets != 3 {
+		t.Fatalf("bad merged statistics %+v", stats)
+	}
+	if !stats.TimeStart.Equal(time.Date(2017, 12, 8, 4, 5, 6, 0, time.UTC)) ||
+		!stats.TimeEnd.Equal(time.Date(2017, 12, 10, 4, 5, 7, 0, time.UTC)) {
+		t.Fatalf("bad merged time range %v to %v", stats.TimeStart, stats.TimeEnd)
+	}
+	if stats.Conditions["pto.test.rollup.first"] != 3 || stats.Conditions["pto.test.rollup.second"] != 1 {
+		t.Fatalf("bad merged condition counts %v", stats.Conditions)
+	}
+
+	// and the chunk's rollups are added to the set's
+	var n int
+	if _, err := TestDB.QueryOne(pg.Scan(&n), "SELECT sum(observations) FROM observation_rollups WHERE set_id = ?", set.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("expected rollups to count 4 observations, got %d", n)
+	}
+}
@@ -0,0 +1,236 @@
+package pto3
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Observation set supersession graph for PTO3 obs and query.
+// An observation set may declare, via the _supersedes metadata key, that it
+// replaces one or more earlier sets (e.g. after a normalizer or analyzer bug
+// has been fixed and the analysis rerun). Superseded sets are excluded from
+// queries by default.
+
+// ObservationSetSupersession implements a linking table between observation
+// sets and the observation sets they supersede.
+type ObservationSetSupersession struct {
+	ObservationSetID int
+	SupersededSetID  int
+}
+
+// SetIDFromLink extracts an observation set ID from an observation set link,
+// or from a bare hexadecimal set ID.
+func SetIDFromLink(link string) (int, error) {
+	idstr := link[strings.LastIndex(link, "/")+1:]
+	setid, err := strconv.ParseUint(idstr, 16, 32)
+	if err != nil {
+		return 0, PTOErrorf("bad observation set reference %s", link).StatusIs(http.StatusBadRequest)
+	}
+	return int(setid), nil
+}
+
+// selectSupersessions fills in the sets this ObservationSet supersedes and is
+// superseded by from the database.
+func (set *ObservationSet) selectSupersessions(db orm.DB) error {
+	set.Supersedes = nil
+	set.supersededBy = nil
+
+	var supersessions []ObservationSetSupersession
+	err := db.Model(&supersessions).
+		Where("observation_set_id = ?", set.ID).
+		WhereOr("superseded_set_id = ?", set.ID).
+		Order("observation_set_id", "superseded_set_id").
+		Select()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, s := range supersessions {
+		if s.ObservationSetID == set.ID {
+			set.Supersedes = append(set.Supersedes, s.SupersededSetID)
+		} else {
+			set.supersededBy = append(set.supersededBy, s.ObservationSetID)
+		}
+	}
+
+	return nil
+}
+
+// storeSupersessions replaces the supersession links from this ObservationSet
+// in the database with those in its Supersedes field. It fails if any
+// superseded set does not exist, or if the new links would make the
+// supersession graph cyclic. The generations of sets whose supersession
+// changes are bumped, since queries over them will now return different
+// results.
+func (set *ObservationSet) storeSupersessions(db orm.DB) error {
+	var previous []int
+	err := db.Model(&ObservationSetSupersession{}).
+		ColumnExpr("array_agg(superseded_set_id)").
+		Where("observation_set_id = ?", set.ID).
+		Select(pg.Array(&previous))
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if len(set.Supersedes) > 0 {
+		for _, id := range set.Supersedes {
+			if id == set.ID {
+				return PTOErrorf("observation set %x cannot supersede itself", set.ID).StatusIs(http.StatusBadRequest)
+			}
+		}
+
+		// make sure everything we supersede exists
+		count, err := db.Model(&ObservationSet{}).Where("id IN (?)", pg.In(set.Supersedes)).Count()
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		if count != len(uniqueInts(set.Supersedes)) {
+			return PTOErrorf("observation set %x supersedes nonexistent set", set.ID).StatusIs(http.StatusBadRequest)
+		}
+
+		// make sure nothing we supersede already supersedes us, directly or not
+		var cycle struct {
+			Count int
+		}
+		_, err = db.QueryOne(&cycle, `
+			WITH RECURSIVE superseded(id) AS (
+				SELECT unnest(?::int[])
+				UNION
+				SELECT s.superseded_set_id FROM observation_set_supersessions AS s
+				JOIN superseded ON s.observation_set_id = superseded.id
+			) SELECT count(*) FROM superseded WHERE id = ?`,
+			pg.Array(set.Supersedes), set.ID)
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		if cycle.Count > 0 {
+			return PTOErrorf("observation set %x supersession would create a cycle", set.ID).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	if _, err := db.Exec("DELETE FROM observation_set_supersessions WHERE observation_set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, id := range uniqueInts(set.Supersedes) {
+		_, err := db.Exec("INSERT INTO observation_set_supersessions VALUES (?, ?)", set.ID, id)
+		if err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	// bump generations of sets entering or leaving supersession
+	changed := symmetricDifference(previous, set.Supersedes)
+	if len(changed) > 0 {
+		_, err := db.Exec("UPDATE observation_sets SET generation = coalesce(generation, 0) + 1 WHERE id IN (?)",
+			pg.In(changed))
+		if err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// ObservationSetVersions returns the IDs of all observation sets in the same
+// version chain as the given set, i.e. connected to it by supersession in
+// either direction, including the set itself, ordered by creation time. It
+// also returns the subset of those IDs which are current, i.e. not superseded
+// by a set which has not been retracted.
+func ObservationSetVersions(db orm.DB, setid int) ([]int, []int, error) {
+	var versions []struct {
+		ID      int
+		Current bool
+	}
+
+	_, err := db.Query(&versions, `
+		WITH RECURSIVE chain(id) AS (
+			SELECT ?::int
+			UNION
+			SELECT CASE WHEN s.observation_set_id = chain.id
+				THEN s.superseded_set_id ELSE s.observation_set_id END
+			FROM observation_set_supersessions AS s
+			JOIN chain ON s.observation_set_id = chain.id OR s.superseded_set_id = chain.id
+		) SELECT o.id, o.id NOT IN (`+supersededSetsSubquery+`) AS current
+		FROM observation_sets AS o JOIN chain ON o.id = chain.id
+		ORDER BY o.created, o.id`, setid)
+	if err != nil {
+		return nil, nil, PTOWrapError(err)
+	}
+
+	if len(versions) == 0 {
+		return nil, nil, pg.ErrNoRows
+	}
+
+	all := make([]int, len(versions))
+	current := make([]int, 0)
+	for i, v := range versions {
+		all[i] = v.ID
+		if v.Current {
+			current = append(current, v.ID)
+		}
+	}
+
+	return all, current, nil
+}
+
+// supersededSetsSubquery selects the IDs of all observation sets superseded
+// by a set which has not itself been retracted.
+const supersededSetsSubquery = `SELECT s.superseded_set_id FROM observation_set_supersessions AS s
+	JOIN observation_sets AS superseding ON superseding.id = s.observation_set_id
+	WHERE superseding.retracted IS NULL`
+
+func uniqueInts(in []int) []int {
+	seen := make(map[int]struct{})
+	out := make([]int, 0, len(in))
+	for _, i := range in {
+		if _, ok := seen[i]; !ok {
+			seen[i] = struct{}{}
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func symmetricDifference(a []int, b []int) []int {
+	am := make(map[int]struct{})
+	bm := make(map[int]struct{})
+	for _, i := range a {
+		am[i] = struct{}{}
+	}
+	for _, i := range b {
+		bm[i] = struct{}{}
+	}
+
+	out := make([]int, 0)
+	for i := range am {
+		if _, ok := bm[i]; !ok {
+			out = append(out, i)
+		}
+	}
+	for i := range bm {
+		if _, ok := am[i]; !ok {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// supersessionLinks renders a list of set IDs as links, if a configuration
+// is available, or as bare hexadecimal set IDs otherwise.
+func supersessionLinks(config *PTOConfiguration, setIds []int) []string {
+	out := make([]string, len(setIds))
+	for i, id := range setIds {
+		if config != nil {
+			out[i] = LinkForSetID(config, id)
+		} else {
+			out[i] = fmt.Sprintf("%x", id)
+		}
+	}
+	return out
+}
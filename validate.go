@@ -0,0 +1,373 @@
+package pto3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Validation of observation set files for PTO3 obs.
+// Loading an observation set file stops at the first problem it finds. An
+// observation set file can instead be validated without loading it, which
+// reports every bad line in the file, up to a configurable limit.
+
+// DefaultValidationErrorCap is the default number of problems listed in a
+// validation report.
+const DefaultValidationErrorCap = 100
+
+// ObsLineProblem describes a problem on a line of an observation set file.
+// Problems with the file as a whole have line zero.
+type ObsLineProblem struct {
+	Line    int    `json:"line"`
+	Problem string `json:"problem"`
+}
+
+// ObsValidationReport describes the problems found in an observation set
+// file, in line order. ErrorCount counts all problems found, even if Errors
+// was truncated.
+type ObsValidationReport struct {
+	Lines        int              `json:"lines"`
+	Observations int              `json:"observations"`
+	ErrorCount   int              `json:"error_count"`
+	Errors       []ObsLineProblem `json:"errors"`
+	Truncated    bool             `json:"truncated"`
+}
+
+// Valid returns true if no problems were found in the file.
+func (rep *ObsValidationReport) Valid() bool {
+	return rep.ErrorCount == 0
+}
+
+// obsValidator tracks the state of the validation of an observation set
+// file. If the file's conditions are not known when validation begins, the
+// lines on which each condition was used are kept until all metadata has been
+// read, up to the error cap.
+type obsValidator struct {
+	db        orm.DB
+	maxErrors int
+	report    *ObsValidationReport
+	// conditions declared by the set being checked; nil if not yet known
+	conditionDeclared map[string]struct{}
+	// whether to keep conditions for checking once they are known
+	deferConditions bool
+	conditionLines  map[string][]int
+	conditionCount  map[string]int
+	// registry entries for conditions seen, nil if unregistered
+	conditions map[string]*Condition
+	pathSet    map[string]struct{}
+}
+
+// newObsValidator creates a validator reporting at most maxErrors problems,
+// or all of them if maxErrors is not positive.
+func newObsValidator(db orm.DB, maxErrors int) *obsValidator {
+	return &obsValidator{
+		db:             db,
+		maxErrors:      maxErrors,
+		report:         &ObsValidationReport{Errors: make([]ObsLineProblem, 0)},
+		conditionLines: make(map[string][]int),
+		conditionCount: make(map[string]int),
+		conditions:     make(map[string]*Condition),
+		pathSet:        make(map[string]struct{}),
+	}
+}
+
+// declaredConditions returns the set of names of the given conditions.
+func declaredConditions(declared []Condition) map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, c := range declared {
+		names[c.Name] = struct{}{}
+	}
+	return names
+}
+
+// problem records a problem on a line.
+func (v *obsValidator) problem(lineno int, problem string) {
+	v.report.ErrorCount++
+	if v.maxErrors <= 0 || len(v.report.Errors) < v.maxErrors {
+		v.report.Errors = append(v.report.Errors, ObsLineProblem{lineno, problem})
+	}
+}
+
+// undeclaredConditionProblem describes the use of an undeclared condition.
+func undeclaredConditionProblem(name string) string {
+	return fmt.Sprintf("observation has condition %s not declared in set", name)
+}
+
+// checkCondition checks that a condition is declared, if the declared
+// conditions are known or deferred until they are, and checks the value of an observation against the
+// condition's registered value type, if a database is available.
+func (v *obsValidator) checkCondition(lineno int, jslice []string) error {
+	name := jslice[4]
+
+	if v.conditionDeclared != nil {
+		if _, ok := v.conditionDeclared[name]; !ok {
+			v.problem(lineno, undeclaredConditionProblem(name))
+		}
+	} else if v.deferConditions {
+		if v.maxErrors <= 0 || len(v.conditionLines[name]) < v.maxErrors {
+			v.conditionLines[name] = append(v.conditionLines[name], lineno)
+		}
+		v.conditionCount[name]++
+	}
+
+	if v.db == nil {
+		return nil
+	}
+
+	c, ok := v.conditions[name]
+	if !ok {
+		c = &Condition{Name: name}
+		if err := c.SelectByName(v.db); err == pg.ErrNoRows {
+			c = nil
+		} else if err != nil {
+			return PTOWrapError(err)
+		}
+		v.conditions[name] = c
+	}
+
+	if c != nil && c.ValueType != "" {
+		value := ""
+		if len(jslice) >= 6 {
+			value = jslice[5]
+		}
+		if err := c.ValidateValue(value); err != nil {
+			v.problem(lineno, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// parseObservation counts and parses an observation line, returning nil if
+// it cannot be parsed.
+func (v *obsValidator) parseObservation(lineno int, line string) []string {
+	v.report.Observations++
+
+	jslice, err := parseObsLine(line)
+	if err != nil {
+		v.problem(lineno, err.Error())
+		return nil
+	}
+
+	return jslice
+}
+
+// checkObservation checks an observation parsed by parseObservation.
+func (v *obsValidator) checkObservation(lineno int, jslice []string) error {
+	if err := checkObsElements(jslice); err != nil {
+		v.problem(lineno, err.Error())
+	} else if _, ok := v.pathSet[jslice[3]]; !ok {
+		p := Path{String: jslice[3]}
+		if err := p.Parse(); err != nil {
+			v.problem(lineno, "bad path: "+err.Error())
+		} else {
+			// remember good paths, a batch at a time
+			if len(v.pathSet) >= obsLoadBatchSize {
+				v.pathSet = make(map[string]struct{})
+			}
+			v.pathSet[jslice[3]] = struct{}{}
+		}
+	}
+
+	return v.checkCondition(lineno, jslice)
+}
+
+// checkDeferredConditions checks the conditions seen against those declared,
+// once they are known.
+func (v *obsValidator) checkDeferredConditions(declared []Condition) {
+	names := declaredConditions(declared)
+
+	for name, lines := range v.conditionLines {
+		if _, ok := names[name]; ok {
+			continue
+		}
+		for _, lineno := range lines {
+			v.report.Errors = append(v.report.Errors,
+				ObsLineProblem{lineno, undeclaredConditionProblem(name)})
+		}
+		v.report.ErrorCount += v.conditionCount[name]
+	}
+}
+
+// finish puts the problems in the report in line order, and truncates them to
+// the error cap.
+func (v *obsValidator) finish() {
+	sort.SliceStable(v.report.Errors, func(i, j int) bool {
+		return v.report.Errors[i].Line < v.report.Errors[j].Line
+	})
+
+	if v.maxErrors > 0 && len(v.report.Errors) > v.maxErrors {
+		v.report.Errors = v.report.Errors[:v.maxErrors]
+	}
+
+	v.report.Truncated = v.report.ErrorCount > len(v.report.Errors)
+}
+
+// ValidateObsStream reads an observation set file for a single set from a
+// stream, and reports problems with it without loading it: malformed lines
+// and metadata, bad or misordered times, bad paths, and undeclared
+// conditions. If declared is nil, conditions are checked against those
+// declared in the file's metadata, which must be present and is merged across
+// lines as when loading; otherwise, against the given conditions, and
+// metadata in the file is ignored. Files containing several sets are checked
+// with ValidateObsSetsStream. If a database is given, values are checked
+// against the value types of conditions in its registry. At most maxErrors
+// problems are listed in the report, or all of them if maxErrors is not
+// positive. An error is returned only if the file cannot be read or the
+// database queried.
+func ValidateObsStream(r io.Reader, db orm.DB, declared []Condition, maxErrors int) (*ObsValidationReport, error) {
+	v := newObsValidator(db, maxErrors)
+
+	if declared != nil {
+		v.conditionDeclared = declaredConditions(declared)
+	} else {
+		v.deferConditions = true
+	}
+
+	// metadata is merged as when loading
+	set := new(ObservationSet)
+	metadataSeen := false
+	metadataGood := false
+
+	lineno := 0
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		lineno++
+		line := strings.TrimSpace(in.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		switch line[0] {
+		case '{':
+			if declared != nil {
+				continue
+			}
+			metadataSeen = true
+			if err := set.mergeMetadata([]byte(line)); err != nil {
+				v.problem(lineno, "error in metadata: "+err.Error())
+			} else {
+				metadataGood = true
+			}
+		case '[':
+			if jslice := v.parseObservation(lineno, line); jslice != nil {
+				if err := v.checkObservation(lineno, jslice); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			v.problem(lineno, strayLineProblem)
+		}
+	}
+
+	if err := in.Err(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	v.report.Lines = lineno
+
+	if declared == nil {
+		if !metadataSeen {
+			v.report.Errors = append(v.report.Errors, ObsLineProblem{0, "observation set file has no metadata"})
+			v.report.ErrorCount++
+		}
+		// without good metadata, there is nothing to check conditions against
+		if metadataGood {
+			v.checkDeferredConditions(set.Conditions)
+		}
+	}
+
+	v.finish()
+
+	return v.report, nil
+}
+
+// ValidateObsSetsStream reads an observation set file containing one or more
+// observation sets from a stream, as uploaded to create them, and reports
+// problems with it without loading it, as ValidateObsStream does. As when
+// loading such a file, each metadata object begins a new set, and
+// observations are checked against the conditions declared by the set whose
+// metadata precedes them, unless their set ID refers to an earlier set in the
+// file. Observations in a set whose metadata is malformed are not checked
+// against its conditions.
+func ValidateObsSetsStream(r io.Reader, db orm.DB, maxErrors int) (*ObsValidationReport, error) {
+	v := newObsValidator(db, maxErrors)
+
+	// conditions declared by each set, by the set ID of its first observation
+	var current map[string]struct{}
+	currentBound := false
+	setsSeen := false
+	declaredBySetID := make(map[string]map[string]struct{})
+
+	lineno := 0
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		lineno++
+		line := strings.TrimSpace(in.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		switch line[0] {
+		case '{':
+			// new observation set
+			setsSeen = true
+			currentBound = false
+			set := new(ObservationSet)
+			if err := set.UnmarshalJSON([]byte(line)); err != nil {
+				v.problem(lineno, "error in metadata: "+err.Error())
+				current = nil
+			} else {
+				current = declaredConditions(set.Conditions)
+			}
+		case '[':
+			jslice := v.parseObservation(lineno, line)
+			if jslice == nil {
+				continue
+			}
+
+			// find the set this observation belongs to
+			if !setsSeen {
+				v.problem(lineno, "observation without preceding metadata")
+				v.conditionDeclared = nil
+			} else if setid := jslice[0]; setid == "" {
+				v.conditionDeclared = current
+			} else if !currentBound {
+				declaredBySetID[setid] = current
+				currentBound = true
+				v.conditionDeclared = current
+			} else if declared, ok := declaredBySetID[setid]; ok {
+				v.conditionDeclared = declared
+			} else {
+				v.problem(lineno, fmt.Sprintf("observation refers to unknown set %s", setid))
+				v.conditionDeclared = nil
+			}
+
+			if err := v.checkObservation(lineno, jslice); err != nil {
+				return nil, err
+			}
+		default:
+			v.problem(lineno, strayLineProblem)
+		}
+	}
+
+	if err := in.Err(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	v.report.Lines = lineno
+
+	if !setsSeen {
+		v.report.Errors = append(v.report.Errors, ObsLineProblem{0, "observation set file has no metadata"})
+		v.report.ErrorCount++
+	}
+
+	v.finish()
+
+	return v.report, nil
+}
@@ -0,0 +1,161 @@
+package pto3_test
+
+import (
+	"strings"
+	"testing"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestValidateObsStream(t *testing.T) {
+	metadata := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"]}`
+
+	good := strings.Join([]string{
+		`["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`,
+		`["", "2017-10-05T10:07:00Z", "2017-10-05T10:08:00Z", "10.0.0.1 * 10.0.0.7", "pto.test.succeeded"]`,
+		metadata,
+	}, "\n")
+
+	report, err := pto3.ValidateObsStream(strings.NewReader(good), nil, nil, pto3.DefaultValidationErrorCap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() || report.Lines != 3 || report.Observations != 2 {
+		t.Fatalf("unexpected report for good file: %+v", report)
+	}
+
+	// metadata is merged across lines, as when loading
+	split := strings.Join([]string{
+		metadata,
+		`["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`,
+		`{"validate_test": "split"}`,
+	}, "\n")
+
+	report, err = pto3.ValidateObsStream(strings.NewReader(split), nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() {
+		t.Fatalf("unexpected report for file with split metadata: %+v", report)
+	}
+
+	// and lines which are neither observations nor metadata are problems
+	report, err = pto3.ValidateObsStream(strings.NewReader(good+"\n# comment"), nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 1 || report.Errors[0].Line != 4 {
+		t.Fatalf("unexpected report for file with stray line: %+v", report)
+	}
+
+	// every bad line is reported, in line order, with undeclared conditions
+	// reported even though metadata follows them
+	bad := strings.Join([]string{
+		`["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.failed"]`,
+		`["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6"`,
+		`["", "2017-10-05 10:06", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`,
+		`["", "2017-10-05T10:06:00Z", "2017-10-05T10:05:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`,
+		`["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", " ", "pto.test.succeeded"]`,
+		`["", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`,
+		metadata,
+	}, "\n")
+
+	report, err = pto3.ValidateObsStream(strings.NewReader(bad), nil, nil, pto3.DefaultValidationErrorCap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 5 || len(report.Errors) != 5 || report.Truncated {
+		t.Fatalf("unexpected report for bad file: %+v", report)
+	}
+	for i, lineno := range []int{1, 2, 3, 4, 5} {
+		if report.Errors[i].Line != lineno {
+			t.Fatalf("expected problem %d on line %d, got %+v", i, lineno, report.Errors[i])
+		}
+	}
+
+	// the error cap truncates the report, but not the count
+	report, err = pto3.ValidateObsStream(strings.NewReader(bad), nil, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 5 || len(report.Errors) != 2 || !report.Truncated || report.Errors[1].Line != 2 {
+		t.Fatalf("unexpected truncated report for bad file: %+v", report)
+	}
+
+	// a file without metadata is checked against given conditions
+	declared := []pto3.Condition{pto3.Condition{Name: "pto.test.failed"}}
+	report, err = pto3.ValidateObsStream(strings.NewReader(good), nil, declared, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 2 {
+		t.Fatalf("unexpected report for good file with other conditions: %+v", report)
+	}
+
+	// and is otherwise invalid
+	report, err = pto3.ValidateObsStream(strings.NewReader(bad[:strings.LastIndex(bad, "\n")]), nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 5 || report.Errors[0].Line != 0 {
+		t.Fatalf("unexpected report for file without metadata: %+v", report)
+	}
+}
+
+func TestValidateObsSetsStream(t *testing.T) {
+	metadataSucceeded := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"]}`
+	metadataFailed := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.failed"]}`
+
+	// each set's observations are checked against its own conditions, and
+	// set IDs refer back to earlier sets
+	good := strings.Join([]string{
+		metadataSucceeded,
+		`["a", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`,
+		metadataFailed,
+		`["b", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.failed"]`,
+		`["a", "2017-10-05T10:07:00Z", "2017-10-05T10:07:00Z", "10.0.0.1 * 10.0.0.7", "pto.test.succeeded"]`,
+	}, "\n")
+
+	report, err := pto3.ValidateObsSetsStream(strings.NewReader(good), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() || report.Lines != 5 || report.Observations != 3 {
+		t.Fatalf("unexpected report for good multi-set file: %+v", report)
+	}
+
+	// conditions declared by only one set are problems in the others, as are
+	// observations outside any set or referring to unknown sets
+	bad := strings.Join([]string{
+		`["a", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`,
+		metadataSucceeded,
+		`["a", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.failed"]`,
+		metadataFailed,
+		`["b", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.succeeded"]`,
+		`["c", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.failed"]`,
+		`["a", "2017-10-05T10:06:00Z", "2017-10-05T10:06:00Z", "10.0.0.1 * 10.0.0.6", "pto.test.failed"]`,
+	}, "\n")
+
+	report, err = pto3.ValidateObsSetsStream(strings.NewReader(bad), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 5 {
+		t.Fatalf("unexpected report for bad multi-set file: %+v", report)
+	}
+	for i, lineno := range []int{1, 3, 5, 6, 7} {
+		if report.Errors[i].Line != lineno {
+			t.Fatalf("expected problem %d on line %d, got %+v", i, lineno, report.Errors[i])
+		}
+	}
+
+	// whereas checked as a single set, the last conditions declared apply to
+	// every observation, whatever its set ID
+	report, err = pto3.ValidateObsStream(strings.NewReader(bad), nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorCount != 2 || report.Errors[0].Line != 1 || report.Errors[1].Line != 5 {
+		t.Fatalf("unexpected report for multi-set file as a single set: %+v", report)
+	}
+}